@@ -0,0 +1,284 @@
+// Package imeclient is a client for the IME server's WebSocket protocol.
+//
+// A Client multiplexes any number of concurrent requests over one
+// connection to /socket, matching responses to requests by RequestID.
+// Calls may be made blocking, with Call, or asynchronously, with Go. When
+// the connection drops, outstanding calls fail with ErrDisconnected and the
+// next call dials again. Composer state lives in the server connection, so
+// a reconnect starts every composition session afresh.
+package imeclient
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed is returned for calls made after Close
+	ErrClosed = errors.New("imeclient: client is closed")
+
+	// ErrDisconnected is returned for calls outstanding when the
+	// connection to the server is lost
+	ErrDisconnected = errors.New("imeclient: connection lost")
+
+	// ErrTimeout is returned by Call when no response arrives in time
+	ErrTimeout = errors.New("imeclient: timed out waiting for response")
+)
+
+// Call is an asynchronous request in progress
+type Call struct {
+	Request  *Request
+	Response *Response
+	Error    error
+	Done     chan *Call
+}
+
+// done delivers a finished call without ever blocking the client
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+	default:
+	}
+}
+
+// Client is a connection to an IME server. Its exported fields may be
+// changed before the first call
+type Client struct {
+	URL    string
+	Origin string
+
+	// Timeout bounds how long Call waits for a response. Zero waits forever
+	Timeout time.Duration
+
+	// MaxRetries is how many times a request is retried, reconnecting in
+	// between, when it cannot be sent
+	MaxRetries int
+
+	// lock guards the fields below; it is never held across network I/O
+	// or sleeps, so that readLoop can always deliver responses. dialLock
+	// serializes dialing and writeLock serializes sends on the connection
+	lock      sync.Mutex
+	dialLock  sync.Mutex
+	writeLock sync.Mutex
+	conn      *websocket.Conn
+	nextID    int64
+	pending   map[int64]*Call
+	closed    bool
+}
+
+// NewClient returns a client for the server at url, e.g.
+// ws://localhost:8081/socket, without connecting yet. origin is sent in the
+// handshake and must be on the server's allowlist if it has one
+func NewClient(url, origin string) *Client {
+	return &Client{
+		URL:        url,
+		Origin:     origin,
+		Timeout:    10 * time.Second,
+		MaxRetries: 3,
+		pending:    make(map[int64]*Call),
+	}
+}
+
+// Dial returns a client connected to the server at url
+func Dial(url, origin string) (*Client, error) {
+	c := NewClient(url, origin)
+	if _, err := c.connection(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// connection returns the current connection, dialing the server if there
+// is none
+func (c *Client) connection() (*websocket.Conn, error) {
+	c.dialLock.Lock()
+	defer c.dialLock.Unlock()
+	c.lock.Lock()
+	conn, closed := c.conn, c.closed
+	c.lock.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := websocket.Dial(c.URL, "", c.Origin)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		conn.Close()
+		return nil, ErrClosed
+	}
+	c.conn = conn
+	c.lock.Unlock()
+	go c.readLoop(conn)
+	return conn, nil
+}
+
+// readLoop delivers responses arriving on conn until it fails
+func (c *Client) readLoop(conn *websocket.Conn) {
+	for {
+		var resp Response
+		if err := websocket.JSON.Receive(conn, &resp); err != nil {
+			c.drop(conn)
+			return
+		}
+		c.lock.Lock()
+		call, ok := c.pending[resp.RequestID]
+		delete(c.pending, resp.RequestID)
+		c.lock.Unlock()
+		if ok {
+			call.Response = &resp
+			call.done()
+		}
+	}
+}
+
+// drop closes conn, if it is still current, and fails every outstanding call
+func (c *Client) drop(conn *websocket.Conn) {
+	c.lock.Lock()
+	current := c.conn == conn
+	if current {
+		c.detach()
+	}
+	c.lock.Unlock()
+	if current {
+		conn.Close()
+	}
+}
+
+// detach forgets the current connection, which the caller closes once the
+// lock is released, and fails every outstanding call. Called with the lock
+// held
+func (c *Client) detach() {
+	c.conn = nil
+	for id, call := range c.pending {
+		delete(c.pending, id)
+		call.Error = ErrDisconnected
+		call.done()
+	}
+}
+
+// Go sends a request without waiting for the response. The call is sent
+// on done when complete; if done is nil a new channel is allocated. done
+// must be buffered. Requests that cannot be sent are retried, reconnecting
+// in between, except COMPOSE_QUERY keys once a send was attempted: the
+// server may have applied the key already
+func (c *Client) Go(req *Request, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	}
+	call := &Call{Request: req, Done: done}
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		call.Error = ErrClosed
+		call.done()
+		return call
+	}
+	c.nextID++
+	req.RequestID = c.nextID
+	c.lock.Unlock()
+	if req.Timestamp == 0 {
+		req.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(50<<uint(attempt)) * time.Millisecond)
+		}
+		var conn *websocket.Conn
+		if conn, err = c.connection(); err == ErrClosed {
+			break
+		} else if err != nil {
+			continue
+		}
+
+		c.lock.Lock()
+		c.pending[req.RequestID] = call
+		c.lock.Unlock()
+		c.writeLock.Lock()
+		err = websocket.JSON.Send(conn, req)
+		c.writeLock.Unlock()
+		if err == nil {
+			return call
+		}
+
+		c.lock.Lock()
+		_, stillPending := c.pending[req.RequestID]
+		delete(c.pending, req.RequestID)
+		c.lock.Unlock()
+		c.drop(conn)
+		// the connection was lost meanwhile and the call failed with it
+		if !stillPending {
+			return call
+		}
+		if req.QueryType == COMPOSE_QUERY {
+			break
+		}
+	}
+	call.Error = err
+	call.done()
+	return call
+}
+
+// Call sends a request and waits for its response
+func (c *Client) Call(req *Request) (*Response, error) {
+	call := c.Go(req, make(chan *Call, 1))
+	var timeout <-chan time.Time
+	if c.Timeout > 0 {
+		timer := time.NewTimer(c.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-call.Done:
+		return call.Response, call.Error
+	case <-timeout:
+		c.lock.Lock()
+		delete(c.pending, req.RequestID)
+		c.lock.Unlock()
+		return nil, ErrTimeout
+	}
+}
+
+// Lookup returns the candidates for a query of the given type
+func (c *Client) Lookup(queryType int, query string) ([]Character, error) {
+	resp, err := c.Call(&Request{QueryType: queryType, Query: query})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Candidates()
+}
+
+// Compose feeds a key to the composer of sessionID and returns its state
+func (c *Client) Compose(sessionID, key string) (*CompositionState, error) {
+	resp, err := c.Call(&Request{SessionID: sessionID, QueryType: COMPOSE_QUERY, Query: key})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Composition()
+}
+
+// Close shuts the connection down and fails any outstanding calls
+func (c *Client) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	conn := c.conn
+	if conn != nil {
+		c.detach()
+	}
+	c.lock.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package imeclient
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoServer is a stand-in IME server answering every request with its
+// query. Each connection is closed after closeAfter requests, if set
+type echoServer struct {
+	*httptest.Server
+	closeAfter int
+
+	lock        sync.Mutex
+	connections int
+}
+
+func newEchoServer(closeAfter int) *echoServer {
+	s := &echoServer{closeAfter: closeAfter}
+	s.Server = httptest.NewServer(websocket.Handler(s.serve))
+	return s
+}
+
+func (s *echoServer) serve(ws *websocket.Conn) {
+	s.lock.Lock()
+	s.connections++
+	s.lock.Unlock()
+	for served := 0; s.closeAfter == 0 || served < s.closeAfter; served++ {
+		var req Request
+		if err := websocket.JSON.Receive(ws, &req); err != nil {
+			return
+		}
+		data, _ := json.Marshal(req.Query)
+		websocket.JSON.Send(ws, Response{req.SessionID, RESPONSE_OK, data, req.Timestamp, nil, req.RequestID})
+	}
+	ws.Close()
+}
+
+func (s *echoServer) url() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/socket"
+}
+
+// callEcho calls the server with query and checks that it comes back
+func callEcho(c *Client, query string) error {
+	resp, err := c.Call(&Request{QueryType: CHAR_QUERY, Query: query})
+	if err != nil {
+		return fmt.Errorf("Call(%q): %v", query, err)
+	}
+	var got string
+	if err = json.Unmarshal(resp.Data, &got); err != nil || got != query {
+		return fmt.Errorf("Call(%q) answered %s", query, resp.Data)
+	}
+	return nil
+}
+
+// echo is callEcho failing the test, for the test goroutine only
+func echo(t *testing.T, c *Client, query string) {
+	t.Helper()
+	if err := callEcho(c, query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	server := newEchoServer(0)
+	defer server.Close()
+	c, err := Dial(server.url(), "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	queries := []string{"我", "們", "行", "走", "銀"}
+	errs := make(chan error, len(queries))
+	for _, query := range queries {
+		go func(query string) {
+			errs <- callEcho(c, query)
+		}(query)
+	}
+	for range queries {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	server := newEchoServer(1)
+	defer server.Close()
+	c := NewClient(server.url(), "http://localhost/")
+	defer c.Close()
+
+	echo(t, c, "我")
+	// wait for the client to see the server close the connection
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		c.lock.Lock()
+		conn := c.conn
+		c.lock.Unlock()
+		if conn == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection closed by the server was kept")
+		}
+	}
+	echo(t, c, "們")
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.connections != 2 {
+		t.Errorf("server saw %d connections, want 2", server.connections)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	server := newEchoServer(0)
+	defer server.Close()
+	c, err := Dial(server.url(), "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err = c.Call(&Request{QueryType: CHAR_QUERY, Query: "我"}); err != ErrClosed {
+		t.Errorf("Call after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	server := newEchoServer(0)
+	url := server.url()
+	server.Close()
+	c := NewClient(url, "http://localhost/")
+	c.MaxRetries = 1
+	call := <-c.Go(&Request{QueryType: COMPOSE_QUERY, Query: "ㄅ"}, nil).Done
+	if call.Error == nil {
+		t.Error("call to a closed server succeeded")
+	}
+}
@@ -0,0 +1,139 @@
+package imeclient
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Query types understood by the server
+const (
+	ZHUYIN_QUERY    int = 0
+	PINYIN_QUERY    int = 1
+	DEFINITON_QUERY int = 2
+	CHAR_QUERY      int = 3
+	COMPOSE_QUERY   int = 4
+	DIALECT_QUERY   int = 5
+	JYUTPING_QUERY  int = 6
+)
+
+// Response types sent by the server
+const (
+	RESPONSE_OK           int = 0
+	RESPONSE_ERROR        int = 1
+	RESPONSE_RATE_LIMITED int = 2
+)
+
+// Request is a query sent to the server. RequestID is filled in by the
+// client. More asks for the DICT server definitions on top of the DB ones,
+// when the server has one configured. Languages lists the preferred
+// definition languages, the server falling back to English. Dialect is
+// the code of the dialect of DIALECT_QUERY syllables, such as nan or hak,
+// and of the syllables typed by COMPOSE_QUERY keys, Mandarin when empty.
+// Token identifies a user whose own dictionary is merged into lookups
+type Request struct {
+	SessionID     string
+	QueryType     int
+	Query         string
+	Timestamp     int64
+	Page          int
+	PageSize      int
+	SelectionKeys string
+	RequestID     int64
+	More          bool
+	Languages     []string
+	Dialect       string
+	Token         string
+}
+
+// Response is the server's answer to a Request. Data is left encoded
+// until the caller knows what it holds
+type Response struct {
+	SessionID    string
+	ResponseType int
+	Data         json.RawMessage
+	Timestamp    int64
+	Paging       *PageInfo
+	RequestID    int64
+}
+
+// Character is a candidate character returned by a lookup
+type Character struct {
+	Id         int
+	Character  string
+	Zhuyin     string
+	Pinyin     string
+	Tone       int
+	Definition string
+	Freq       int
+	Jyutping   string
+}
+
+// PageInfo describes which page of candidates a response carries
+type PageInfo struct {
+	Page      int
+	PageSize  int
+	PageCount int
+	Total     int
+}
+
+// CompositionEvent is an action to apply to the client's document
+type CompositionEvent struct {
+	Type string
+	Text string
+}
+
+// CompositionState is the state of a session's composer after a key.
+// SelectionKeys are the keys picking the candidates shown, in order
+type CompositionState struct {
+	Preedit       string
+	Tone          int
+	Candidates    []Character
+	Page          int
+	PageCount     int
+	Total         int
+	Events        []CompositionEvent
+	SelectionKeys []string
+}
+
+// ServerError is returned when the server answers with an error response
+type ServerError struct {
+	ResponseType int
+	Message      string
+}
+
+func (e *ServerError) Error() string {
+	if e.ResponseType == RESPONSE_RATE_LIMITED {
+		return "imeclient: rate limited: " + e.Message
+	}
+	return fmt.Sprintf("imeclient: server error %d: %s", e.ResponseType, e.Message)
+}
+
+// Err returns a *ServerError if the response is not RESPONSE_OK
+func (r *Response) Err() error {
+	if r.ResponseType == RESPONSE_OK {
+		return nil
+	}
+	var message string
+	json.Unmarshal(r.Data, &message)
+	return &ServerError{r.ResponseType, message}
+}
+
+// Candidates decodes the candidates of a lookup response
+func (r *Response) Candidates() ([]Character, error) {
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	var candidates []Character
+	err := json.Unmarshal(r.Data, &candidates)
+	return candidates, err
+}
+
+// Composition decodes the composer state of a COMPOSE_QUERY response
+func (r *Response) Composition() (*CompositionState, error) {
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	var state CompositionState
+	err := json.Unmarshal(r.Data, &state)
+	return &state, err
+}
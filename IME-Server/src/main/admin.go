@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Admin actions on dictionary entries
+const (
+	ADMIN_GET    = "get"
+	ADMIN_CREATE = "create"
+	ADMIN_UPDATE = "update"
+	ADMIN_DELETE = "delete"
+	ADMIN_AUDIT  = "audit"
+)
+
+// maxAdminBody bounds the size of admin request bodies
+const maxAdminBody = 64 << 10
+
+// defaultAuditLimit is the number of audit entries listed by default
+const defaultAuditLimit = 50
+
+var (
+	errEntryNotFound = errors.New("no such entry")
+	errUnauthorized  = errors.New("missing or unknown admin token")
+)
+
+// AdminRequest is an object that asks the DB thread to read or change a
+// character or phrase on behalf of User. Id names the entry to read,
+// update or delete
+type AdminRequest struct {
+	User      string
+	Action    string
+	Kind      string
+	Id        int
+	Character Character
+	Phrase    Phrase
+	Limit     int
+	WriteBack chan *AdminResult
+}
+
+// AdminResult is the entry an admin action read or left, the entry as it
+// was before a delete, or the audit trail
+type AdminResult struct {
+	Entry interface{}
+	Err   error
+}
+
+// AuditEntry records a change to the dictionary: who made it, when, and
+// the entry before and after, as JSON. Before is empty for creations and
+// After for deletions
+type AuditEntry struct {
+	Id     int
+	At     string
+	User   string
+	Action string
+	Kind   string
+	Entry  int
+	Before string
+	After  string
+}
+
+// ValidateCharacter checks that a character entry is a single Chinese
+// character whose Zhuyin, Pinyin and tone agree. An empty Pinyin is filled
+// in from the Zhuyin, and a tone digit or mark on the Pinyin is removed
+func ValidateCharacter(c *Character) error {
+	r, _ := utf8.DecodeRuneInString(c.Character)
+	if utf8.RuneCountInString(c.Character) != 1 || !unicode.Is(unicode.Han, r) {
+		return fmt.Errorf("%q is not a single Chinese character", c.Character)
+	}
+	for _, r := range c.Zhuyin {
+		if !isZhuyin(string(r)) {
+			return fmt.Errorf("%q is not Zhuyin", c.Zhuyin)
+		}
+	}
+	pinyin, ok := ZhuyinToPinyin(c.Zhuyin)
+	if !ok {
+		return fmt.Errorf("%q is not a Zhuyin syllable", c.Zhuyin)
+	}
+	if c.Tone < 1 || c.Tone > 5 {
+		return fmt.Errorf("tone %d is not 1 to 5", c.Tone)
+	}
+	if c.Freq < 0 {
+		return errors.New("frequency must not be negative")
+	}
+	if c.Pinyin == "" {
+		c.Pinyin = pinyin
+		return nil
+	}
+
+	zhuyin, tone, ok := PinyinToZhuyin(c.Pinyin)
+	if !ok {
+		return fmt.Errorf("%q is not a Pinyin syllable", c.Pinyin)
+	}
+	if zhuyin != c.Zhuyin {
+		return fmt.Errorf("Pinyin %q reads %s, not %s", c.Pinyin, zhuyin, c.Zhuyin)
+	}
+	if tone >= 0 && tone != c.Tone {
+		return fmt.Errorf("Pinyin %q has tone %d, not %d", c.Pinyin, tone, c.Tone)
+	}
+	c.Pinyin, _ = splitPinyinTone(c.Pinyin)
+	return nil
+}
+
+// ValidatePhrase checks that a phrase entry is made of two or more Chinese
+// characters. Its character row is checked by the DB thread
+func ValidatePhrase(p *Phrase) error {
+	if utf8.RuneCountInString(p.Phrase) < 2 {
+		return fmt.Errorf("%q is not a phrase of two or more characters", p.Phrase)
+	}
+	for _, r := range p.Phrase {
+		if !unicode.Is(unicode.Han, r) {
+			return fmt.Errorf("%q is not made of Chinese characters", p.Phrase)
+		}
+	}
+	if p.Freq < 0 {
+		return errors.New("frequency must not be negative")
+	}
+	return nil
+}
+
+// Admin runs an admin action on the DB thread. Entries are validated
+// before they are sent
+func (ref ReferenceStore) Admin(request AdminRequest) *AdminResult {
+	if request.Action == ADMIN_CREATE || request.Action == ADMIN_UPDATE {
+		var err error
+		switch request.Kind {
+		case DEFINITION_CHARACTER:
+			err = ValidateCharacter(&request.Character)
+		case DEFINITION_PHRASE:
+			err = ValidatePhrase(&request.Phrase)
+		}
+		if err != nil {
+			return &AdminResult{nil, err}
+		}
+	}
+	request.WriteBack = make(chan *AdminResult)
+	metrics.QueueAdd(1)
+	ref.adminQueue <- &request
+	result := <-request.WriteBack
+	metrics.QueueAdd(-1)
+	return result
+}
+
+// characterById reads a character row, returning errEntryNotFound if there
+// is none
+func (ref ReferenceStore) characterById(id int) (*Character, error) {
+	stmt, err := ref.conn.Prepare(`SELECT id, character, COALESCE(zhuyin, ''), COALESCE(pinyin, ''), COALESCE(tone, 0),
+					COALESCE(definition, ''), COALESCE(freq, 0), COALESCE(jyutping, '')
+					FROM characters WHERE id = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(id); err != nil {
+		return nil, err
+	}
+	if !stmt.Next() {
+		return nil, errEntryNotFound
+	}
+	c := &Character{}
+	err = stmt.Scan(&c.Id, &c.Character, &c.Zhuyin, &c.Pinyin, &c.Tone, &c.Definition, &c.Freq, &c.Jyutping)
+	return c, err
+}
+
+// phraseById reads a phrase row, returning errEntryNotFound if there is none
+func (ref ReferenceStore) phraseById(id int) (*Phrase, error) {
+	stmt, err := ref.conn.Prepare(`SELECT id, character, phrase, COALESCE(definition, ''), COALESCE(freq, 0)
+					FROM phrases WHERE id = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(id); err != nil {
+		return nil, err
+	}
+	if !stmt.Next() {
+		return nil, errEntryNotFound
+	}
+	p := &Phrase{}
+	err = stmt.Scan(&p.Id, &p.Character, &p.Phrase, &p.Definition, &p.Freq)
+	return p, err
+}
+
+// checkPhraseCharacter checks that the character row a phrase is linked to
+// exists and is one of the phrase's characters
+func (ref ReferenceStore) checkPhraseCharacter(p *Phrase) error {
+	c, err := ref.characterById(p.Character)
+	if err == errEntryNotFound {
+		return fmt.Errorf("character row %d does not exist", p.Character)
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(p.Phrase, c.Character) {
+		return fmt.Errorf("character row %d is %s, which is not in %s", p.Character, c.Character, p.Phrase)
+	}
+	return nil
+}
+
+// audit records a change in the audit trail
+func (ref ReferenceStore) audit(request *AdminRequest, id int, before, after interface{}) error {
+	encode := func(entry interface{}) string {
+		if entry == nil {
+			return ""
+		}
+		bytearray, _ := json.Marshal(entry)
+		return string(bytearray)
+	}
+	return ref.conn.Exec(`INSERT INTO audit_log(at, user, action, kind, entry, before, after)
+				VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().UTC().Format(time.RFC3339), request.User, request.Action, request.Kind, id,
+		encode(before), encode(after))
+}
+
+// GetAudit is the base audit trail lookup called only by the DB thread.
+// The most recent changes come first
+func (ref ReferenceStore) GetAudit(limit int) ([]AuditEntry, error) {
+	stmt, err := ref.conn.Prepare(`SELECT id, at, user, action, kind, entry, before, after
+					FROM audit_log ORDER BY id DESC LIMIT ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(limit); err != nil {
+		return nil, err
+	}
+	var entries []AuditEntry
+	for stmt.Next() {
+		var e AuditEntry
+		if err = stmt.Scan(&e.Id, &e.At, &e.User, &e.Action, &e.Kind, &e.Entry, &e.Before, &e.After); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// changeCharacter creates, updates or deletes a character row, returning
+// the row as it is after the change, or as it was before a delete
+func (ref ReferenceStore) changeCharacter(request *AdminRequest) (interface{}, error) {
+	c := request.Character
+	var before *Character
+	if request.Action != ADMIN_CREATE {
+		var err error
+		if before, err = ref.characterById(request.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	switch request.Action {
+	case ADMIN_CREATE:
+		err = ref.conn.Exec(`INSERT INTO characters(character, zhuyin, pinyin, tone, definition, freq)
+					VALUES(?, ?, ?, ?, ?, ?)`, c.Character, c.Zhuyin, c.Pinyin, c.Tone, c.Definition, c.Freq)
+		if err == nil {
+			request.Id, err = (&importer{ref: ref}).lastInsertId()
+		}
+	case ADMIN_UPDATE:
+		err = ref.conn.Exec(`UPDATE characters SET character = ?, zhuyin = ?, pinyin = ?, tone = ?, definition = ?, freq = ?
+					WHERE id = ?`, c.Character, c.Zhuyin, c.Pinyin, c.Tone, c.Definition, c.Freq, request.Id)
+	case ADMIN_DELETE:
+		phrases, err := ref.GetPhrases(request.Id)
+		if err != nil {
+			return nil, err
+		}
+		if len(phrases) > 0 {
+			return nil, fmt.Errorf("%d phrases are linked to character row %d, delete or relink them first",
+				len(phrases), request.Id)
+		}
+		err = ref.conn.Exec("DELETE FROM characters WHERE id = ?", request.Id)
+		if err == nil {
+			err = ref.conn.Exec("DELETE FROM definitions WHERE kind = ? AND entry = ?", DEFINITION_CHARACTER, request.Id)
+		}
+		if err == nil {
+			err = ref.audit(request, request.Id, before, nil)
+		}
+		return before, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := ref.characterById(request.Id)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil {
+		err = ref.audit(request, request.Id, nil, after)
+	} else {
+		err = ref.audit(request, request.Id, before, after)
+	}
+	return after, err
+}
+
+// changePhrase creates, updates or deletes a phrase row, returning the row
+// as it is after the change, or as it was before a delete
+func (ref ReferenceStore) changePhrase(request *AdminRequest) (interface{}, error) {
+	p := request.Phrase
+	var before *Phrase
+	if request.Action != ADMIN_CREATE {
+		var err error
+		if before, err = ref.phraseById(request.Id); err != nil {
+			return nil, err
+		}
+	}
+	if request.Action != ADMIN_DELETE {
+		if err := ref.checkPhraseCharacter(&p); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	switch request.Action {
+	case ADMIN_CREATE:
+		err = ref.conn.Exec("INSERT INTO phrases(character, phrase, definition, freq) VALUES(?, ?, ?, ?)",
+			p.Character, p.Phrase, p.Definition, p.Freq)
+		if err == nil {
+			request.Id, err = (&importer{ref: ref}).lastInsertId()
+		}
+	case ADMIN_UPDATE:
+		err = ref.conn.Exec("UPDATE phrases SET character = ?, phrase = ?, definition = ?, freq = ? WHERE id = ?",
+			p.Character, p.Phrase, p.Definition, p.Freq, request.Id)
+	case ADMIN_DELETE:
+		err = ref.conn.Exec("DELETE FROM phrases WHERE id = ?", request.Id)
+		if err == nil {
+			err = ref.conn.Exec("DELETE FROM definitions WHERE kind = ? AND entry = ?", DEFINITION_PHRASE, request.Id)
+		}
+		if err == nil {
+			err = ref.audit(request, request.Id, before, nil)
+		}
+		return before, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := ref.phraseById(request.Id)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil {
+		err = ref.audit(request, request.Id, nil, after)
+	} else {
+		err = ref.audit(request, request.Id, before, after)
+	}
+	return after, err
+}
+
+// ApplyAdmin is the base admin function called only by the DB thread.
+// Changes and their audit records are written in a single transaction,
+// after which the lookup cache is emptied
+func (ref ReferenceStore) ApplyAdmin(request *AdminRequest) *AdminResult {
+	switch request.Action {
+	case ADMIN_AUDIT:
+		entries, err := ref.GetAudit(request.Limit)
+		return &AdminResult{entries, err}
+	case ADMIN_GET:
+		if request.Kind == DEFINITION_PHRASE {
+			p, err := ref.phraseById(request.Id)
+			return &AdminResult{p, err}
+		}
+		c, err := ref.characterById(request.Id)
+		return &AdminResult{c, err}
+	}
+
+	if err := ref.conn.Exec("BEGIN"); err != nil {
+		metrics.Error("db_admin")
+		return &AdminResult{nil, err}
+	}
+	var entry interface{}
+	var err error
+	if request.Kind == DEFINITION_PHRASE {
+		entry, err = ref.changePhrase(request)
+	} else {
+		entry, err = ref.changeCharacter(request)
+	}
+	if err == nil {
+		err = ref.conn.Exec("COMMIT")
+	}
+	if err != nil {
+		ref.conn.Exec("ROLLBACK")
+		if err != errEntryNotFound {
+			metrics.Error("db_admin")
+		}
+		return &AdminResult{nil, err}
+	}
+
+	for key := range ref.GlobalCache {
+		delete(ref.GlobalCache, key)
+	}
+	logger.Info("dictionary changed", "user", request.User, "action", request.Action, "kind", request.Kind, "id", request.Id)
+	return &AdminResult{entry, nil}
+}
+
+// LoadTokens reads users from a file of "user token" lines, returning the
+// users by token
+func LoadTokens(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"user token\"", path, line)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	return tokens, scanner.Err()
+}
+
+// adminUser returns the admin user whose bearer token the request carries
+func (serv *ServerParams) adminUser(r *http.Request) (string, bool) {
+	return bearerUser(r, serv.config.AdminTokens)
+}
+
+// bearerUser returns the user of tokens whose bearer token the request
+// carries
+func bearerUser(r *http.Request, tokens map[string]string) (string, bool) {
+	return tokenUser(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), tokens)
+}
+
+// tokenUser returns the user of tokens holding token
+func tokenUser(token string, tokens map[string]string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	// compare against every token, so that timing tells nothing of them
+	user, found := "", false
+	for known, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			user, found = name, true
+		}
+	}
+	return user, found
+}
+
+// writeAdmin writes the JSON response of an admin request
+func writeAdmin(w http.ResponseWriter, status int, data interface{}) {
+	responseType := RESPONSE_OK
+	if err, ok := data.(error); ok {
+		responseType, data = RESPONSE_ERROR, err.Error()
+	}
+	w.WriteHeader(status)
+	bytearray, _ := json.Marshal(Response{"", responseType, data, 0, nil, 0})
+	w.Write(bytearray)
+}
+
+// adminHandler serves the admin API, for holders of an admin token:
+// GET /admin/audit lists the latest changes, POST /admin/characters and
+// /admin/phrases create entries, and GET, PUT and DELETE on
+// /admin/characters/<id> and /admin/phrases/<id> read, replace and delete
+// them. Entries are sent and returned as JSON
+func (serv *ServerParams) adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !serv.allowRequest(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	user, ok := serv.adminUser(r)
+	if !ok {
+		metrics.Error("unauthorized")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeAdmin(w, http.StatusUnauthorized, errUnauthorized)
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/"), "/")
+	request := AdminRequest{User: user}
+	switch path[0] {
+	case "audit":
+		request.Action = ADMIN_AUDIT
+		request.Limit = defaultAuditLimit
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			request.Limit = n
+		}
+		result := serv.ref.Admin(request)
+		if result.Err != nil {
+			writeAdmin(w, http.StatusInternalServerError, result.Err)
+			return
+		}
+		writeAdmin(w, http.StatusOK, result.Entry)
+		return
+	case "characters":
+		request.Kind = DEFINITION_CHARACTER
+	case "phrases":
+		request.Kind = DEFINITION_PHRASE
+	default:
+		metrics.Error("not_found")
+		writeAdmin(w, http.StatusNotFound, errors.New("unknown admin resource"))
+		return
+	}
+
+	if len(path) > 2 {
+		metrics.Error("not_found")
+		writeAdmin(w, http.StatusNotFound, errors.New("unknown admin resource"))
+		return
+	}
+	if len(path) == 2 {
+		id, err := strconv.Atoi(path[1])
+		if err != nil {
+			metrics.Error("bad_request")
+			writeAdmin(w, http.StatusBadRequest, errors.New("entry ids are numbers"))
+			return
+		}
+		request.Id = id
+	}
+
+	status := http.StatusOK
+	switch {
+	case r.Method == "POST" && len(path) == 1:
+		request.Action, status = ADMIN_CREATE, http.StatusCreated
+	case r.Method == "GET" && len(path) == 2:
+		request.Action = ADMIN_GET
+	case r.Method == "PUT" && len(path) == 2:
+		request.Action = ADMIN_UPDATE
+	case r.Method == "DELETE" && len(path) == 2:
+		request.Action = ADMIN_DELETE
+	default:
+		metrics.Error("bad_request")
+		writeAdmin(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	if request.Action == ADMIN_CREATE || request.Action == ADMIN_UPDATE {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBody))
+		if err == nil && request.Kind == DEFINITION_PHRASE {
+			err = json.Unmarshal(body, &request.Phrase)
+		} else if err == nil {
+			err = json.Unmarshal(body, &request.Character)
+		}
+		if err != nil {
+			metrics.Error("bad_request")
+			writeAdmin(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	result := serv.ref.Admin(request)
+	switch {
+	case result.Err == errEntryNotFound:
+		writeAdmin(w, http.StatusNotFound, result.Err)
+	case result.Err != nil:
+		metrics.Error("bad_request")
+		writeAdmin(w, http.StatusUnprocessableEntity, result.Err)
+	default:
+		writeAdmin(w, status, result.Entry)
+	}
+}
+
+// writeAudit prints audit entries as a table
+func writeAudit(out io.Writer, entries []AuditEntry) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tAt\tUser\tAction\tKind\tEntry\tBefore\tAfter")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", e.Id, e.At, e.User, e.Action, e.Kind, e.Entry, e.Before, e.After)
+	}
+	w.Flush()
+}
+
+// RunAdmin is the admin command: the command line equivalent of the admin
+// API. Its first argument is the action: show, add, edit or rm, followed
+// by -char or -phrase flags, or audit
+func RunAdmin(ref *ReferenceStore, args []string) error {
+	if len(args) == 0 {
+		return errors.New("admin needs an action: show, add, edit, rm or audit")
+	}
+	actions := map[string]string{"show": ADMIN_GET, "add": ADMIN_CREATE, "edit": ADMIN_UPDATE, "rm": ADMIN_DELETE,
+		"audit": ADMIN_AUDIT}
+	action, ok := actions[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown admin action %q", args[0])
+	}
+
+	flags := flag.NewFlagSet("admin "+args[0], flag.ExitOnError)
+	user := flags.String("user", os.Getenv("USER"), "Name recorded in the audit trail")
+	kind := flags.String("kind", DEFINITION_CHARACTER, "Kind of entry: character or phrase")
+	id := flags.Int("id", 0, "Row id of the entry to show, edit or remove")
+	char := flags.String("char", "", "Character")
+	zhuyin := flags.String("zhuyin", "", "Zhuyin reading, without tone")
+	pinyin := flags.String("pinyin", "", "Pinyin reading, filled in from the Zhuyin when empty")
+	tone := flags.Int("tone", 1, "Tone, 1 to 5")
+	phrase := flags.String("phrase", "", "Phrase")
+	charId := flags.Int("charid", 0, "Row id of the character a phrase is linked to")
+	definition := flags.String("def", "", "Definition")
+	freq := flags.Int("freq", 0, "Frequency")
+	limit := flags.Int("limit", defaultAuditLimit, "Number of audit entries to list")
+	flags.Parse(args[1:])
+
+	request := AdminRequest{User: *user, Action: action, Kind: *kind, Id: *id, Limit: *limit}
+	if *user == "" && action != ADMIN_GET && action != ADMIN_AUDIT {
+		return errors.New("-user is required for the audit trail")
+	}
+	if *kind != DEFINITION_CHARACTER && *kind != DEFINITION_PHRASE {
+		return fmt.Errorf("unknown kind %q", *kind)
+	}
+
+	// edits start from the stored entry and change the flags given
+	if action == ADMIN_UPDATE {
+		current := ref.Admin(AdminRequest{User: *user, Action: ADMIN_GET, Kind: *kind, Id: *id})
+		if current.Err != nil {
+			return current.Err
+		}
+		switch entry := current.Entry.(type) {
+		case *Character:
+			request.Character = *entry
+		case *Phrase:
+			request.Phrase = *entry
+		}
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if action == ADMIN_CREATE || set["char"] {
+		request.Character.Character = *char
+	}
+	if action == ADMIN_CREATE || set["zhuyin"] {
+		request.Character.Zhuyin = *zhuyin
+		if !set["pinyin"] {
+			request.Character.Pinyin = ""
+		}
+	}
+	if action == ADMIN_CREATE || set["pinyin"] {
+		request.Character.Pinyin = *pinyin
+	}
+	if action == ADMIN_CREATE || set["tone"] {
+		request.Character.Tone = *tone
+	}
+	if action == ADMIN_CREATE || set["phrase"] {
+		request.Phrase.Phrase = *phrase
+	}
+	if action == ADMIN_CREATE || set["charid"] {
+		request.Phrase.Character = *charId
+	}
+	if action == ADMIN_CREATE || set["def"] {
+		request.Character.Definition, request.Phrase.Definition = *definition, *definition
+	}
+	if action == ADMIN_CREATE || set["freq"] {
+		request.Character.Freq, request.Phrase.Freq = *freq, *freq
+	}
+
+	result := ref.Admin(request)
+	if result.Err != nil {
+		return result.Err
+	}
+	if entries, ok := result.Entry.([]AuditEntry); ok {
+		writeAudit(os.Stdout, entries)
+		return nil
+	}
+	bytearray, _ := json.Marshal(result.Entry)
+	fmt.Println(string(bytearray))
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateCharacter(t *testing.T) {
+	valid := []struct {
+		c      Character
+		pinyin string
+	}{
+		{Character{0, "我", "ㄨㄛ", "", 3, "", 100, ""}, "wo"},
+		{Character{0, "我", "ㄨㄛ", "wo3", 3, "", 100, ""}, "wo"},
+		{Character{0, "我", "ㄨㄛ", "wǒ", 3, "", 0, ""}, "wo"},
+		{Character{0, "們", "ㄇㄣ", "men", 5, "", 80, ""}, "men"},
+		{Character{0, "軍", "ㄐㄩㄣ", "jun1", 1, "", 0, ""}, "jun"},
+	}
+	for _, test := range valid {
+		c := test.c
+		if err := ValidateCharacter(&c); err != nil || c.Pinyin != test.pinyin {
+			t.Errorf("ValidateCharacter(%+v) = %v, Pinyin %q, want %q", test.c, err, c.Pinyin, test.pinyin)
+		}
+	}
+
+	invalid := []Character{
+		{0, "我們", "ㄨㄛ", "", 3, "", 0, ""},
+		{0, "a", "ㄨㄛ", "", 3, "", 0, ""},
+		{0, "我", "wo", "", 3, "", 0, ""},
+		{0, "我", "ㄛㄨ", "", 3, "", 0, ""},
+		{0, "我", "ㄨㄛ", "", 0, "", 0, ""},
+		{0, "我", "ㄨㄛ", "", 6, "", 0, ""},
+		{0, "我", "ㄨㄛ", "", 3, "", -1, ""},
+		{0, "我", "ㄨㄛ", "ni", 3, "", 0, ""},
+		{0, "我", "ㄨㄛ", "wo4", 3, "", 0, ""},
+		{0, "我", "ㄨㄛ", "xyz", 3, "", 0, ""},
+	}
+	for _, c := range invalid {
+		if err := ValidateCharacter(&c); err == nil {
+			t.Errorf("ValidateCharacter(%+v) accepted it", c)
+		}
+	}
+}
+
+func TestValidatePhrase(t *testing.T) {
+	if err := ValidatePhrase(&Phrase{0, 7, "銀行", "bank", 90}); err != nil {
+		t.Error(err)
+	}
+	for _, p := range []Phrase{{0, 7, "行", "", 0}, {0, 7, "銀a", "", 0}, {0, 7, "", "", 0}, {0, 7, "銀行", "", -1}} {
+		if err := ValidatePhrase(&p); err == nil {
+			t.Errorf("ValidatePhrase(%+v) accepted it", p)
+		}
+	}
+}
+
+func TestTokenUser(t *testing.T) {
+	tokens := map[string]string{"s3cret": "alice", "t0ken": "bob"}
+	tests := []struct {
+		token, user string
+		ok          bool
+	}{
+		{"s3cret", "alice", true},
+		{"t0ken", "bob", true},
+		{"s3cre", "", false},
+		{"S3CRET", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if user, ok := tokenUser(test.token, tokens); user != test.user || ok != test.ok {
+			t.Errorf("tokenUser(%q) = %q, %v, want %q, %v", test.token, user, ok, test.user, test.ok)
+		}
+	}
+	if _, ok := tokenUser("", map[string]string{"": "nobody"}); ok {
+		t.Error("empty token matched")
+	}
+	if _, ok := tokenUser("s3cret", nil); ok {
+		t.Error("token matched without tokens")
+	}
+}
+
+// adminCall serves an admin request, returning the status and response
+func adminCall(serv *ServerParams, method, path, token, body string) (int, *Response) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	serv.adminHandler(w, r)
+	var resp Response
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, &resp
+}
+
+func TestAdminHandler(t *testing.T) {
+	ref := newTestReference(t)
+	serv := &ServerParams{ref: ref, config: ServerConfig{AdminTokens: map[string]string{"s3cret": "alice"}}}
+
+	tests := []struct {
+		method, path, token, body string
+		status                    int
+	}{
+		{"GET", "/admin/characters/1", "", "", http.StatusUnauthorized},
+		{"GET", "/admin/characters/1", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/admin/characters/1", "s3cret", "", http.StatusOK},
+		{"GET", "/admin/characters/99", "s3cret", "", http.StatusNotFound},
+		{"GET", "/admin/phrases/99", "s3cret", "", http.StatusNotFound},
+		{"GET", "/admin/words/1", "s3cret", "", http.StatusNotFound},
+		{"GET", "/admin/characters/1/2", "s3cret", "", http.StatusNotFound},
+		{"GET", "/admin/characters/one", "s3cret", "", http.StatusBadRequest},
+		{"PATCH", "/admin/characters/1", "s3cret", "", http.StatusMethodNotAllowed},
+		{"POST", "/admin/characters", "s3cret", "{", http.StatusBadRequest},
+		{"POST", "/admin/characters", "s3cret", `{"Character": "我們", "Zhuyin": "ㄨㄛ", "Tone": 3}`, http.StatusUnprocessableEntity},
+		{"POST", "/admin/phrases", "s3cret", `{"Character": 1, "Phrase": "銀行"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/admin/characters/99", "s3cret", `{"Character": "我", "Zhuyin": "ㄨㄛ", "Tone": 3}`, http.StatusNotFound},
+		// 行 is linked to the phrase 銀行
+		{"DELETE", "/admin/characters/7", "s3cret", "", http.StatusUnprocessableEntity},
+		{"POST", "/admin/characters", "s3cret", `{"Character": "臥", "Zhuyin": "ㄨㄛ", "Tone": 4}`, http.StatusCreated},
+		{"DELETE", "/admin/characters/9", "s3cret", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		status, resp := adminCall(serv, test.method, test.path, test.token, test.body)
+		if status != test.status {
+			t.Errorf("%s %s = %d %v, want %d", test.method, test.path, status, resp.Data, test.status)
+		}
+	}
+
+	status, resp := adminCall(serv, "GET", "/admin/audit", "s3cret", "")
+	entries, _ := resp.Data.([]interface{})
+	if status != http.StatusOK || len(entries) != 2 {
+		t.Errorf("audit = %d %v, want the creation and the deletion", status, resp.Data)
+	}
+}
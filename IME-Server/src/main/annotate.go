@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxAnnotateBody bounds the size of text accepted by the HTTP endpoint
+const maxAnnotateBody = 1 << 20
+
+// Output formats of the annotator
+const (
+	FORMAT_TEXT        = "text"
+	FORMAT_JSON        = "json"
+	FORMAT_INTERLEAVED = "interleaved"
+)
+
+// zhuyinToneMarks are the marks written after a Zhuyin syllable, by tone.
+// The first tone is customarily left unmarked
+var zhuyinToneMarks = []string{"", "", "ˊ", "ˇ", "ˋ", "˙"}
+
+// Annotation is a run of text with its reading. Runs of non-Chinese text
+// are kept whole and have no reading
+type Annotation struct {
+	Text      string
+	Zhuyin    string `json:",omitempty"`
+	Pinyin    string `json:",omitempty"`
+	Tone      int    `json:",omitempty"`
+	Polyphone bool   `json:",omitempty"`
+}
+
+// Annotator looks up the readings of Chinese text, using the phrases a
+// polyphonic character appears in to pick the reading that fits the context
+type Annotator struct {
+	ref      *ReferenceStore
+	readings map[rune][]Character
+	phrases  map[int][]Phrase
+}
+
+// NewAnnotator returns an annotator reading from ref
+func NewAnnotator(ref *ReferenceStore) *Annotator {
+	return &Annotator{ref, make(map[rune][]Character), make(map[int][]Phrase)}
+}
+
+// FormatZhuyin returns the Zhuyin of a character with its tone mark. The
+// neutral tone mark is written before the syllable
+func FormatZhuyin(c Character) string {
+	if c.Tone == 5 {
+		return zhuyinToneMarks[5] + c.Zhuyin
+	}
+	if c.Tone > 0 && c.Tone < len(zhuyinToneMarks) {
+		return c.Zhuyin + zhuyinToneMarks[c.Tone]
+	}
+	return c.Zhuyin
+}
+
+// FormatPinyin returns the Pinyin of a character with its tone number
+func FormatPinyin(c Character) string {
+	if c.Tone > 0 {
+		return c.Pinyin + strconv.Itoa(c.Tone)
+	}
+	return c.Pinyin
+}
+
+// readingsOf returns the distinct readings of a character, most frequent first
+func (a *Annotator) readingsOf(r rune) []Character {
+	if readings, ok := a.readings[r]; ok {
+		return readings
+	}
+	result, _ := a.ref.GetByChar(string(r))
+	var readings []Character
+	seen := make(map[string]bool)
+	for _, c := range *result {
+		key := c.Zhuyin + strconv.Itoa(c.Tone)
+		if c.Character != string(r) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		readings = append(readings, c)
+	}
+	a.readings[r] = readings
+	return readings
+}
+
+// phrasesOf returns the phrases linked to a character row
+func (a *Annotator) phrasesOf(id int) []Phrase {
+	if phrases, ok := a.phrases[id]; ok {
+		return phrases
+	}
+	phrases := a.ref.GetPhrasesByCharacter(id)
+	a.phrases[id] = phrases
+	return phrases
+}
+
+// phraseAt reports whether phrase occurs in text covering position i with
+// the character at i in the phrase
+func phraseAt(text []rune, i int, phrase []rune) bool {
+	for offset, r := range phrase {
+		if r != text[i] {
+			continue
+		}
+		start := i - offset
+		if start < 0 || start+len(phrase) > len(text) {
+			continue
+		}
+		if string(text[start:start+len(phrase)]) == string(phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick chooses the reading of the character at position i of text. The
+// reading whose phrases best match the surrounding text wins, longer
+// phrases first and then more frequent ones; without any match the most
+// frequent reading is used
+func (a *Annotator) pick(text []rune, i int, readings []Character) Character {
+	best, bestLength, bestFreq := readings[0], 0, 0
+	for _, reading := range readings {
+		for _, phrase := range a.phrasesOf(reading.Id) {
+			runes := []rune(phrase.Phrase)
+			if len(runes) < 2 || len(runes) < bestLength {
+				continue
+			}
+			if len(runes) == bestLength && phrase.Freq <= bestFreq {
+				continue
+			}
+			if phraseAt(text, i, runes) {
+				best, bestLength, bestFreq = reading, len(runes), phrase.Freq
+			}
+		}
+	}
+	return best
+}
+
+// Annotate splits text into characters with their readings and runs of
+// other text
+func (a *Annotator) Annotate(text string) []Annotation {
+	runes := []rune(text)
+	var annotations []Annotation
+	var plain []rune
+
+	flush := func() {
+		if len(plain) > 0 {
+			annotations = append(annotations, Annotation{Text: string(plain)})
+			plain = nil
+		}
+	}
+
+	for i, r := range runes {
+		if !unicode.Is(unicode.Han, r) {
+			plain = append(plain, r)
+			continue
+		}
+		readings := a.readingsOf(r)
+		if len(readings) == 0 {
+			plain = append(plain, r)
+			continue
+		}
+		flush()
+		reading := readings[0]
+		if len(readings) > 1 {
+			reading = a.pick(runes, i, readings)
+		}
+		annotations = append(annotations, Annotation{
+			Text:      string(r),
+			Zhuyin:    FormatZhuyin(reading),
+			Pinyin:    FormatPinyin(reading),
+			Tone:      reading.Tone,
+			Polyphone: len(readings) > 1,
+		})
+	}
+	flush()
+	return annotations
+}
+
+// stripPinyin drops the Pinyin readings from annotations
+func stripPinyin(annotations []Annotation) {
+	for i := range annotations {
+		annotations[i].Pinyin = ""
+	}
+}
+
+// WriteAnnotations writes annotations to w in the given format. The text
+// format gives only the readings, one per character; interleaved follows
+// every character with its reading in parentheses. Pinyin is included when
+// withPinyin is set
+func WriteAnnotations(w io.Writer, annotations []Annotation, format string, withPinyin bool) error {
+	switch format {
+	case FORMAT_JSON:
+		if !withPinyin {
+			stripPinyin(annotations)
+		}
+		return json.NewEncoder(w).Encode(annotations)
+	case FORMAT_TEXT, FORMAT_INTERLEAVED:
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	var out []string
+	for _, a := range annotations {
+		if a.Zhuyin == "" {
+			out = append(out, a.Text)
+			continue
+		}
+		reading := a.Zhuyin
+		if withPinyin {
+			reading += "/" + a.Pinyin
+		}
+		if format == FORMAT_INTERLEAVED {
+			out = append(out, a.Text+"("+reading+")")
+		} else {
+			out = append(out, reading)
+		}
+	}
+	separator := ""
+	if format == FORMAT_TEXT {
+		separator = " "
+	}
+	_, err := io.WriteString(w, strings.Join(out, separator))
+	return err
+}
+
+// annotateHandler annotates the text in the request body, or the text
+// parameter, in the format given by the format parameter
+func (serv *ServerParams) annotateHandler(w http.ResponseWriter, r *http.Request) {
+	if !serv.allowRequest(w, r) {
+		return
+	}
+
+	text := r.URL.Query().Get("text")
+	if r.Method == "POST" {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAnnotateBody))
+		if err != nil {
+			metrics.Error("bad_request")
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		text = string(body)
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FORMAT_JSON
+	}
+	withPinyin := r.URL.Query().Get("pinyin") != ""
+
+	annotations := NewAnnotator(serv.ref).Annotate(text)
+	switch format {
+	case FORMAT_JSON:
+		if !withPinyin {
+			stripPinyin(annotations)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		bytearray, _ := json.Marshal(Response{"", RESPONSE_OK, annotations, 0, nil, 0})
+		w.Write(bytearray)
+	case FORMAT_TEXT, FORMAT_INTERLEAVED:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		WriteAnnotations(w, annotations, format, withPinyin)
+	default:
+		metrics.Error("bad_request")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		bytearray, _ := json.Marshal(Response{"", RESPONSE_ERROR, "unknown format", 0, nil, 0})
+		w.Write(bytearray)
+	}
+}
+
+// RunAnnotate is the annotate command: it annotates the named files, or
+// standard input, to standard output
+func RunAnnotate(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("annotate", flag.ExitOnError)
+	format := flags.String("format", FORMAT_INTERLEAVED, "Output format: text, json or interleaved")
+	withPinyin := flags.Bool("pinyin", false, "Include Pinyin readings")
+	flags.Parse(args)
+
+	var inputs []io.Reader
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		inputs = append(inputs, file)
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, os.Stdin)
+	}
+
+	text, err := ioutil.ReadAll(io.MultiReader(inputs...))
+	if err != nil {
+		return err
+	}
+	if len(text) == 0 {
+		return errors.New("no input text")
+	}
+	return WriteAnnotations(os.Stdout, NewAnnotator(ref).Annotate(string(text)), *format, *withPinyin)
+}
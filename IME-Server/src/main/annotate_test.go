@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestFormatReading(t *testing.T) {
+	tests := []struct {
+		c      Character
+		zhuyin string
+		pinyin string
+	}{
+		{Character{0, "窩", "ㄨㄛ", "wo", 1, "", 0, ""}, "ㄨㄛ", "wo1"},
+		{Character{0, "行", "ㄒㄧㄥ", "xing", 2, "", 0, ""}, "ㄒㄧㄥˊ", "xing2"},
+		{Character{0, "我", "ㄨㄛ", "wo", 3, "", 0, ""}, "ㄨㄛˇ", "wo3"},
+		{Character{0, "握", "ㄨㄛ", "wo", 4, "", 0, ""}, "ㄨㄛˋ", "wo4"},
+		{Character{0, "們", "ㄇㄣ", "men", 5, "", 0, ""}, "˙ㄇㄣ", "men5"},
+		// a reading without a known tone is written bare
+		{Character{0, "我", "ㄨㄛ", "wo", 0, "", 0, ""}, "ㄨㄛ", "wo"},
+	}
+	for _, test := range tests {
+		if got := FormatZhuyin(test.c); got != test.zhuyin {
+			t.Errorf("FormatZhuyin(%+v) = %q, want %q", test.c, got, test.zhuyin)
+		}
+		if got := FormatPinyin(test.c); got != test.pinyin {
+			t.Errorf("FormatPinyin(%+v) = %q, want %q", test.c, got, test.pinyin)
+		}
+	}
+}
+
+// annotateReference returns the test store with the phrase 行走 linked to
+// 行 read xing, less frequent than 銀行
+func annotateReference(t *testing.T) *ReferenceStore {
+	t.Helper()
+	ref := newTestReference(t)
+	result := ref.Admin(AdminRequest{User: "alice", Action: ADMIN_CREATE, Kind: DEFINITION_PHRASE,
+		Phrase: Phrase{0, 6, "行走", "walk", 10}})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	return ref
+}
+
+func TestAnnotatePolyphone(t *testing.T) {
+	a := NewAnnotator(annotateReference(t))
+	tests := []struct {
+		text   string
+		i      int
+		zhuyin string
+	}{
+		{"銀行", 1, "ㄏㄤˊ"},
+		{"行走", 0, "ㄒㄧㄥˊ"},
+		{"去銀行了", 2, "ㄏㄤˊ"},
+		// both phrases match, the more frequent 銀行 wins
+		{"銀行走", 1, "ㄏㄤˊ"},
+		// 銀 and 行 are not adjacent
+		{"銀的行", 2, "ㄒㄧㄥˊ"},
+		// without a phrase the most frequent reading is used
+		{"行", 0, "ㄒㄧㄥˊ"},
+		{"我行", 1, "ㄒㄧㄥˊ"},
+	}
+	for _, test := range tests {
+		annotations := a.Annotate(test.text)
+		var got *Annotation
+		for i, seen := range annotations {
+			if seen.Text == "行" {
+				got = &annotations[i]
+			}
+		}
+		if got == nil || got.Zhuyin != test.zhuyin || !got.Polyphone {
+			t.Errorf("行 in %s = %+v, want %s", test.text, got, test.zhuyin)
+		}
+		if c := a.pick([]rune(test.text), test.i, a.readingsOf('行')); FormatZhuyin(c) != test.zhuyin {
+			t.Errorf("pick(%s, %d) = %+v, want %s", test.text, test.i, c, test.zhuyin)
+		}
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	a := NewAnnotator(annotateReference(t))
+	got := a.Annotate("我們去銀行, ok")
+	want := []Annotation{
+		{"我", "ㄨㄛˇ", "wo3", 3, false},
+		{"們", "˙ㄇㄣ", "men5", 5, false},
+		// 去 has no reading and is kept with the text around it
+		{"去", "", "", 0, false},
+		{"銀", "ㄧㄣˊ", "yin2", 2, false},
+		{"行", "ㄏㄤˊ", "hang2", 2, true},
+		{", ok", "", "", 0, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Annotate = %+v, want %+v", got, want)
+	}
+	if got = a.Annotate(""); len(got) != 0 {
+		t.Errorf("Annotate of no text = %+v", got)
+	}
+}
+
+func TestAnnotateHandler(t *testing.T) {
+	serv := &ServerParams{ref: annotateReference(t)}
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serv.annotateHandler(w, httptest.NewRequest("GET", "/annotate?"+query, nil))
+		return w
+	}
+	text := "text=" + url.QueryEscape("我在銀行")
+
+	tests := []struct {
+		query string
+		body  string
+	}{
+		{"format=text", "ㄨㄛˇ 在 ㄧㄣˊ ㄏㄤˊ"},
+		{"format=text&pinyin=1", "ㄨㄛˇ/wo3 在 ㄧㄣˊ/yin2 ㄏㄤˊ/hang2"},
+		{"format=interleaved", "我(ㄨㄛˇ)在銀(ㄧㄣˊ)行(ㄏㄤˊ)"},
+	}
+	for _, test := range tests {
+		if w := get(text + "&" + test.query); w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("%s = %d %q, want %q", test.query, w.Code, w.Body.String(), test.body)
+		}
+	}
+
+	// JSON is the default, and leaves Pinyin out unless asked for
+	w := get(text)
+	var resp struct {
+		ResponseType int
+		Data         []Annotation
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.ResponseType != RESPONSE_OK || len(resp.Data) != 4 {
+		t.Fatalf("JSON = %d %s", w.Code, w.Body.String())
+	}
+	if a := resp.Data[3]; a.Zhuyin != "ㄏㄤˊ" || a.Pinyin != "" || !a.Polyphone {
+		t.Errorf("JSON 行 = %+v", a)
+	}
+
+	if w = get(text + "&format=xml"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format = %d", w.Code)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"code.google.com/p/go.net/html"
+	"code.google.com/p/go.net/html/atom"
+	"crypto/sha1"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// corpusMetaFile is the name of the sidecar file giving the metadata of
+// every document in a directory and its subdirectories. A file may also
+// have its own sidecar named <file>.meta.json
+const corpusMetaFile = "meta.json"
+
+// CorpusMeta is the sampling metadata of a document. Era is "modern" for
+// vernacular text or "classical" for Literary Chinese
+type CorpusMeta struct {
+	Region string `json:",omitempty"`
+	Era    string `json:",omitempty"`
+}
+
+// merge fills the empty fields of meta from parent
+func (meta CorpusMeta) merge(parent CorpusMeta) CorpusMeta {
+	if meta.Region == "" {
+		meta.Region = parent.Region
+	}
+	if meta.Era == "" {
+		meta.Era = parent.Era
+	}
+	return meta
+}
+
+// CorpusDocument is a single collected document, written as one line of
+// the corpus file
+type CorpusDocument struct {
+	Source     string
+	Region     string
+	Era        string
+	Title      string `json:",omitempty"`
+	Chars      int
+	Paragraphs []string
+}
+
+// blockElements end the paragraph being collected
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Br: true, atom.Li: true, atom.Ul: true, atom.Ol: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Table: true, atom.Tr: true, atom.Td: true, atom.Th: true, atom.Dd: true, atom.Dt: true,
+	atom.Blockquote: true, atom.Pre: true, atom.Section: true, atom.Article: true,
+	atom.Header: true, atom.Footer: true, atom.Hr: true,
+}
+
+// hiddenElements hold no visible text
+var hiddenElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true,
+	atom.Head: true, atom.Select: true, atom.Textarea: true,
+}
+
+// Collector extracts, filters and deduplicates Chinese text
+type Collector struct {
+	MinChars int
+	MinRatio float64
+	seen     map[[sha1.Size]byte]bool
+}
+
+// NewCollector returns a collector keeping paragraphs of at least minChars
+// Chinese characters making up at least minRatio of their letters
+func NewCollector(minChars int, minRatio float64) *Collector {
+	return &Collector{minChars, minRatio, make(map[[sha1.Size]byte]bool)}
+}
+
+// normalizeParagraph collapses all runs of white space, including the
+// ideographic space, into single spaces
+func normalizeParagraph(s string) string {
+	return strings.Join(strings.FieldsFunc(s, unicode.IsSpace), " ")
+}
+
+// cjkCount returns the number of Chinese characters in s and the number of
+// letters of any script
+func cjkCount(s string) (cjk, letters int) {
+	for _, r := range s {
+		if unicode.Is(unicode.Han, r) {
+			cjk++
+			letters++
+		} else if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	return cjk, letters
+}
+
+// keep reports whether a normalised paragraph is Chinese enough and not yet
+// seen, marking it as seen
+func (c *Collector) keep(paragraph string) bool {
+	cjk, letters := cjkCount(paragraph)
+	if cjk < c.MinChars || float64(cjk) < c.MinRatio*float64(letters) {
+		return false
+	}
+	sum := sha1.Sum([]byte(paragraph))
+	if c.seen[sum] {
+		return false
+	}
+	c.seen[sum] = true
+	return true
+}
+
+// filter normalises paragraphs and returns those worth keeping
+func (c *Collector) filter(paragraphs []string) []string {
+	var kept []string
+	for _, paragraph := range paragraphs {
+		paragraph = normalizeParagraph(paragraph)
+		if c.keep(paragraph) {
+			kept = append(kept, paragraph)
+		}
+	}
+	return kept
+}
+
+// ExtractHTML returns the title and visible text paragraphs of an HTML page.
+// The page is parsed into a tree, so that end tags left out, as HTML
+// allows for head and p, do not hide the rest of the page
+func ExtractHTML(r io.Reader) (title string, paragraphs []string) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", nil
+	}
+	var current []string
+	flush := func() {
+		if len(current) > 0 {
+			paragraphs = append(paragraphs, strings.Join(current, ""))
+			current = nil
+		}
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			current = append(current, n.Data)
+			return
+		case html.ElementNode:
+			if hiddenElements[n.DataAtom] || n.DataAtom == atom.Title {
+				return
+			}
+		}
+		block := n.Type == html.ElementNode && blockElements[n.DataAtom]
+		if block {
+			flush()
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if block {
+			flush()
+		}
+	}
+	if t := findElement(doc, atom.Title); t != nil {
+		title = normalizeParagraph(nodeText(t))
+	}
+	walk(doc)
+	flush()
+	return title, paragraphs
+}
+
+// findElement returns the first element of type a in the tree under n
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// nodeText returns the text of the tree under n
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	text := ""
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		text += nodeText(child)
+	}
+	return text
+}
+
+// ExtractText returns the paragraphs of a plain text file, which are
+// separated by blank lines
+func ExtractText(r io.Reader) []string {
+	var paragraphs, current []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			if len(current) > 0 {
+				paragraphs = append(paragraphs, strings.Join(current, ""))
+				current = nil
+			}
+			continue
+		}
+		current = append(current, line)
+	}
+	if len(current) > 0 {
+		paragraphs = append(paragraphs, strings.Join(current, ""))
+	}
+	return paragraphs
+}
+
+// readMeta reads a metadata sidecar, returning an empty one if absent
+func readMeta(path string) (CorpusMeta, error) {
+	var meta CorpusMeta
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// Collect walks root and writes a CorpusDocument line to out for every
+// HTML or text file holding Chinese text. Metadata comes from the sidecar
+// files, falling back to defaults
+func (c *Collector) Collect(root string, defaults CorpusMeta, out io.Writer) (documents int, err error) {
+	encoder := json.NewEncoder(out)
+	dirMeta := map[string]CorpusMeta{}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			parent, ok := dirMeta[filepath.Dir(path)]
+			if !ok || path == root {
+				parent = defaults
+			}
+			meta, err := readMeta(filepath.Join(path, corpusMetaFile))
+			if err != nil {
+				return err
+			}
+			dirMeta[path] = meta.merge(parent)
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".html" && ext != ".htm" && ext != ".txt" {
+			return nil
+		}
+		meta, err := readMeta(path + ".meta.json")
+		if err != nil {
+			return err
+		}
+		meta = meta.merge(dirMeta[filepath.Dir(path)])
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(data) {
+			logger.Warn("skipping file that is not UTF-8", "path", path)
+			return nil
+		}
+
+		doc := CorpusDocument{Source: path, Region: meta.Region, Era: meta.Era}
+		var paragraphs []string
+		if ext == ".txt" {
+			paragraphs = ExtractText(strings.NewReader(string(data)))
+		} else {
+			doc.Title, paragraphs = ExtractHTML(strings.NewReader(string(data)))
+		}
+		doc.Paragraphs = c.filter(paragraphs)
+		if len(doc.Paragraphs) == 0 {
+			return nil
+		}
+		for _, paragraph := range doc.Paragraphs {
+			cjk, _ := cjkCount(paragraph)
+			doc.Chars += cjk
+		}
+		documents++
+		return encoder.Encode(&doc)
+	})
+	return documents, err
+}
+
+// ReadCorpus calls fn for every document of a corpus file
+func ReadCorpus(r io.Reader, fn func(*CorpusDocument) error) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var doc CorpusDocument
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(&doc); err != nil {
+			return err
+		}
+	}
+}
+
+// RunCollect is the collect command: it gathers the Chinese text of the
+// given directories into a corpus file
+func RunCollect(args []string) error {
+	flags := flag.NewFlagSet("collect", flag.ExitOnError)
+	output := flags.String("o", "corpus.jsonl", "Corpus file to write")
+	region := flags.String("region", "", "Region of documents without metadata, e.g. TW, HK, CN")
+	era := flags.String("era", "modern", "Era of documents without metadata: modern or classical")
+	minChars := flags.Int("minchars", 10, "Minimum Chinese characters per paragraph")
+	minRatio := flags.Float64("ratio", 0.5, "Minimum share of Chinese characters among a paragraph's letters")
+	flags.Parse(args)
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out := bufio.NewWriter(file)
+
+	collector := NewCollector(*minChars, *minRatio)
+	for _, root := range flags.Args() {
+		documents, err := collector.Collect(root, CorpusMeta{*region, *era}, out)
+		if err != nil {
+			return err
+		}
+		logger.Info("collected", "root", root, "documents", documents)
+	}
+	return out.Flush()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractHTML(t *testing.T) {
+	tests := []struct {
+		name       string
+		page       string
+		title      string
+		paragraphs []string
+	}{
+		{"complete page",
+			`<html><head><title>標題</title><style>p{}</style></head><body><p>第一段</p><div>第二<b>段</b></div><script>var x="隱藏"</script></body></html>`,
+			"標題", []string{"第一段", "第二段"}},
+		{"head end tag left out",
+			`<html><head><title>標題</title><meta charset="utf-8"><body><p>正文<p>下一段</body></html>`,
+			"標題", []string{"正文", "下一段"}},
+		{"no head or body tags",
+			`<title>只有標題</title><p>內容`,
+			"只有標題", []string{"內容"}},
+		{"hidden elements",
+			`<body><noscript>不要</noscript><p>要<textarea>不要</textarea></p><select><option>不要</option></select></body>`,
+			"", []string{"要"}},
+	}
+	for _, test := range tests {
+		title, paragraphs := ExtractHTML(strings.NewReader(test.page))
+		if title != test.title || !reflect.DeepEqual(paragraphs, test.paragraphs) {
+			t.Errorf("%s: ExtractHTML = %q, %q, want %q, %q", test.name, title, paragraphs, test.title, test.paragraphs)
+		}
+	}
+}
+
+func TestCollectorFilter(t *testing.T) {
+	c := NewCollector(3, 0.5)
+	got := c.filter([]string{"中文　段落", "短", "mostly English 中文字", "中文 段落", "另一個段落"})
+	want := []string{"中文 段落", "另一個段落"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("filter = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultSelectionKeys select candidates 1-9 on the current page. They are
+// the shifted number row, since 1-5 are kept for tones
+const defaultSelectionKeys = "!@#$%^&*("
+
+// maxSyllableSymbols is the most Zhuyin symbols a single syllable can have
+const maxSyllableSymbols = 3
+
+// Named keys understood by the composer, besides Zhuyin symbols and tones
+const (
+	KEY_SPACE     = "Space"
+	KEY_BACKSPACE = "Backspace"
+	KEY_ENTER     = "Enter"
+	KEY_ESCAPE    = "Escape"
+	KEY_PAGE_UP   = "PageUp"
+	KEY_PAGE_DOWN = "PageDown"
+	KEY_SELECT    = "Select:"
+)
+
+// Event types emitted by the composer for the client to act upon
+const (
+	EVENT_COMMIT      = "commit"
+	EVENT_BACKSPACE   = "backspace"
+	EVENT_PASSTHROUGH = "passthrough"
+)
+
+// toneMarks maps the Zhuyin tone marks to their tone numbers
+var toneMarks = map[string]int{"ˉ": 1, "ˊ": 2, "ˇ": 3, "ˋ": 4, "˙": 5}
+
+// CompositionEvent is an action the client must apply to its document,
+// such as inserting committed text
+type CompositionEvent struct {
+	Type string
+	Text string
+}
+
+// CompositionState is a snapshot of a composer, sent back to the client
+// after every key. SelectionKeys are the keys picking the candidates shown,
+// in order, for the client to label them with
+type CompositionState struct {
+	Preedit       string
+	Tone          int
+	Candidates    []Character
+	Page          int
+	PageCount     int
+	Total         int
+	Events        []CompositionEvent
+	SelectionKeys []string
+}
+
+// maxSessionComposers bounds the composers a single connection may keep,
+// one per session id it sends
+const maxSessionComposers = 16
+
+// Composer is the per-session IME state machine. Keys go in, the preedit
+// buffer and candidate list are updated, and commit events come out. It
+// types Mandarin unless a dialect is set
+type Composer struct {
+	ref           *ReferenceStore
+	user          string
+	dialect       *Dialect
+	preedit       []string
+	tone          int
+	candidates    []Character
+	page          int
+	pageSize      int
+	selectionKeys []string
+	events        []CompositionEvent
+}
+
+// NewComposer returns an empty composer looking up candidates in ref
+func NewComposer(ref *ReferenceStore) *Composer {
+	c := &Composer{ref: ref, tone: -1, pageSize: defaultPageSize}
+	c.SetSelectionKeys(defaultSelectionKeys)
+	return c
+}
+
+// SessionComposers holds the composers of the sessions of a connection.
+// Session ids are chosen by the client, so once there are
+// maxSessionComposers the least recently used one is dropped for a new one
+type SessionComposers struct {
+	ref       *ReferenceStore
+	composers map[string]*Composer
+	used      map[string]int
+	tick      int
+}
+
+// NewSessionComposers returns an empty set of composers looking up
+// candidates in ref
+func NewSessionComposers(ref *ReferenceStore) *SessionComposers {
+	return &SessionComposers{ref, make(map[string]*Composer), make(map[string]int), 0}
+}
+
+// Get returns the composer of a session, creating it if needed
+func (s *SessionComposers) Get(session string) *Composer {
+	s.tick++
+	composer, ok := s.composers[session]
+	if !ok {
+		if len(s.composers) >= maxSessionComposers {
+			oldest, found := "", false
+			for id := range s.composers {
+				if !found || s.used[id] < s.used[oldest] {
+					oldest, found = id, true
+				}
+			}
+			delete(s.composers, oldest)
+			delete(s.used, oldest)
+		}
+		composer = NewComposer(s.ref)
+		s.composers[session] = composer
+	}
+	s.used[session] = s.tick
+	return composer
+}
+
+// Len returns the number of sessions holding a composer
+func (s *SessionComposers) Len() int {
+	return len(s.composers)
+}
+
+// SetUser sets the user whose dictionary words are placed before the
+// candidates, none for an empty user
+func (c *Composer) SetUser(user string) {
+	c.user = user
+}
+
+// SetDialect switches the composer to the syllables of a dialect, Mandarin
+// for an empty code. Switching drops what was being composed
+func (c *Composer) SetDialect(code string) error {
+	var dialect *Dialect
+	if code != "" {
+		var ok bool
+		if dialect, ok = GetDialect(code); !ok {
+			return fmt.Errorf("unknown dialect %q", code)
+		}
+		if dialect.Code == DIALECT_MANDARIN {
+			dialect = nil
+		}
+	}
+	if dialect != c.dialect {
+		c.reset()
+		c.dialect = dialect
+	}
+	return nil
+}
+
+// SetPageSize changes the number of candidates per page, keeping the
+// first candidate of the current page in view
+func (c *Composer) SetPageSize(pageSize int) {
+	if pageSize <= 0 || pageSize == c.pageSize {
+		return
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	c.page = c.page * c.pageSize / pageSize
+	c.pageSize = pageSize
+}
+
+// SetSelectionKeys sets the keys that pick candidates off the current page,
+// one key per character of keys. Tone keys cannot be used for selection and
+// are dropped
+func (c *Composer) SetSelectionKeys(keys string) {
+	c.selectionKeys = nil
+	for _, r := range keys {
+		key := string(r)
+		if isTone(key) || isBopomofo(key) {
+			continue
+		}
+		c.selectionKeys = append(c.selectionKeys, key)
+	}
+}
+
+// selectionIndex returns the candidate position a selection key picks
+func (c *Composer) selectionIndex(key string) (int, bool) {
+	for i, selectionKey := range c.selectionKeys {
+		if selectionKey == key {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// isSelectionKey reports whether key is one of the composer's selection keys
+func (c *Composer) isSelectionKey(key string) bool {
+	_, ok := c.selectionIndex(key)
+	return ok
+}
+
+// isZhuyin reports whether key is a single Bopomofo symbol
+func isZhuyin(key string) bool {
+	r, size := utf8.DecodeRuneInString(key)
+	return size == len(key) && r >= 0x3105 && r <= 0x312F
+}
+
+// isBopomofo reports whether key is a single symbol of the Bopomofo or the
+// Bopomofo Extended (U+31A0–U+31BF) block
+func isBopomofo(key string) bool {
+	r, size := utf8.DecodeRuneInString(key)
+	return isZhuyin(key) || size == len(key) && r >= 0x31A0 && r <= 0x31BF
+}
+
+// isSymbol reports whether key is a Zhuyin symbol of the composer's dialect
+func (c *Composer) isSymbol(key string) bool {
+	if c.dialect == nil {
+		return isZhuyin(key)
+	}
+	dialect := c.dialect
+	return utf8.RuneCountInString(key) == 1 && strings.Contains(dialect.Initials+dialect.Finals+dialect.Codas, key)
+}
+
+// maxSymbols returns the most symbols a syllable of the dialect has
+func (c *Composer) maxSymbols() int {
+	if c.dialect == nil {
+		return maxSyllableSymbols
+	}
+	return maxDialectSymbols
+}
+
+// toneKey returns the tone key types after the preedit. Dialect tones must
+// fit the syllable typed so far
+func (c *Composer) toneKey(key string) (int, bool) {
+	if c.dialect == nil {
+		return toneOf(key)
+	}
+	if isBopomofo(key) {
+		return 0, false
+	}
+	_, tone, err := c.dialect.Syllable(c.Preedit() + key)
+	return tone, err == nil && tone >= 0
+}
+
+// unmarkedTone returns the tone of the preedit written without a tone:
+// first tone in Mandarin, in dialects the unmarked tone that fits whether
+// the syllable is checked
+func (c *Composer) unmarkedTone() int {
+	if c.dialect == nil {
+		return 1
+	}
+	checked := c.dialect.endsInStop(c.Preedit())
+	for _, tone := range c.dialect.Tones {
+		marked := false
+		for _, mark := range c.dialect.ToneMarks {
+			marked = marked || mark.Tone == tone
+		}
+		if !marked && hasTone(c.dialect.Checked, tone) == checked {
+			return tone
+		}
+	}
+	return -1
+}
+
+// toneOf returns the tone typed by key, given as a digit or a tone mark
+func toneOf(key string) (int, bool) {
+	if tone, ok := toneMarks[key]; ok {
+		return tone, true
+	}
+	if len(key) == 1 && key[0] >= '1' && key[0] <= '5' {
+		return int(key[0] - '0'), true
+	}
+	return 0, false
+}
+
+// Key feeds a single key to the composer and returns the resulting state
+func (c *Composer) Key(key string) *CompositionState {
+	c.events = nil
+
+	tone, isToneKey := 0, false
+	if len(c.preedit) > 0 && c.candidates == nil {
+		tone, isToneKey = c.toneKey(key)
+	}
+
+	switch {
+	case c.isSymbol(key):
+		// Typing on while candidates are shown accepts the first one
+		if c.candidates != nil {
+			c.selectIndex(0)
+		}
+		if len(c.preedit) < c.maxSymbols() {
+			c.preedit = append(c.preedit, key)
+		}
+	case isToneKey:
+		c.tone = tone
+		c.lookup()
+	case key == KEY_SPACE:
+		if c.candidates != nil {
+			c.selectIndex(0)
+		} else if len(c.preedit) > 0 {
+			c.tone = c.unmarkedTone()
+			c.lookup()
+		} else {
+			c.emit(EVENT_PASSTHROUGH, " ")
+		}
+	case key == KEY_BACKSPACE:
+		if c.candidates != nil {
+			c.candidates = nil
+			c.tone = -1
+		} else if len(c.preedit) > 0 {
+			c.preedit = c.preedit[:len(c.preedit)-1]
+		} else {
+			c.emit(EVENT_BACKSPACE, "")
+		}
+	case key == KEY_ENTER:
+		if len(c.preedit) > 0 {
+			c.emit(EVENT_COMMIT, c.Preedit())
+			c.reset()
+		} else {
+			c.emit(EVENT_PASSTHROUGH, "\n")
+		}
+	case key == KEY_ESCAPE:
+		c.reset()
+	case key == KEY_PAGE_DOWN:
+		if c.page+1 < c.pageCount() {
+			c.page++
+		}
+	case key == KEY_PAGE_UP:
+		if c.page > 0 {
+			c.page--
+		}
+	case strings.HasPrefix(key, KEY_SELECT):
+		if index, err := strconv.Atoi(key[len(KEY_SELECT):]); err == nil && c.candidates != nil {
+			c.selectIndex(index)
+		}
+	case c.candidates != nil && c.isSelectionKey(key):
+		index, _ := c.selectionIndex(key)
+		c.selectIndex(index)
+	default:
+		if len(c.preedit) == 0 {
+			c.emit(EVENT_PASSTHROUGH, key)
+		}
+	}
+	return c.State()
+}
+
+// isTone reports whether key types a tone
+func isTone(key string) bool {
+	_, ok := toneOf(key)
+	return ok
+}
+
+// Preedit returns the uncommitted Zhuyin typed so far
+func (c *Composer) Preedit() string {
+	return strings.Join(c.preedit, "")
+}
+
+// State returns a snapshot of the composer, including the current page of
+// candidates and any events produced by the last key
+func (c *Composer) State() *CompositionState {
+	state := &CompositionState{
+		Preedit: c.Preedit(),
+		Tone:    c.tone,
+		Events:  c.events,
+	}
+	if c.candidates != nil {
+		var info *PageInfo
+		state.Candidates, info = paginate(c.candidates, c.page, c.pageSize)
+		state.Page = info.Page
+		state.PageCount = info.PageCount
+		state.Total = info.Total
+		state.SelectionKeys = c.selectionKeys
+		if len(state.SelectionKeys) > len(state.Candidates) {
+			state.SelectionKeys = state.SelectionKeys[:len(state.Candidates)]
+		}
+	}
+	return state
+}
+
+// lookup fetches the candidates for the current preedit and tone, in
+// Mandarin the words of the user's dictionary first
+func (c *Composer) lookup() {
+	var candidates []Character
+	if c.dialect != nil {
+		result, _, err := c.ref.GetByDialect(c.dialect.Code, c.Preedit()+strconv.Itoa(c.tone))
+		if err == nil && result != nil {
+			candidates = *result
+		}
+	} else {
+		result, _ := c.ref.GetByZhuyin(c.Preedit() + strconv.Itoa(c.tone))
+		if result != nil {
+			candidates = *result
+		}
+		candidates = c.ref.MergeUserEntries(c.user, c.Preedit(), c.tone, candidates)
+	}
+	// an empty, non-nil list shows that nothing matched
+	c.candidates = []Character{}
+	if len(candidates) > 0 {
+		c.candidates = candidates
+	}
+	c.page = 0
+}
+
+// selectIndex commits the candidate at index on the current page. When
+// nothing matched the preedit is committed as typed
+func (c *Composer) selectIndex(index int) {
+	if len(c.candidates) == 0 {
+		c.emit(EVENT_COMMIT, c.Preedit())
+		c.reset()
+		return
+	}
+	if index < 0 || index >= c.pageSize {
+		return
+	}
+	index += c.page * c.pageSize
+	if index >= len(c.candidates) {
+		return
+	}
+	c.emit(EVENT_COMMIT, c.candidates[index].Character)
+	c.reset()
+}
+
+// pageCount returns the number of candidate pages
+func (c *Composer) pageCount() int {
+	return (len(c.candidates) + c.pageSize - 1) / c.pageSize
+}
+
+// emit queues an event for the client
+func (c *Composer) emit(eventType, text string) {
+	c.events = append(c.events, CompositionEvent{eventType, text})
+}
+
+// reset clears the preedit and candidates
+func (c *Composer) reset() {
+	c.preedit = nil
+	c.tone = -1
+	c.candidates = nil
+	c.page = 0
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// typeKeys feeds keys to a composer, returning the state after the last
+func typeKeys(c *Composer, keys ...string) *CompositionState {
+	var state *CompositionState
+	for _, key := range keys {
+		state = c.Key(key)
+	}
+	return state
+}
+
+// commits returns the text of the commit events of a state
+func commits(state *CompositionState) []string {
+	var texts []string
+	for _, event := range state.Events {
+		if event.Type == EVENT_COMMIT {
+			texts = append(texts, event.Text)
+		}
+	}
+	return texts
+}
+
+func TestComposerToneLookup(t *testing.T) {
+	c := NewComposer(newTestReference(t))
+	state := typeKeys(c, "ㄨ", "ㄛ")
+	if state.Preedit != "ㄨㄛ" || state.Candidates != nil {
+		t.Fatalf("preedit state = %+v", state)
+	}
+	state = c.Key("ˋ")
+	if state.Tone != 4 || state.Total != 2 || state.Candidates[0].Character != "握" {
+		t.Fatalf("after tone, state = %+v", state)
+	}
+	if !reflect.DeepEqual(state.SelectionKeys, []string{"!", "@"}) {
+		t.Errorf("selection keys = %v, want one per candidate", state.SelectionKeys)
+	}
+	state = c.Key("@")
+	if got := commits(state); !reflect.DeepEqual(got, []string{"沃"}) {
+		t.Errorf("second selection key committed %v, want [沃]", got)
+	}
+	if state.Preedit != "" || state.Candidates != nil {
+		t.Errorf("composer not reset after commit: %+v", state)
+	}
+}
+
+func TestComposerSpaceIsFirstTone(t *testing.T) {
+	c := NewComposer(newTestReference(t))
+	state := typeKeys(c, "ㄨ", "ㄛ", KEY_SPACE)
+	if state.Tone != 1 || state.Total != 1 {
+		t.Fatalf("space lookup state = %+v", state)
+	}
+	if got := commits(c.Key(KEY_SPACE)); !reflect.DeepEqual(got, []string{"窩"}) {
+		t.Errorf("space committed %v, want [窩]", got)
+	}
+}
+
+func TestComposerTypingOnAcceptsFirst(t *testing.T) {
+	c := NewComposer(newTestReference(t))
+	state := typeKeys(c, "ㄨ", "ㄛ", "3", "ㄇ")
+	if got := commits(state); !reflect.DeepEqual(got, []string{"我"}) {
+		t.Errorf("typing on committed %v, want [我]", got)
+	}
+	if state.Preedit != "ㄇ" {
+		t.Errorf("preedit = %q, want ㄇ", state.Preedit)
+	}
+}
+
+func TestComposerEditing(t *testing.T) {
+	c := NewComposer(newTestReference(t))
+	state := typeKeys(c, "ㄨ", "ㄛ", "4", KEY_BACKSPACE)
+	if state.Candidates != nil || state.Preedit != "ㄨㄛ" || state.Tone != -1 {
+		t.Errorf("backspace over candidates: %+v", state)
+	}
+	state = typeKeys(c, KEY_BACKSPACE, KEY_BACKSPACE, KEY_BACKSPACE)
+	if len(state.Events) != 1 || state.Events[0].Type != EVENT_BACKSPACE {
+		t.Errorf("backspace on empty preedit: %+v", state.Events)
+	}
+	state = typeKeys(c, "ㄨ", KEY_ENTER)
+	if got := commits(state); !reflect.DeepEqual(got, []string{"ㄨ"}) {
+		t.Errorf("enter committed %v, want the preedit", got)
+	}
+	state = typeKeys(c, "ㄨ", KEY_ESCAPE)
+	if state.Preedit != "" || len(state.Events) != 0 {
+		t.Errorf("escape: %+v", state)
+	}
+	state = c.Key("a")
+	if len(state.Events) != 1 || state.Events[0] != (CompositionEvent{EVENT_PASSTHROUGH, "a"}) {
+		t.Errorf("other key on empty preedit: %+v", state.Events)
+	}
+	if state = typeKeys(c, "ㄇ", "ㄣ", "ㄨ", "ㄛ"); state.Preedit != "ㄇㄣㄨ" {
+		t.Errorf("preedit = %q, want at most %d symbols", state.Preedit, maxSyllableSymbols)
+	}
+}
+
+func TestComposerNoMatchCommitsPreedit(t *testing.T) {
+	c := NewComposer(newTestReference(t))
+	state := typeKeys(c, "ㄈ", "3")
+	if state.Total != 0 || state.Candidates == nil {
+		t.Fatalf("no match state = %+v", state)
+	}
+	if got := commits(c.Key(KEY_SPACE)); !reflect.DeepEqual(got, []string{"ㄈ"}) {
+		t.Errorf("committed %v, want the preedit", got)
+	}
+}
+
+func TestComposerPaging(t *testing.T) {
+	c := NewComposer(newTestReference(t))
+	c.SetPageSize(1)
+	state := typeKeys(c, "ㄨ", "ㄛ", "4", KEY_PAGE_DOWN)
+	if state.Page != 1 || state.PageCount != 2 || state.Candidates[0].Character != "沃" {
+		t.Fatalf("page down state = %+v", state)
+	}
+	if state = c.Key(KEY_PAGE_DOWN); state.Page != 1 {
+		t.Errorf("page down past the end moved to page %d", state.Page)
+	}
+	if got := commits(c.Key(KEY_SELECT + "0")); !reflect.DeepEqual(got, []string{"沃"}) {
+		t.Errorf("selecting on page 1 committed %v, want [沃]", got)
+	}
+}
+
+func TestComposerSelectionKeys(t *testing.T) {
+	c := NewComposer(nil)
+	c.SetSelectionKeys("a3ㄅsㆣ")
+	if !reflect.DeepEqual(c.selectionKeys, []string{"a", "s"}) {
+		t.Errorf("selection keys = %v, want tone and Zhuyin keys dropped", c.selectionKeys)
+	}
+}
+
+func TestComposerDialect(t *testing.T) {
+	ref := newTestReference(t)
+	importHokkien(t, ref)
+	c := NewComposer(ref)
+	if err := c.SetDialect("xx"); err == nil {
+		t.Error("unknown dialect set")
+	}
+	if err := c.SetDialect(DIALECT_HOKKIEN); err != nil {
+		t.Fatal(err)
+	}
+
+	state := typeKeys(c, "ㆣ", "ㄨ", "ㄚ", "ˋ")
+	if state.Tone != 2 || state.Total != 1 || state.Candidates[0].Character != "我" {
+		t.Fatalf("ㆣㄨㄚˋ state = %+v", state)
+	}
+	if got := commits(c.Key(KEY_SPACE)); !reflect.DeepEqual(got, []string{"我"}) {
+		t.Errorf("space committed %v, want [我]", got)
+	}
+
+	// ˋ is not a tone of a checked syllable, ˙ is
+	if state = typeKeys(c, "ㄏ", "ㄚ", "ㆶ", "ˋ"); state.Candidates != nil || state.Preedit != "ㄏㄚㆶ" {
+		t.Errorf("open tone on a checked syllable = %+v", state)
+	}
+	state = c.Key("˙")
+	if state.Tone != 8 || state.Total != 2 || state.Candidates[0].Character != "學" {
+		t.Errorf("ㄏㄚㆶ˙ state = %+v, want 學 and 學生", state)
+	}
+	c.Key(KEY_ESCAPE)
+
+	// an unmarked checked syllable is the fourth tone
+	if state = typeKeys(c, "ㄏ", "ㄚ", "ㆶ", KEY_SPACE); state.Tone != 4 {
+		t.Errorf("unmarked ㄏㄚㆶ tone = %d, want 4", state.Tone)
+	}
+	if c.SetDialect(""); c.Preedit() != "" {
+		t.Error("switching back to Mandarin kept the preedit")
+	}
+	if state = typeKeys(c, "ㆣ", "ㄨ", "ㄛ", "ˇ"); state.Preedit != "ㄨㄛ" || state.Total != 1 {
+		t.Errorf("Mandarin state = %+v, want ㆣ ignored", state)
+	}
+}
+
+func TestSessionComposersBound(t *testing.T) {
+	s := NewSessionComposers(nil)
+	first := s.Get("0")
+	for i := 1; i < maxSessionComposers; i++ {
+		s.Get(strconv.Itoa(i))
+	}
+	// keep session 0 in use, so that session 1 is the oldest
+	if s.Get("0") != first {
+		t.Fatal("Get made a new composer for a known session")
+	}
+	s.Get("new")
+	if s.Len() != maxSessionComposers {
+		t.Errorf("holding %d composers, want at most %d", s.Len(), maxSessionComposers)
+	}
+	if _, ok := s.composers["1"]; ok {
+		t.Error("least recently used session was kept")
+	}
+	if s.Get("0") != first {
+		t.Error("recently used session was dropped")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight result
+const corsMaxAge = "600"
+
+// normalizeOrigin lower-cases an origin and strips any trailing slash so
+// that "https://Example.com/" and "https://example.com" compare equal
+func normalizeOrigin(origin string) string {
+	return strings.TrimRight(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
+
+// originAllowed reports whether a browser origin is on the allowlist.
+// An empty allowlist, or one containing "*", allows every origin
+func (serv *ServerParams) originAllowed(origin string) bool {
+	if len(serv.config.AllowedOrigins) == 0 {
+		return true
+	}
+	origin = normalizeOrigin(origin)
+	for _, allowed := range serv.config.AllowedOrigins {
+		if allowed == "*" || normalizeOrigin(allowed) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is the WebSocket handshake hook enforcing the origin allowlist.
+// Clients that send no Origin header at all are not browsers and are let through
+func (serv *ServerParams) checkOrigin(config *websocket.Config, req *http.Request) error {
+	if req.Header.Get("Origin") == "" && req.Header.Get("Sec-Websocket-Origin") == "" {
+		return nil
+	}
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		metrics.Error("bad_origin")
+		return err
+	}
+	if origin == nil {
+		if len(serv.config.AllowedOrigins) == 0 {
+			return nil
+		}
+		metrics.Error("bad_origin")
+		return errors.New("null origin")
+	}
+	config.Origin = origin
+	if !serv.originAllowed(origin.Scheme + "://" + origin.Host) {
+		metrics.Error("bad_origin")
+		logger.Info("rejected websocket origin", "origin", origin.String(), "remote", clientIP(req))
+		return errors.New("origin not allowed")
+	}
+	return nil
+}
+
+// cors wraps an HTTP API handler with CORS headers for allowed origins
+// and answers preflight requests itself
+func (serv *ServerParams) cors(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && serv.originAllowed(origin)
+		// responses differ by origin, shared caches must key them on it
+		w.Header().Add("Vary", "Origin")
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		// Preflight
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				metrics.Error("bad_origin")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		allowlist []string
+		origin    string
+		want      bool
+	}{
+		{nil, "https://evil.example", true},
+		{[]string{"*"}, "https://evil.example", true},
+		{[]string{"https://ime.example"}, "https://ime.example", true},
+		{[]string{"https://IME.example/"}, "https://ime.example", true},
+		{[]string{"https://ime.example"}, "HTTPS://ime.example/", true},
+		{[]string{"https://ime.example"}, "http://ime.example", false},
+		{[]string{"https://ime.example"}, "https://ime.example:8443", false},
+		{[]string{"https://ime.example"}, "https://evil.example", false},
+	}
+	for _, test := range tests {
+		serv := &ServerParams{config: ServerConfig{AllowedOrigins: test.allowlist}}
+		if got := serv.originAllowed(test.origin); got != test.want {
+			t.Errorf("originAllowed(%s) with %v = %v, want %v", test.origin, test.allowlist, got, test.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		allowlist []string
+		origin    string
+		ok        bool
+	}{
+		// clients without an origin are not browsers
+		{[]string{"https://ime.example"}, "", true},
+		{[]string{"https://ime.example"}, "https://ime.example", true},
+		{[]string{"https://ime.example"}, "https://evil.example", false},
+		{[]string{"https://ime.example"}, "null", false},
+		{nil, "null", true},
+		{nil, "https://evil.example", true},
+		{nil, "not a url", false},
+	}
+	for _, test := range tests {
+		serv := &ServerParams{config: ServerConfig{AllowedOrigins: test.allowlist}}
+		r := httptest.NewRequest("GET", "/socket", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		config := &websocket.Config{Version: websocket.ProtocolVersionHybi13}
+		if err := serv.checkOrigin(config, r); (err == nil) != test.ok {
+			t.Errorf("checkOrigin(%q) with %v = %v", test.origin, test.allowlist, err)
+		}
+	}
+}
+
+func TestCorsWrapper(t *testing.T) {
+	called := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		called++
+		w.WriteHeader(http.StatusOK)
+	}
+	tests := []struct {
+		name      string
+		allowlist []string
+		method    string
+		origin    string
+		status    int
+		allowed   bool
+		called    bool
+	}{
+		{"allowed", []string{"https://ime.example"}, "GET", "https://ime.example", http.StatusOK, true, true},
+		// the browser enforces the missing header, the request is still answered
+		{"disallowed", []string{"https://ime.example"}, "GET", "https://evil.example", http.StatusOK, false, true},
+		{"no origin", []string{"https://ime.example"}, "GET", "", http.StatusOK, false, true},
+		{"empty allowlist", nil, "GET", "https://evil.example", http.StatusOK, true, true},
+		{"allowed preflight", []string{"https://ime.example"}, "OPTIONS", "https://ime.example", http.StatusNoContent, true, false},
+		{"disallowed preflight", []string{"https://ime.example"}, "OPTIONS", "https://evil.example", http.StatusForbidden, false, false},
+		{"empty allowlist preflight", nil, "OPTIONS", "https://evil.example", http.StatusNoContent, true, false},
+	}
+	for _, test := range tests {
+		serv := &ServerParams{config: ServerConfig{AllowedOrigins: test.allowlist}}
+		r := httptest.NewRequest(test.method, "/annotate", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+			r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		}
+		w := httptest.NewRecorder()
+		called = 0
+		serv.cors(handler)(w, r)
+
+		header := w.Header()
+		if w.Code != test.status || (called > 0) != test.called {
+			t.Errorf("%s: status %d, handler called %d times", test.name, w.Code, called)
+		}
+		if got := header.Get("Access-Control-Allow-Origin"); (got == test.origin && got != "") != test.allowed {
+			t.Errorf("%s: Access-Control-Allow-Origin %q", test.name, got)
+		}
+		if got := header.Get("Vary"); got != "Origin" {
+			t.Errorf("%s: Vary %q, want Origin", test.name, got)
+		}
+		if w.Code == http.StatusNoContent {
+			if header.Get("Access-Control-Allow-Methods") != "GET, POST, OPTIONS" ||
+				header.Get("Access-Control-Allow-Headers") != "Content-Type" ||
+				header.Get("Access-Control-Max-Age") != corsMaxAge {
+				t.Errorf("%s: preflight headers %v", test.name, header)
+			}
+		}
+	}
+
+	// an OPTIONS request that is not a preflight goes to the handler
+	serv := &ServerParams{}
+	called = 0
+	serv.cors(handler)(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/annotate", nil))
+	if called != 1 {
+		t.Error("plain OPTIONS request was not handled")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"code.google.com/p/go.net/dict"
+	"errors"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDefinitionCache bounds the number of words whose DICT definitions
+// are kept. The cache is emptied when it fills up
+const maxDefinitionCache = 10000
+
+// errDictTimeout is returned when the DICT server does not answer in time
+var errDictTimeout = errors.New("dict server timed out")
+
+// DefinitionBackend looks up definitions missing from the DB on a DICT
+// (RFC 2229) server, such as a local dictd serving CEDICT or freedict
+type DefinitionBackend struct {
+	addr    string
+	dict    string
+	timeout time.Duration
+	lock    sync.Mutex
+	cache   map[string]string
+}
+
+// NewDefinitionBackend returns a backend querying the dictionary named
+// dict on the DICT server at addr. The dictionary "!" uses the first of
+// the server's dictionaries that defines a word, "*" all of them
+func NewDefinitionBackend(addr, dict string, timeout time.Duration) *DefinitionBackend {
+	if dict == "" {
+		dict = "!"
+	}
+	return &DefinitionBackend{addr: addr, dict: dict, timeout: timeout, cache: make(map[string]string)}
+}
+
+// define asks the DICT server for the definitions of word, joined by
+// blank lines. A word the server does not know has an empty definition
+func (backend *DefinitionBackend) define(client *dict.Client, word string) (string, error) {
+	defns, err := client.Define(backend.dict, word)
+	if err != nil {
+		// 552 is the "no match" status
+		if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code == 552 {
+			return "", nil
+		}
+		return "", err
+	}
+	var texts []string
+	for _, defn := range defns {
+		if text := strings.TrimSpace(string(defn.Text)); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n\n"), nil
+}
+
+// dictSession is a DICT connection shared by the lookups of a request. It
+// is dialed on the first word missing from the cache
+type dictSession struct {
+	backend *DefinitionBackend
+	client  *dict.Client
+}
+
+// session returns a session on the backend, to be closed when done
+func (backend *DefinitionBackend) session() *dictSession {
+	return &dictSession{backend, nil}
+}
+
+// Close hangs up the session's connection, if it was dialed
+func (s *dictSession) Close() {
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+}
+
+// Define returns the DICT definition of a character or phrase, from the
+// cache when it was looked up before. Failed lookups are not cached, and
+// drop the connection, which is dialed again for the next word
+func (s *dictSession) Define(word string) (string, error) {
+	backend := s.backend
+	backend.lock.Lock()
+	definition, ok := backend.cache[word]
+	backend.lock.Unlock()
+	if ok {
+		metrics.DictCacheHit()
+		return definition, nil
+	}
+	metrics.DictCacheMiss()
+
+	type result struct {
+		client     *dict.Client
+		definition string
+		err        error
+	}
+	start := time.Now()
+	done := make(chan result, 1)
+	client := s.client
+	s.client = nil
+	go func() {
+		var err error
+		if client == nil {
+			if client, err = dict.Dial("tcp", backend.addr); err != nil {
+				done <- result{nil, "", err}
+				return
+			}
+		}
+		definition, err := backend.define(client, word)
+		done <- result{client, definition, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(backend.timeout):
+		// the connection is still busy with word, hang it up when done
+		go func() {
+			if r := <-done; r.client != nil {
+				r.client.Close()
+			}
+		}()
+		r.err = errDictTimeout
+	}
+	metrics.ObserveQuery("dict", time.Since(start))
+	if r.err != nil {
+		if r.client != nil {
+			r.client.Close()
+		}
+		metrics.Error("dict")
+		return "", r.err
+	}
+	s.client = r.client
+
+	backend.lock.Lock()
+	if len(backend.cache) >= maxDefinitionCache {
+		backend.cache = make(map[string]string)
+	}
+	backend.cache[word] = r.definition
+	backend.lock.Unlock()
+	return r.definition, nil
+}
+
+// Define returns the DICT definition of a character or phrase on a
+// connection of its own
+func (backend *DefinitionBackend) Define(word string) (string, error) {
+	s := backend.session()
+	defer s.Close()
+	return s.Define(word)
+}
+
+// Enrich returns a copy of candidates where the characters and phrases
+// without a definition take the DICT one, looked up on one connection.
+// With more set every candidate gets the DICT definition, after its own.
+// A nil backend returns candidates as is
+func (backend *DefinitionBackend) Enrich(candidates []Character, more bool) []Character {
+	if backend == nil {
+		return candidates
+	}
+	s := backend.session()
+	defer s.Close()
+
+	// candidates may be shared with the lookup cache, never change them
+	enriched := make([]Character, len(candidates))
+	copy(enriched, candidates)
+	for i := range enriched {
+		c := &enriched[i]
+		if c.Definition != "" && !more {
+			continue
+		}
+		definition, err := s.Define(c.Character)
+		if err != nil {
+			logger.Warn("dict lookup failed", "addr", backend.addr, "word", c.Character, "err", err)
+			return enriched
+		}
+		if definition == "" {
+			continue
+		}
+		if c.Definition == "" {
+			c.Definition = definition
+		} else {
+			c.Definition += "\n\n" + definition
+		}
+	}
+	return enriched
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dictServer is a stand-in DICT server answering DEFINE from a map. It
+// never answers the word "slow", to time out clients
+type dictServer struct {
+	net.Listener
+	definitions map[string]string
+	release     chan struct{}
+
+	lock        sync.Mutex
+	connections int
+	defines     int
+}
+
+func newDictServer(t *testing.T) *dictServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dictServer{Listener: l, release: make(chan struct{}), definitions: map[string]string{
+		"我":  "I; me",
+		"走":  "to walk",
+		"銀行": "bank",
+	}}
+	t.Cleanup(func() {
+		close(s.release)
+		l.Close()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *dictServer) serve() {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *dictServer) handle(conn net.Conn) {
+	defer conn.Close()
+	s.lock.Lock()
+	s.connections++
+	s.lock.Unlock()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 stand-in dictd")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "DEFINE" {
+			text.PrintfLine("500 unknown command")
+			continue
+		}
+		word, _ := strconv.Unquote(fields[2])
+		s.lock.Lock()
+		s.defines++
+		s.lock.Unlock()
+		if word == "slow" {
+			<-s.release
+			return
+		}
+		definition, ok := s.definitions[word]
+		if !ok {
+			text.PrintfLine("552 no match")
+			continue
+		}
+		text.PrintfLine("150 1 definitions retrieved")
+		text.PrintfLine("151 %q test \"Test dictionary\"", word)
+		w := text.DotWriter()
+		io.WriteString(w, definition+"\n")
+		w.Close()
+		text.PrintfLine("250 ok")
+	}
+}
+
+// counts returns the connections and DEFINE commands seen so far
+func (s *dictServer) counts() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connections, s.defines
+}
+
+func TestDefineMatch(t *testing.T) {
+	server := newDictServer(t)
+	backend := NewDefinitionBackend(server.Addr().String(), "", time.Second)
+	metrics.lock.Lock()
+	hits, cacheHits := metrics.dictHits, metrics.cacheHits
+	metrics.lock.Unlock()
+
+	for i := 0; i < 2; i++ {
+		definition, err := backend.Define("我")
+		if err != nil || definition != "I; me" {
+			t.Fatalf("Define(我) = %q, %v", definition, err)
+		}
+	}
+	if _, defines := server.counts(); defines != 1 {
+		t.Errorf("server saw %d DEFINE, want the second served from the cache", defines)
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if metrics.dictHits != hits+1 || metrics.cacheHits != cacheHits {
+		t.Errorf("DICT cache hit counted as %d DICT and %d lookup cache hits", metrics.dictHits-hits, metrics.cacheHits-cacheHits)
+	}
+}
+
+func TestDefineNoMatch(t *testing.T) {
+	server := newDictServer(t)
+	backend := NewDefinitionBackend(server.Addr().String(), "", time.Second)
+	if definition, err := backend.Define("沃"); err != nil || definition != "" {
+		t.Errorf("Define(沃) = %q, %v, want no definition", definition, err)
+	}
+}
+
+func TestDefineTimeout(t *testing.T) {
+	server := newDictServer(t)
+	backend := NewDefinitionBackend(server.Addr().String(), "", 50*time.Millisecond)
+	if _, err := backend.Define("slow"); err != errDictTimeout {
+		t.Errorf("Define(slow) error = %v, want %v", err, errDictTimeout)
+	}
+	if _, ok := backend.cache["slow"]; ok {
+		t.Error("timed out lookup was cached")
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	server := newDictServer(t)
+	backend := NewDefinitionBackend(server.Addr().String(), "", time.Second)
+	candidates := []Character{
+		{1, "我", "ㄨㄛ", "wo", 3, "", 100, ""},
+		{4, "沃", "ㄨㄛ", "wo", 4, "", 10, ""},
+		{9, "走", "ㄗㄡ", "zou", 3, "walk", 60, ""},
+		{1, "銀行", "", "", 0, "", 90, ""},
+	}
+	enriched := backend.Enrich(candidates, false)
+	want := []string{"I; me", "", "walk", "bank"}
+	for i, c := range enriched {
+		if c.Definition != want[i] {
+			t.Errorf("%s enriched to %q, want %q", c.Character, c.Definition, want[i])
+		}
+	}
+	if candidates[0].Definition != "" {
+		t.Error("Enrich changed its input")
+	}
+	if connections, defines := server.counts(); connections != 1 || defines != 3 {
+		t.Errorf("server saw %d DEFINE on %d connections, want 3 on 1", defines, connections)
+	}
+
+	more := backend.Enrich(candidates[2:3], true)
+	if more[0].Definition != "walk\n\nto walk" {
+		t.Errorf("more definition = %q", more[0].Definition)
+	}
+}
+
+func TestEnrichStopsOnTimeout(t *testing.T) {
+	server := newDictServer(t)
+	backend := NewDefinitionBackend(server.Addr().String(), "", 50*time.Millisecond)
+	candidates := []Character{
+		{1, "slow", "", "", 0, "", 0, ""},
+		{2, "我", "ㄨㄛ", "wo", 3, "", 100, ""},
+	}
+	enriched := backend.Enrich(candidates, false)
+	if enriched[1].Definition != "" {
+		t.Errorf("lookups went on after a timeout: %+v", enriched)
+	}
+}
+
+func TestEnrichWithoutBackend(t *testing.T) {
+	var backend *DefinitionBackend
+	candidates := []Character{{4, "沃", "ㄨㄛ", "wo", 4, "", 10, ""}}
+	if enriched := backend.Enrich(candidates, true); &enriched[0] != &candidates[0] {
+		t.Error("nil backend copied the candidates")
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Dialect codes, as in ISO 639-3
+const (
+	DIALECT_MANDARIN = "cmn"
+	DIALECT_HOKKIEN  = "nan"
+	DIALECT_HAKKA    = "hak"
+)
+
+// maxDialectSymbols is the most Zhuyin symbols a syllable has in any
+// dialect: initial, medial, rhyme and stop coda
+const maxDialectSymbols = 4
+
+// ToneMark is a mark written after a syllable for a tone. A mark may
+// stand for both an open and a checked tone, told apart by the stop coda
+type ToneMark struct {
+	Mark string
+	Tone int
+}
+
+// Dialect describes the Zhuyin syllables of a dialect: the symbols that
+// may only start a syllable, those that may follow, the stop codas ending
+// checked syllables and the tones. Unmarked tones have no tone mark
+type Dialect struct {
+	Code      string
+	Name      string
+	Initials  string
+	Finals    string
+	Codas     string
+	Tones     []int
+	Checked   []int
+	ToneMarks []ToneMark
+}
+
+// toneMarkList lists the tone marks of a map in the order of the marks
+func toneMarkList(marks map[string]int) []ToneMark {
+	list := make([]ToneMark, 0, len(marks))
+	for mark, tone := range marks {
+		list = append(list, ToneMark{mark, tone})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Mark < list[j].Mark })
+	return list
+}
+
+// longestFirst sorts tone marks longest first, so that a mark ending with
+// another is tried before it. Marks of the same length keep their order
+func longestFirst(marks []ToneMark) []ToneMark {
+	sort.SliceStable(marks, func(i, j int) bool { return len(marks[i].Mark) > len(marks[j].Mark) })
+	return marks
+}
+
+// dialects are the dialects that can be typed, by code. Hokkien and Hakka
+// use the Bopomofo Extended block (U+31A0–U+31BF) and the tone marks of
+// the Taiwanese Ministry of Education's 臺灣方音符號, for Hakka those of
+// Sixian, where ˋ marks both the falling and the low checked tone
+var dialects = map[string]*Dialect{
+	DIALECT_MANDARIN: {DIALECT_MANDARIN, "Mandarin",
+		"ㄅㄆㄇㄈㄉㄊㄋㄌㄍㄎㄏㄐㄑㄒㄓㄔㄕㄖㄗㄘㄙ",
+		"ㄚㄛㄜㄝㄞㄟㄠㄡㄢㄣㄤㄥㄦㄧㄨㄩ",
+		"",
+		[]int{1, 2, 3, 4, 5}, nil, longestFirst(toneMarkList(toneMarks))},
+	DIALECT_HOKKIEN: {DIALECT_HOKKIEN, "Taiwanese Hokkien",
+		"ㄅㄆㆠㄉㄊㄋㄌㄍㄎㆣㄏㄗㄘㆡㄙㄐㄑㆢㄒ",
+		"ㄇㄫㄚㆦㄜㆤㄧㄨㆩㆧㆥㆪㆫㄞㆮㄠㆯㆬㄢㄣㄤㆲㄥㆰㆱㆭㆨ",
+		"ㆴㆵㆶㆷ",
+		[]int{1, 2, 3, 4, 5, 7, 8}, []int{4, 8},
+		longestFirst([]ToneMark{{"ˋ", 2}, {"˪", 3}, {"ˊ", 5}, {"˫", 7}, {"˙", 8}})},
+	DIALECT_HAKKA: {DIALECT_HAKKA, "Hakka",
+		"ㄅㄆㄈㄪㄉㄊㄌㄍㄎㄏㄗㄘㄙㄐㄑㄒㄓㄔㄕㄖㆡㆢ",
+		"ㄇㄋㄫㄬㄚㄛㄜㆤㄝㄧㄨㄩㄭㄞㄟㄠㄡㆬㆰㄢㄣㄤㆲㄥ",
+		"ㆴㆵㆶ",
+		[]int{1, 2, 3, 4, 5, 7, 8}, []int{4, 8},
+		longestFirst([]ToneMark{{"ˊ", 1}, {"ˋ", 2}, {"ˋ", 4}, {"ˇ", 5}, {"⁺", 7}})},
+}
+
+// DialectReading is the reading of a character or word in a dialect, in
+// Zhuyin and in the dialect's romanization
+type DialectReading struct {
+	Id           int
+	Text         string
+	Dialect      string
+	Zhuyin       string
+	Tone         int
+	Romanization string
+	Definition   string
+	Freq         int
+}
+
+// DialectLookupRequest is an object that asks the DB thread for the
+// characters read as a syllable in a dialect. Tone is -1 for any tone
+type DialectLookupRequest struct {
+	Dialect   string
+	Zhuyin    string
+	Tone      int
+	WriteBack chan *CharLookupResponse
+}
+
+// DialectImportRequest is an object that asks the DB thread to store the
+// readings of a dialect dictionary
+type DialectImportRequest struct {
+	Readings  []DialectReading
+	WriteBack chan *ImportResult
+}
+
+// GetDialect returns the dialect of a code
+func GetDialect(code string) (*Dialect, bool) {
+	dialect, ok := dialects[strings.ToLower(code)]
+	return dialect, ok
+}
+
+// hasTone reports whether tone is one of tones
+func hasTone(tones []int, tone int) bool {
+	for _, t := range tones {
+		if t == tone {
+			return true
+		}
+	}
+	return false
+}
+
+// endsInStop reports whether a syllable ends with one of the dialect's
+// stop codas
+func (dialect *Dialect) endsInStop(syllable string) bool {
+	last, _ := utf8.DecodeLastRuneInString(syllable)
+	return dialect.Codas != "" && strings.ContainsRune(dialect.Codas, last)
+}
+
+// Syllable separates a syllable of the dialect from its tone, given as a
+// trailing digit or tone mark, and checks that it is well formed. The tone
+// is -1 when none is given
+func (dialect *Dialect) Syllable(input string) (string, int, error) {
+	input = strings.TrimSpace(input)
+	tone := -1
+	if n := len(input); n > 1 && input[n-1] >= '0' && input[n-1] <= '9' {
+		tone, input = int(input[n-1]-'0'), input[:n-1]
+	} else {
+		// the longest mark ending the input wins; of its tones, the one
+		// that fits whether the syllable is checked
+		matched := ""
+		for _, mark := range dialect.ToneMarks {
+			if matched != "" && mark.Mark != matched || len(input) <= len(mark.Mark) || !strings.HasSuffix(input, mark.Mark) {
+				continue
+			}
+			checked := dialect.endsInStop(strings.TrimSuffix(input, mark.Mark))
+			if matched == "" || checked == hasTone(dialect.Checked, mark.Tone) {
+				tone = mark.Tone
+			}
+			matched = mark.Mark
+		}
+		input = strings.TrimSuffix(input, matched)
+	}
+
+	symbols := []rune(input)
+	if len(symbols) == 0 || len(symbols) > maxDialectSymbols {
+		return "", tone, fmt.Errorf("%q is not a %s syllable", input, dialect.Name)
+	}
+	checked := false
+	for i, r := range symbols {
+		symbol := string(r)
+		switch {
+		case strings.Contains(dialect.Codas, symbol):
+			if i == 0 || i != len(symbols)-1 {
+				return "", tone, fmt.Errorf("%q: the stop %s must end the syllable", input, symbol)
+			}
+			checked = true
+		case strings.Contains(dialect.Finals, symbol):
+		case strings.Contains(dialect.Initials, symbol):
+			if i != 0 {
+				return "", tone, fmt.Errorf("%q: the initial %s must start the syllable", input, symbol)
+			}
+		default:
+			return "", tone, fmt.Errorf("%q: %s is not a %s symbol", input, symbol, dialect.Name)
+		}
+	}
+	if tone >= 0 && !hasTone(dialect.Tones, tone) {
+		return "", tone, fmt.Errorf("%q: tone %d is not a %s tone", input, tone, dialect.Name)
+	}
+	if tone >= 0 && len(dialect.Checked) > 0 && checked != hasTone(dialect.Checked, tone) {
+		return "", tone, fmt.Errorf("%q: only syllables ending in a stop take tone %d", input, tone)
+	}
+	return input, tone, nil
+}
+
+// GetByDialect retrieves full candidate characters, given a syllable in a
+// dialect. Their Zhuyin and tone are the dialect reading and their Pinyin
+// its romanization. Mandarin syllables are looked up as Zhuyin
+func (ref ReferenceStore) GetByDialect(code, syllable string) (*[]Character, int, error) {
+	dialect, ok := GetDialect(code)
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown dialect %q", code)
+	}
+	zhuyin, tone, err := dialect.Syllable(syllable)
+	if err != nil {
+		return nil, 0, err
+	}
+	if dialect.Code == DIALECT_MANDARIN {
+		if tone >= 0 {
+			zhuyin += strconv.Itoa(tone)
+		}
+		result, count := ref.GetByZhuyin(zhuyin)
+		return result, count, nil
+	}
+
+	start := time.Now()
+	writeBack := make(chan *CharLookupResponse)
+	metrics.QueueAdd(1)
+	ref.dialectQueue <- &DialectLookupRequest{dialect.Code, zhuyin, tone, writeBack}
+	response := <-writeBack
+	metrics.QueueAdd(-1)
+	metrics.ObserveQuery(dialect.Code, time.Since(start))
+	return &response.CharList, response.NumResults, nil
+}
+
+// GetDialectReadings is the base dialect lookup function called only by
+// the DB thread. Syllables match by prefix, so that partly typed ones
+// list their completions and words list under their first syllable
+func (ref ReferenceStore) GetDialectReadings(request *DialectLookupRequest) *CharLookupResponse {
+	toneString := "%"
+	if request.Tone >= 0 {
+		toneString = strconv.Itoa(request.Tone)
+	}
+	searchStmt, err := ref.conn.Prepare(`SELECT id, character, zhuyin, romanization, tone, definition, freq
+						FROM dialect_readings
+						WHERE dialect = ? AND zhuyin LIKE ? AND tone LIKE ?
+						ORDER BY freq DESC LIMIT 50`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare dialect search", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	defer searchStmt.Finalize()
+
+	if err = searchStmt.Exec(request.Dialect, request.Zhuyin+"%", toneString); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while selecting", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	var charList []Character
+	for searchStmt.Next() {
+		var c Character
+		if err = searchStmt.Scan(&c.Id, &c.Character, &c.Zhuyin, &c.Pinyin, &c.Tone, &c.Definition, &c.Freq); err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting row data", "err", err)
+			continue
+		}
+		charList = append(charList, c)
+	}
+	return &CharLookupResponse{charList, len(charList)}
+}
+
+// ParseDialectDictionary reads a dialect dictionary: one reading per line
+// as tab separated text, syllables, romanization, frequency and definition,
+// where only the first two are required. Syllables are separated by spaces,
+// each with a tone digit or mark. Words are stored under the tone of their
+// first syllable, the one they are looked up by. It returns the number of
+// lines that are not valid readings of the dialect
+func ParseDialectDictionary(r io.Reader, dialect *Dialect) ([]DialectReading, int, error) {
+	var readings []DialectReading
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+		syllables := strings.Fields(fields[1])
+		if fields[0] == "" || len(syllables) == 0 || len(syllables) != utf8.RuneCountInString(fields[0]) {
+			logger.Debug("not a dialect reading", "line", line)
+			skipped++
+			continue
+		}
+
+		var zhuyin []string
+		tone := -1
+		for i, syllable := range syllables {
+			symbols, t, err := dialect.Syllable(syllable)
+			if err != nil {
+				logger.Debug("not a dialect reading", "line", line, "err", err)
+				zhuyin = nil
+				break
+			}
+			zhuyin = append(zhuyin, symbols)
+			if i == 0 {
+				tone = t
+			}
+		}
+		freq, err := strconv.Atoi(strings.TrimSpace(fields[3]))
+		if zhuyin == nil || err != nil && strings.TrimSpace(fields[3]) != "" {
+			skipped++
+			continue
+		}
+		readings = append(readings, DialectReading{-1, fields[0], dialect.Code, strings.Join(zhuyin, " "), tone,
+			strings.TrimSpace(fields[2]), strings.TrimSpace(fields[4]), freq})
+	}
+	return readings, skipped, scanner.Err()
+}
+
+// ImportDialect stores the readings of a dialect dictionary, updating the
+// romanization, definition and frequency of those already stored
+func (ref ReferenceStore) ImportDialect(readings []DialectReading) *ImportResult {
+	writeBack := make(chan *ImportResult)
+	metrics.QueueAdd(1)
+	ref.dialectImportQueue <- &DialectImportRequest{readings, writeBack}
+	result := <-writeBack
+	metrics.QueueAdd(-1)
+	return result
+}
+
+// storeDialectReading adds a reading or updates the stored one
+func (ref ReferenceStore) storeDialectReading(reading DialectReading, result *ImportResult) error {
+	stmt, err := ref.conn.Prepare(`SELECT id, romanization, definition, freq FROM dialect_readings
+					WHERE character = ? AND dialect = ? AND zhuyin = ? AND tone = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(reading.Text, reading.Dialect, reading.Zhuyin, reading.Tone); err != nil {
+		return err
+	}
+	if !stmt.Next() {
+		result.Added++
+		return ref.conn.Exec(`INSERT INTO dialect_readings(character, dialect, zhuyin, tone, romanization, definition, freq)
+					VALUES(?, ?, ?, ?, ?, ?, ?)`,
+			reading.Text, reading.Dialect, reading.Zhuyin, reading.Tone, reading.Romanization, reading.Definition, reading.Freq)
+	}
+
+	var old DialectReading
+	if err = stmt.Scan(&old.Id, &old.Romanization, &old.Definition, &old.Freq); err != nil {
+		return err
+	}
+	if reading.Romanization == "" {
+		reading.Romanization = old.Romanization
+	}
+	if reading.Definition == "" {
+		reading.Definition = old.Definition
+	}
+	if reading.Romanization == old.Romanization && reading.Definition == old.Definition && reading.Freq == old.Freq {
+		result.Kept++
+		return nil
+	}
+	result.Updated++
+	return ref.conn.Exec("UPDATE dialect_readings SET romanization = ?, definition = ?, freq = ? WHERE id = ?",
+		reading.Romanization, reading.Definition, reading.Freq, old.Id)
+}
+
+// ApplyDialectImport is the base dialect import function called only by
+// the DB thread. The import runs in a single transaction
+func (ref ReferenceStore) ApplyDialectImport(request *DialectImportRequest) *ImportResult {
+	result := &ImportResult{}
+	return ref.importTransaction(result, func() error {
+		for _, reading := range request.Readings {
+			if err := ref.storeDialectReading(reading, result); err != nil {
+				return importFailed(reading.Text, err)
+			}
+		}
+		return nil
+	})
+}
+
+// RunImportDialect is the importdialect command: it stores the readings
+// of dialect dictionaries
+func RunImportDialect(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("importdialect", flag.ExitOnError)
+	code := flags.String("dialect", DIALECT_HOKKIEN, "Dialect of the dictionaries: nan (Taiwanese Hokkien) or hak (Hakka)")
+	flags.Parse(args)
+
+	dialect, ok := GetDialect(*code)
+	if !ok || dialect.Code == DIALECT_MANDARIN {
+		return fmt.Errorf("unknown dialect %q", *code)
+	}
+	if flags.NArg() == 0 {
+		return errors.New("no dictionary to import")
+	}
+
+	var readings []DialectReading
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		parsed, skipped, err := ParseDialectDictionary(file, dialect)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if skipped > 0 {
+			logger.Warn("lines that are not readings of the dialect were skipped", "file", name, "count", skipped)
+		}
+		readings = append(readings, parsed...)
+	}
+
+	result := ref.ImportDialect(readings)
+	if result.Err != nil {
+		return result.Err
+	}
+	logger.Info("dialect readings imported", "dialect", dialect.Code, "added", result.Added, "updated", result.Updated,
+		"kept", result.Kept)
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testHokkien is a Hokkien dictionary with a line of another dialect
+const testHokkien = "我\tㆣㄨㄚˋ\tguá\t100\tI\n" +
+	"學\tㄏㄚㆶ˙\thak8\t40\tlearn\n" +
+	"學生\tㄏㄚㆶ8 ㄙㄥ\thak-sing\t30\tstudent\n" +
+	"客\tㄎㄜ⁺\n"
+
+func TestDialectSyllable(t *testing.T) {
+	tests := []struct {
+		dialect, input string
+		syllable       string
+		tone           int
+	}{
+		{DIALECT_MANDARIN, "ㄨㄛˇ", "ㄨㄛ", 3},
+		{DIALECT_HOKKIEN, "ㆣㄨㄚˋ", "ㆣㄨㄚ", 2},
+		{DIALECT_HOKKIEN, "ㆣㄨㄚ2", "ㆣㄨㄚ", 2},
+		{DIALECT_HOKKIEN, "ㄏㄚㆷ", "ㄏㄚㆷ", -1},
+		{DIALECT_HOKKIEN, "ㄏㄚㆷ˙", "ㄏㄚㆷ", 8},
+		{DIALECT_HAKKA, "ㄍㄚˊ", "ㄍㄚ", 1},
+		{DIALECT_HAKKA, "ㄏㄛˋ", "ㄏㄛ", 2},
+		{DIALECT_HAKKA, "ㄏㄚㆶˋ", "ㄏㄚㆶ", 4},
+		{DIALECT_HAKKA, "ㄖㄣˇ", "ㄖㄣ", 5},
+		{DIALECT_HAKKA, "ㄏㄛ⁺", "ㄏㄛ", 7},
+		{DIALECT_HAKKA, "ㄏㄚㆶ8", "ㄏㄚㆶ", 8},
+	}
+	for _, test := range tests {
+		dialect, _ := GetDialect(test.dialect)
+		syllable, tone, err := dialect.Syllable(test.input)
+		if err != nil || syllable != test.syllable || tone != test.tone {
+			t.Errorf("%s Syllable(%s) = %s, %d, %v, want %s, %d", test.dialect, test.input, syllable, tone, err, test.syllable, test.tone)
+		}
+	}
+
+	invalid := []struct{ dialect, input string }{
+		{DIALECT_HOKKIEN, "ㄏㄚㆷˋ"}, // open tone on a checked syllable
+		{DIALECT_HOKKIEN, "ㄏㄚ˙"},  // checked tone on an open syllable
+		{DIALECT_HOKKIEN, "ㄚㄅ"},   // initial after a final
+		{DIALECT_HOKKIEN, "ㆷㄚ"},   // stop starting the syllable
+		{DIALECT_HOKKIEN, "ㄏㄚ6"},  // no sixth tone
+		{DIALECT_HAKKA, "ㄏㄛ˙"},    // not a Hakka tone mark
+		{DIALECT_HAKKA, ""},
+	}
+	for _, test := range invalid {
+		dialect, _ := GetDialect(test.dialect)
+		if syllable, tone, err := dialect.Syllable(test.input); err == nil {
+			t.Errorf("%s Syllable(%s) = %s, %d, want an error", test.dialect, test.input, syllable, tone)
+		}
+	}
+}
+
+func TestToneMarksLongestFirst(t *testing.T) {
+	marks := longestFirst([]ToneMark{{"b", 1}, {"ab", 2}, {"c", 3}})
+	if !reflect.DeepEqual(marks, []ToneMark{{"ab", 2}, {"b", 1}, {"c", 3}}) {
+		t.Errorf("longestFirst = %v", marks)
+	}
+	dialect := &Dialect{"x", "Test", "", "ab", "", []int{1, 2}, nil, marks}
+	if syllable, tone, err := dialect.Syllable("aab"); err != nil || syllable != "a" || tone != 2 {
+		t.Errorf("Syllable(aab) = %s, %d, %v, want the longer mark", syllable, tone, err)
+	}
+	for code, dialect := range dialects {
+		for i := 1; i < len(dialect.ToneMarks); i++ {
+			if len(dialect.ToneMarks[i].Mark) > len(dialect.ToneMarks[i-1].Mark) {
+				t.Errorf("%s tone marks are not longest first: %v", code, dialect.ToneMarks)
+			}
+		}
+	}
+}
+
+// importHokkien imports testHokkien into ref
+func importHokkien(t *testing.T, ref *ReferenceStore) {
+	t.Helper()
+	dialect, _ := GetDialect(DIALECT_HOKKIEN)
+	readings, skipped, err := ParseDialectDictionary(strings.NewReader(testHokkien), dialect)
+	if err != nil || skipped != 1 || len(readings) != 3 {
+		t.Fatalf("ParseDialectDictionary read %d and skipped %d, %v", len(readings), skipped, err)
+	}
+	if readings[2].Zhuyin != "ㄏㄚㆶ ㄙㄥ" || readings[2].Tone != 8 {
+		t.Errorf("word reading = %+v, want the tone of its first syllable", readings[2])
+	}
+	if result := ref.ImportDialect(readings); result.Err != nil || result.Added != 3 {
+		t.Fatalf("ImportDialect = %+v", *result)
+	}
+}
+
+func TestGetByDialect(t *testing.T) {
+	ref := newTestReference(t)
+	importHokkien(t, ref)
+
+	result, n, err := ref.GetByDialect(DIALECT_HOKKIEN, "ㄏㄚㆶ˙")
+	if err != nil || n != 2 || (*result)[0].Character != "學" || (*result)[1].Character != "學生" {
+		t.Errorf("GetByDialect(ㄏㄚㆶ˙) = %v, %v", *result, err)
+	}
+	if result, n, err = ref.GetByDialect(DIALECT_MANDARIN, "ㄨㄛˋ"); err != nil || n != 2 {
+		t.Errorf("Mandarin GetByDialect(ㄨㄛˋ) found %d, %v", n, err)
+	}
+	if _, _, err = ref.GetByDialect("xx", "ㄅ"); err == nil {
+		t.Error("unknown dialect looked up")
+	}
+}
+
+func TestDialectRoute(t *testing.T) {
+	ref := newTestReference(t)
+	importHokkien(t, ref)
+	serv := &ServerParams{ref: ref}
+
+	get := func(path string) *Response {
+		w := httptest.NewRecorder()
+		serv.requestHandler(w, httptest.NewRequest("GET", path, nil))
+		var resp Response
+		if json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+			return nil
+		}
+		return &resp
+	}
+	resp := get("/get/dialect/nan/" + url.PathEscape("ㆣㄨㄚ"))
+	if resp == nil || resp.ResponseType != RESPONSE_OK {
+		t.Fatalf("dialect lookup answered %+v", resp)
+	}
+	if candidates := resp.Data.([]interface{}); len(candidates) != 1 {
+		t.Errorf("dialect lookup found %v", candidates)
+	}
+	for _, path := range []string{"/get/nan/" + url.PathEscape("ㆣㄨㄚ"), "/get/dialect/nan", "/get/dialect/xx/a"} {
+		if resp = get(path); resp != nil {
+			t.Errorf("%s answered %+v", path, resp)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dictionary table formats
+const (
+	TABLE_CIN   = "cin"
+	TABLE_IBUS  = "ibus"
+	TABLE_FCITX = "fcitx"
+	TABLE_RIME  = "rime"
+)
+
+// tableWriters write a dictionary table in each table format
+var tableWriters = map[string]func(io.Writer, *DictionaryTable) error{
+	TABLE_CIN:   WriteCin,
+	TABLE_IBUS:  WriteIbusTable,
+	TABLE_FCITX: WriteFcitxTable,
+	TABLE_RIME:  WriteRimeDict,
+}
+
+// ibusKeyNames are the X key names of the default selection keys, as
+// ibus-table expects them
+var ibusKeyNames = map[rune]string{
+	'!': "exclam", '@': "at", '#': "numbersign", '$': "dollar", '%': "percent",
+	'^': "asciicircum", '&': "ampersand", '*': "asterisk", '(': "parenleft",
+}
+
+// TableEntry is a character or phrase with the keys typing each of its
+// syllables
+type TableEntry struct {
+	Text      string
+	Syllables []string
+	Freq      int
+}
+
+// Key returns the keys typing the whole entry
+func (entry TableEntry) Key() string {
+	return strings.Join(entry.Syllables, "")
+}
+
+// DictionaryTable is the dictionary keyed for an input method, either by
+// Zhuyin or by the keystrokes of a layout. The first tone is not typed.
+// Version dates the table, for the formats that carry a version
+type DictionaryTable struct {
+	Name    string
+	Layout  *Layout
+	Entries []TableEntry
+	Version time.Time
+}
+
+// syllableKey returns the keys typing a reading, or false if the layout
+// has no key for one of its symbols
+func (table *DictionaryTable) syllableKey(zhuyin string, tone int) (string, bool) {
+	key := ""
+	for _, symbol := range readingSymbols(zhuyin, tone) {
+		if toneMarks[symbol] == 1 {
+			continue
+		}
+		if table.Layout != nil {
+			var ok bool
+			if symbol, ok = table.Layout.KeyOf(symbol); !ok {
+				return "", false
+			}
+		}
+		key += symbol
+	}
+	return key, key != ""
+}
+
+// KeyChars returns every key used by the table, sorted
+func (table *DictionaryTable) KeyChars() string {
+	seen := make(map[rune]bool)
+	for _, entry := range table.Entries {
+		for _, r := range entry.Key() {
+			seen[r] = true
+		}
+	}
+	var chars []string
+	for r := range seen {
+		chars = append(chars, string(r))
+	}
+	sort.Strings(chars)
+	return strings.Join(chars, "")
+}
+
+// MaxKeyLength returns the length in keys of the longest key of the table
+func (table *DictionaryTable) MaxKeyLength() int {
+	max := 0
+	for _, entry := range table.Entries {
+		if length := len([]rune(entry.Key())); length > max {
+			max = length
+		}
+	}
+	return max
+}
+
+// BuildDictionaryTable keys every character and phrase of the dictionary
+// by the keystrokes of layout, or by Zhuyin when layout is nil. Phrases
+// take the readings their characters have in them. Entries are sorted by
+// key and then by frequency, most frequent first
+func BuildDictionaryTable(ref *ReferenceStore, name string, layout *Layout) *DictionaryTable {
+	table := &DictionaryTable{name, layout, nil, time.Time{}}
+	dump := ref.Dump()
+	index := make(map[[2]string]int)
+
+	add := func(text string, syllables []string, freq int) {
+		entry := TableEntry{text, syllables, freq}
+		id := [2]string{text, entry.Key()}
+		if i, ok := index[id]; ok {
+			if freq > table.Entries[i].Freq {
+				table.Entries[i].Freq = freq
+			}
+			return
+		}
+		index[id] = len(table.Entries)
+		table.Entries = append(table.Entries, entry)
+	}
+
+	skipped := 0
+	for _, c := range dump.Characters {
+		key, ok := table.syllableKey(c.Zhuyin, c.Tone)
+		if !ok || c.Character == "" {
+			skipped++
+			continue
+		}
+		add(c.Character, []string{key}, c.Freq)
+	}
+
+	annotator := NewAnnotator(ref)
+	for _, phrase := range dump.Phrases {
+		var syllables []string
+		for _, a := range annotator.Annotate(phrase.Phrase) {
+			key, ok := table.syllableKey(a.Zhuyin, a.Tone)
+			if !ok {
+				syllables = nil
+				break
+			}
+			syllables = append(syllables, key)
+		}
+		if len(syllables) == 0 {
+			skipped++
+			continue
+		}
+		add(phrase.Phrase, syllables, phrase.Freq)
+	}
+	if skipped > 0 {
+		logger.Warn("entries without a typable reading were skipped", "count", skipped)
+	}
+
+	sort.SliceStable(table.Entries, func(i, j int) bool {
+		a, b := table.Entries[i], table.Entries[j]
+		if a.Key() != b.Key() {
+			return a.Key() < b.Key()
+		}
+		return a.Freq > b.Freq
+	})
+	return table
+}
+
+// WriteCin writes table as a .cin table for gcin and OpenVanilla. The
+// format has no weights, so candidates are listed most frequent first
+func WriteCin(w io.Writer, table *DictionaryTable) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "# Generated by rational-ime")
+	io.WriteString(out, "%gen_inp\n")
+	fmt.Fprintf(out, "%%ename %s\n", table.Name)
+	io.WriteString(out, "%cname 注音\n")
+	fmt.Fprintf(out, "%%selkey %s\n", defaultSelectionKeys)
+
+	if table.Layout != nil {
+		var endKeys []string
+		for _, toneKey := range table.Layout.ToneKeys {
+			if toneKey.Tone != 1 {
+				endKeys = append(endKeys, toneKey.Key)
+			}
+		}
+		sort.Strings(endKeys)
+		fmt.Fprintf(out, "%%endkey %s\n", strings.Join(endKeys, ""))
+	}
+
+	io.WriteString(out, "%keyname begin\n")
+	for _, r := range table.KeyChars() {
+		symbol := string(r)
+		if table.Layout != nil {
+			for _, row := range table.Layout.Rows {
+				for _, key := range row.Keys {
+					if key.Key == string(r) {
+						symbol = key.Symbol
+					}
+				}
+			}
+		}
+		fmt.Fprintf(out, "%c %s\n", r, symbol)
+	}
+	io.WriteString(out, "%keyname end\n")
+
+	io.WriteString(out, "%chardef begin\n")
+	for _, entry := range table.Entries {
+		fmt.Fprintf(out, "%s %s\n", entry.Key(), entry.Text)
+	}
+	io.WriteString(out, "%chardef end\n")
+	return out.Flush()
+}
+
+// WriteIbusTable writes table as an ibus-table source, to be compiled
+// with ibus-table-createdb
+func WriteIbusTable(w io.Writer, table *DictionaryTable) error {
+	var selectKeys []string
+	for _, r := range defaultSelectionKeys {
+		selectKeys = append(selectKeys, ibusKeyNames[r])
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "### Generated by rational-ime")
+	fmt.Fprintf(out, "SERIAL_NUMBER = %s\n", table.Version.Format("20060102"))
+	fmt.Fprintf(out, "NAME = %s\n", table.Name)
+	fmt.Fprintln(out, "NAME.zh_TW = 注音")
+	fmt.Fprintln(out, "LANGUAGES = zh_TW")
+	fmt.Fprintln(out, "STATUS_PROMPT = 注")
+	fmt.Fprintf(out, "VALID_INPUT_CHARS = %s\n", table.KeyChars())
+	fmt.Fprintln(out, "LAYOUT = us")
+	fmt.Fprintf(out, "MAX_KEY_LENGTH = %d\n", table.MaxKeyLength())
+	fmt.Fprintf(out, "SELECT_KEYS = %s\n", strings.Join(selectKeys, ","))
+	fmt.Fprintln(out, "AUTO_COMMIT = FALSE")
+	fmt.Fprintln(out, "DYNAMIC_ADJUST = TRUE")
+	fmt.Fprintln(out, "BEGIN_DEFINITION")
+	fmt.Fprintln(out, "END_DEFINITION")
+	fmt.Fprintln(out, "BEGIN_TABLE")
+	for _, entry := range table.Entries {
+		fmt.Fprintf(out, "%s\t%s\t%d\n", entry.Key(), entry.Text, entry.Freq)
+	}
+	fmt.Fprintln(out, "END_TABLE")
+	return out.Flush()
+}
+
+// WriteFcitxTable writes table as a fcitx table source, to be compiled
+// with libime_tabledict. The format has no weights, so candidates are
+// listed most frequent first
+func WriteFcitxTable(w io.Writer, table *DictionaryTable) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "KeyCode=%s\n", table.KeyChars())
+	fmt.Fprintf(out, "Length=%d\n", table.MaxKeyLength())
+	fmt.Fprintln(out, "[Data]")
+	for _, entry := range table.Entries {
+		fmt.Fprintf(out, "%s %s\n", entry.Key(), entry.Text)
+	}
+	return out.Flush()
+}
+
+// WriteRimeDict writes table as a Rime dict.yaml, with syllables separated
+// by spaces and frequencies as weights
+func WriteRimeDict(w io.Writer, table *DictionaryTable) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "# Rime dictionary")
+	fmt.Fprintln(out, "# encoding: utf-8")
+	fmt.Fprintln(out, "# Generated by rational-ime")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "---")
+	fmt.Fprintf(out, "name: %s\n", table.Name)
+	fmt.Fprintf(out, "version: \"%s\"\n", table.Version.Format("2006.01.02"))
+	fmt.Fprintln(out, "sort: by_weight")
+	fmt.Fprintln(out, "use_preset_vocabulary: false")
+	fmt.Fprintln(out, "...")
+	fmt.Fprintln(out)
+	for _, entry := range table.Entries {
+		fmt.Fprintf(out, "%s\t%s\t%d\n", entry.Text, strings.Join(entry.Syllables, " "), entry.Freq)
+	}
+	return out.Flush()
+}
+
+// RunExportDict is the exportdict command: it writes the dictionary as an
+// input method table
+func RunExportDict(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("exportdict", flag.ExitOnError)
+	format := flags.String("format", TABLE_CIN, "Table format: cin, ibus, fcitx or rime")
+	layoutName := flags.String("layout", "standard", "Layout whose keystrokes key the table, empty to key by Zhuyin")
+	name := flags.String("name", "rational_zhuyin", "Name of the table")
+	output := flags.String("o", "", "File to write, empty for standard output")
+	version := flags.String("version", "", "Date versioning the table, as YYYY-MM-DD, empty for the database's modification date")
+	flags.Parse(args)
+
+	var versionDate time.Time
+	if *version != "" {
+		var err error
+		if versionDate, err = time.Parse("2006-01-02", *version); err != nil {
+			return fmt.Errorf("-version: %v", err)
+		}
+	} else {
+		// the date of the data, so that exports of the same database match
+		info, err := os.Stat(ref.dbName)
+		if err != nil {
+			return err
+		}
+		versionDate = info.ModTime().UTC()
+	}
+
+	writer, ok := tableWriters[*format]
+	if !ok {
+		return fmt.Errorf("unknown table format %q", *format)
+	}
+	var layout *Layout
+	if *layoutName != "" {
+		if layout, ok = GetLayout(*layoutName); !ok {
+			return fmt.Errorf("unknown layout %q", *layoutName)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	table := BuildDictionaryTable(ref, *name, layout)
+	table.Version = versionDate
+	return writer(out, table)
+}
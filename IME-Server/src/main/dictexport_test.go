@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDictionaryTableReproducible(t *testing.T) {
+	ref := newTestReference(t)
+	version := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	for format, writer := range tableWriters {
+		var first, second bytes.Buffer
+		for _, out := range []*bytes.Buffer{&first, &second} {
+			table := BuildDictionaryTable(ref, "test", nil)
+			table.Version = version
+			if err := writer(out, table); err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Errorf("%s: two exports of the same table differ", format)
+		}
+	}
+
+	table := BuildDictionaryTable(ref, "test", nil)
+	table.Version = version
+	var ibus, rime bytes.Buffer
+	WriteIbusTable(&ibus, table)
+	WriteRimeDict(&rime, table)
+	if !strings.Contains(ibus.String(), "SERIAL_NUMBER = 20240305\n") {
+		t.Error("ibus table is not numbered by the table's version")
+	}
+	if !strings.Contains(rime.String(), "version: \"2024.03.05\"\n") {
+		t.Error("Rime dictionary is not versioned by the table's version")
+	}
+}
+
+func TestDictionaryTableKeys(t *testing.T) {
+	table := BuildDictionaryTable(newTestReference(t), "test", standardLayout())
+	keys := make(map[string]string)
+	for _, entry := range table.Entries {
+		keys[entry.Text] += entry.Key() + " "
+	}
+	// 我 is ㄨㄛˇ, j i 3; 窩 is first tone, which is not typed
+	for text, want := range map[string]string{"我": "ji3 ", "窩": "ji ", "銀行": "up6c;6 "} {
+		if keys[text] != want {
+			t.Errorf("%s keyed %q, want %q", text, keys[text], want)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// Export formats of keyboard layouts, which are also the extensions of
+// the files written
+const (
+	EXPORT_XKB       = "xkb"
+	EXPORT_KLC       = "klc"
+	EXPORT_KEYLAYOUT = "keylayout"
+)
+
+// exporters write a layout in each export format
+var exporters = map[string]func(io.Writer, *Layout) error{
+	EXPORT_XKB:       ExportXKB,
+	EXPORT_KLC:       ExportKLC,
+	EXPORT_KEYLAYOUT: ExportKeylayout,
+}
+
+// xkbKeys are the XKB key names of the QWERTY keys
+var xkbKeys = map[string]string{}
+
+// klcKeys are the Windows scan codes and virtual keys of the QWERTY keys
+var klcKeys = map[string][2]string{}
+
+// macKeys are the macOS ANSI virtual key codes of the QWERTY keys
+var macKeys = map[string]int{}
+
+func init() {
+	xkbRows := []string{"AE", "AD", "AC", "AB"}
+	klcFirstScanCodes := []int{0x02, 0x10, 0x1e, 0x2c}
+	klcVirtualKeys := map[string]string{
+		"-": "OEM_MINUS", "=": "OEM_PLUS", "[": "OEM_4", "]": "OEM_6", ";": "OEM_1",
+		"'": "OEM_7", ",": "OEM_COMMA", ".": "OEM_PERIOD", "/": "OEM_2",
+	}
+	macCodes := [][]int{
+		{18, 19, 20, 21, 23, 22, 26, 28, 25, 29, 27, 24},
+		{12, 13, 14, 15, 17, 16, 32, 34, 31, 35, 33, 30},
+		{0, 1, 2, 3, 5, 4, 38, 40, 37, 41, 39},
+		{6, 7, 8, 9, 11, 45, 46, 43, 47, 44},
+	}
+	for row, chars := range qwertyRows {
+		for column, r := range chars[0] {
+			key := string(r)
+			xkbKeys[key] = fmt.Sprintf("%s%02d", xkbRows[row], column+1)
+			vk, ok := klcVirtualKeys[key]
+			if !ok {
+				vk = strings.ToUpper(key)
+			}
+			klcKeys[key] = [2]string{fmt.Sprintf("%02x", klcFirstScanCodes[row]+column), vk}
+			macKeys[key] = macCodes[row][column]
+		}
+	}
+}
+
+// exportKey is a key of a layout as typed without and with shift
+type exportKey struct {
+	Key     string
+	Plain   string
+	Shifted string
+}
+
+// exportKeys returns the keys of a layout in row order. Keys without a
+// shifted character type their symbol with shift too
+func exportKeys(layout *Layout) ([]exportKey, error) {
+	var keys []exportKey
+	for _, row := range layout.Rows {
+		for _, key := range row.Keys {
+			if _, ok := xkbKeys[key.Key]; !ok {
+				return nil, fmt.Errorf("layout %s: key %q is not on a QWERTY keyboard", layout.Name, key.Key)
+			}
+			if key.Symbol == "" {
+				continue
+			}
+			shifted := key.Shifted
+			if shifted == "" {
+				shifted = key.Symbol
+			}
+			keys = append(keys, exportKey{key.Key, key.Symbol, shifted})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("layout %s has no keys", layout.Name)
+	}
+	return keys, nil
+}
+
+// singleRune returns the only character of s, failing for text that a
+// single keystroke cannot produce
+func singleRune(layout *Layout, s string) (rune, error) {
+	runes := []rune(s)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("layout %s: %q is not a single character", layout.Name, s)
+	}
+	return runes[0], nil
+}
+
+// ExportXKB writes layout as an XKB symbols file, for installation under
+// /usr/share/X11/xkb/symbols
+func ExportXKB(w io.Writer, layout *Layout) error {
+	keys, err := exportKeys(layout)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "// %s\n", layout.Description)
+	fmt.Fprintln(out, "// Generated by rational-ime, do not edit")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "default partial alphanumeric_keys")
+	fmt.Fprintf(out, "xkb_symbols %q {\n", layout.Name)
+	fmt.Fprintf(out, "    name[Group1] = %q;\n\n", "Chinese (Zhuyin, "+layout.Name+")")
+	for _, key := range keys {
+		plain, err := singleRune(layout, key.Plain)
+		if err != nil {
+			return err
+		}
+		shifted, err := singleRune(layout, key.Shifted)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "    key <%s> { [ U%04X, U%04X ] }; // %s %s\n",
+			xkbKeys[key.Key], plain, shifted, key.Plain, key.Shifted)
+	}
+	fmt.Fprintln(out, "};")
+	return out.Flush()
+}
+
+// klcName returns the 8 character keyboard name of a layout in a .klc file
+func klcName(layout *Layout) string {
+	name := "ZY"
+	for _, r := range strings.ToUpper(layout.Name) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			name += string(r)
+		}
+	}
+	if len(name) > 8 {
+		name = name[:8]
+	}
+	return name
+}
+
+// ExportKLC writes layout as a Microsoft Keyboard Layout Creator source
+// file, which is UTF-16 as MSKLC expects
+func ExportKLC(w io.Writer, layout *Layout) error {
+	keys, err := exportKeys(layout)
+	if err != nil {
+		return err
+	}
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "KBD\t%s\t%q\r\n\r\n", klcName(layout), layout.Description)
+	fmt.Fprintf(&text, "COPYRIGHT\t%q\r\n\r\n", "rational-ime")
+	fmt.Fprintf(&text, "COMPANY\t%q\r\n\r\n", "rational-ime")
+	fmt.Fprint(&text, "LOCALENAME\t\"zh-TW\"\r\n\r\n")
+	fmt.Fprint(&text, "LOCALEID\t\"00000404\"\r\n\r\n")
+	fmt.Fprint(&text, "VERSION\t1.0\r\n\r\n")
+	fmt.Fprint(&text, "SHIFTSTATE\r\n\r\n0\t//Column 4\r\n1\t//Column 5 : Shft\r\n\r\n")
+	fmt.Fprint(&text, "LAYOUT\t\t;an extra '@' at the end is a dead key\r\n\r\n")
+	fmt.Fprint(&text, "//SC\tVK_\t\tCap\t0\t1\r\n//--\t----\t\t----\t----\t----\r\n\r\n")
+	for _, key := range keys {
+		plain, err := singleRune(layout, key.Plain)
+		if err != nil {
+			return err
+		}
+		shifted, err := singleRune(layout, key.Shifted)
+		if err != nil {
+			return err
+		}
+		caps := 0
+		if plain >= 'a' && plain <= 'z' {
+			caps = 1
+		}
+		codes := klcKeys[key.Key]
+		fmt.Fprintf(&text, "%s\t%s\t\t%d\t%04x\t%04x\t\t// %s, %s\r\n",
+			codes[0], codes[1], caps, plain, shifted, key.Plain, key.Shifted)
+	}
+	fmt.Fprint(&text, "39\tSPACE\t\t0\t0020\t0020\t\t// Space\r\n")
+	fmt.Fprint(&text, "53\tDECIMAL\t\t0\t002e\t002e\t\t// FULL STOP\r\n\r\n")
+	fmt.Fprintf(&text, "DESCRIPTIONS\r\n\r\n0409\t%s\r\n\r\n", layout.Description)
+	fmt.Fprint(&text, "LANGUAGENAMES\r\n\r\n0409\tChinese (Traditional, Taiwan)\r\n\r\n")
+	fmt.Fprint(&text, "ENDKBD\r\n")
+
+	units := utf16.Encode([]rune("\uFEFF" + text.String()))
+	encoded := make([]byte, 0, 2*len(units))
+	for _, unit := range units {
+		encoded = append(encoded, byte(unit), byte(unit>>8))
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+// macControlKeys are the keys every macOS keyboard layout must type
+// besides the character keys, with their outputs
+var macControlKeys = []struct {
+	code   int
+	output string
+}{
+	{36, "&#x000D;"}, {48, "&#x0009;"}, {49, " "}, {51, "&#x0008;"}, {53, "&#x001B;"},
+	{76, "&#x0003;"}, {117, "&#x007F;"}, {123, "&#x001C;"}, {124, "&#x001D;"},
+	{125, "&#x001F;"}, {126, "&#x001E;"},
+}
+
+// xmlAttribute escapes s for use in an XML attribute value
+func xmlAttribute(s string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// ExportKeylayout writes layout as a macOS .keylayout file, for
+// installation under ~/Library/Keyboard Layouts
+func ExportKeylayout(w io.Writer, layout *Layout) error {
+	keys, err := exportKeys(layout)
+	if err != nil {
+		return err
+	}
+	// layouts in the Unicode group have a negative id, unique per name
+	id := -int(crc32.ChecksumIEEE([]byte(layout.Name))%30000) - 2000
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, `<?xml version="1.1" encoding="UTF-8"?>`)
+	fmt.Fprintln(out, `<!DOCTYPE keyboard SYSTEM "file://localhost/System/Library/DTDs/KeyboardLayout.dtd">`)
+	fmt.Fprintf(out, "<!-- %s. Generated by rational-ime, do not edit -->\n", xmlAttribute(layout.Description))
+	fmt.Fprintf(out, "<keyboard group=\"126\" id=\"%d\" name=\"%s\" maxout=\"1\">\n",
+		id, xmlAttribute("Zhuyin "+layout.Name))
+	fmt.Fprintln(out, `  <layouts>`)
+	fmt.Fprintln(out, `    <layout first="0" last="17" modifiers="Modifiers" mapSet="ANSI"/>`)
+	fmt.Fprintln(out, `  </layouts>`)
+	fmt.Fprintln(out, `  <modifierMap id="Modifiers" defaultIndex="0">`)
+	fmt.Fprintln(out, `    <keyMapSelect mapIndex="0">`)
+	fmt.Fprintln(out, `      <modifier keys=""/>`)
+	fmt.Fprintln(out, `      <modifier keys="caps"/>`)
+	fmt.Fprintln(out, `    </keyMapSelect>`)
+	fmt.Fprintln(out, `    <keyMapSelect mapIndex="1">`)
+	fmt.Fprintln(out, `      <modifier keys="anyShift caps?"/>`)
+	fmt.Fprintln(out, `    </keyMapSelect>`)
+	fmt.Fprintln(out, `  </modifierMap>`)
+	fmt.Fprintln(out, `  <keyMapSet id="ANSI">`)
+	for index := 0; index < 2; index++ {
+		fmt.Fprintf(out, "    <keyMap index=\"%d\">\n", index)
+		for _, key := range keys {
+			output := key.Plain
+			if index == 1 {
+				output = key.Shifted
+			}
+			fmt.Fprintf(out, "      <key code=\"%d\" output=\"%s\"/>\n", macKeys[key.Key], xmlAttribute(output))
+		}
+		for _, key := range macControlKeys {
+			fmt.Fprintf(out, "      <key code=\"%d\" output=\"%s\"/>\n", key.code, key.output)
+		}
+		fmt.Fprintln(out, `    </keyMap>`)
+	}
+	fmt.Fprintln(out, `  </keyMapSet>`)
+	fmt.Fprintln(out, `</keyboard>`)
+	return out.Flush()
+}
+
+// ExportLayout returns layout in the given export format
+func ExportLayout(layout *Layout, format string) ([]byte, error) {
+	exporter, ok := exporters[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	var out bytes.Buffer
+	err := exporter(&out, layout)
+	return out.Bytes(), err
+}
+
+// CheckGolden regenerates every <layout>.<format> file in dir and compares
+// it with the file, returning the names of the files that differ. With
+// update set the files are rewritten instead
+func CheckGolden(dir string, update bool) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.*"))
+	if err != nil {
+		return nil, err
+	}
+	var mismatched []string
+	for _, path := range paths {
+		base := filepath.Base(path)
+		format := strings.TrimPrefix(filepath.Ext(base), ".")
+		if _, ok := exporters[format]; !ok {
+			continue
+		}
+		name := strings.TrimSuffix(base, "."+format)
+		layout, ok := GetLayout(name)
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown layout %q", path, name)
+		}
+		generated, err := ExportLayout(layout, format)
+		if err != nil {
+			return nil, err
+		}
+		if update {
+			if err = ioutil.WriteFile(path, generated, 0644); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		golden, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(golden, generated) {
+			mismatched = append(mismatched, path)
+		}
+	}
+	return mismatched, nil
+}
+
+// RunExport is the export command: it writes a layout in an installable
+// format, or checks the exporters against golden files
+func RunExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	name := flags.String("layout", "standard", "Layout to export")
+	format := flags.String("format", EXPORT_XKB, "Export format: xkb, klc or keylayout")
+	output := flags.String("o", "", "File to write, empty for standard output")
+	check := flags.String("check", "", "Compare the exports of layouts with the golden files in this directory")
+	update := flags.Bool("update", false, "With -check, rewrite the golden files")
+	flags.Parse(args)
+
+	if *check != "" {
+		mismatched, err := CheckGolden(*check, *update)
+		if err != nil {
+			return err
+		}
+		for _, path := range mismatched {
+			logger.Error("export differs from golden file", "path", path)
+		}
+		if len(mismatched) > 0 {
+			return errors.New("exports do not match the golden files")
+		}
+		return nil
+	}
+
+	layout, ok := GetLayout(*name)
+	if !ok {
+		return fmt.Errorf("unknown layout %q", *name)
+	}
+	exported, err := ExportLayout(layout, *format)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(exported)
+		return err
+	}
+	return ioutil.WriteFile(*output, exported, 0644)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// updateGolden rewrites the golden files instead of comparing with them:
+// go test -run Golden -update
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the layout exports")
+
+// goldenDir holds the expected export of every built-in layout in every
+// format, as <layout>.<format>
+const goldenDir = "golden"
+
+func TestExportGolden(t *testing.T) {
+	for _, name := range LayoutNames() {
+		for format := range exporters {
+			path := filepath.Join(goldenDir, name+"."+format)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				if !*updateGolden {
+					t.Errorf("%s is missing, run go test -run Golden -update", path)
+					continue
+				}
+				// CheckGolden only rewrites the files that exist
+				if err = ioutil.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	mismatched, err := CheckGolden(goldenDir, *updateGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range mismatched {
+		t.Errorf("%s differs from the export, run go test -run Golden -update if the change is intended", path)
+	}
+}
+
+// keylayoutFile is the part of a macOS .keylayout file that maps keys
+type keylayoutFile struct {
+	Group   int    `xml:"group,attr"`
+	Id      int    `xml:"id,attr"`
+	Name    string `xml:"name,attr"`
+	KeyMaps []struct {
+		Index int `xml:"index,attr"`
+		Keys  []struct {
+			Code   int    `xml:"code,attr"`
+			Output string `xml:"output,attr"`
+		} `xml:"key"`
+	} `xml:"keyMapSet>keyMap"`
+}
+
+// controlReference matches a character reference to a control character
+var controlReference = regexp.MustCompile(`&#x(00[01][0-9A-F]|007F);`)
+
+func TestExportKeylayout(t *testing.T) {
+	layout := standardLayout()
+	keys, _ := exportKeys(layout)
+	data, err := ExportLayout(layout, EXPORT_KEYLAYOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// macOS wants XML 1.1 for the references to control characters, which
+	// encoding/xml refuses to read: both are rewritten as XML 1.0
+	data = bytes.Replace(data, []byte(`<?xml version="1.1"`), []byte(`<?xml version="1.0"`), 1)
+	data = controlReference.ReplaceAll(data, []byte("U+$1"))
+	var file keylayoutFile
+	if err = xml.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Group != 126 || file.Id >= 0 || file.Name != "Zhuyin standard" || len(file.KeyMaps) != 2 {
+		t.Fatalf("keylayout = group %d, id %d, name %q with %d key maps", file.Group, file.Id, file.Name, len(file.KeyMaps))
+	}
+	for index, keyMap := range file.KeyMaps {
+		if keyMap.Index != index || len(keyMap.Keys) != len(keys)+len(macControlKeys) {
+			t.Errorf("key map %d has index %d and %d keys", index, keyMap.Index, len(keyMap.Keys))
+		}
+		outputs := make(map[int]string)
+		for _, key := range keyMap.Keys {
+			if _, ok := outputs[key.Code]; ok {
+				t.Errorf("key map %d maps code %d twice", index, key.Code)
+			}
+			outputs[key.Code] = key.Output
+		}
+		for _, key := range keys {
+			want := key.Plain
+			if index == 1 {
+				want = key.Shifted
+			}
+			if got := outputs[macKeys[key.Key]]; got != want {
+				t.Errorf("key map %d types %q with %s, want %q", index, got, key.Key, want)
+			}
+		}
+		if got := outputs[51]; got != "U+0008" {
+			t.Errorf("key map %d types %q with delete", index, got)
+		}
+	}
+}
+
+func TestExportKLC(t *testing.T) {
+	layout := standardLayout()
+	keys, _ := exportKeys(layout)
+	data, err := ExportLayout(layout, EXPORT_KLC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%2 != 0 || data[0] != 0xff || data[1] != 0xfe {
+		t.Fatalf("klc is not UTF-16LE with a byte order mark")
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+	}
+	lines := strings.Split(string(utf16.Decode(units[1:])), "\r\n")
+	if !strings.HasPrefix(lines[0], "KBD\tZYSTANDA\t") || lines[len(lines)-2] != "ENDKBD" {
+		t.Errorf("klc runs from %q to %q", lines[0], lines[len(lines)-2])
+	}
+
+	// the LAYOUT section has a line per key, and space and decimal
+	scanCodes := make(map[string]string)
+	section := ""
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if len(fields) > 0 && strings.ToUpper(fields[0]) == fields[0] && !strings.ContainsAny(fields[0], "0123456789") {
+			section = fields[0]
+			continue
+		}
+		if section != "LAYOUT" {
+			continue
+		}
+		if len(fields) < 6 {
+			t.Errorf("layout line %q has %d fields", line, len(fields))
+			continue
+		}
+		scanCodes[fields[0]] = fields[4] + " " + fields[5]
+	}
+	if len(scanCodes) != len(keys)+2 {
+		t.Errorf("klc layout has %d scan codes, want %d", len(scanCodes), len(keys)+2)
+	}
+	for _, key := range keys {
+		plain, shifted := []rune(key.Plain)[0], []rune(key.Shifted)[0]
+		want := fmt.Sprintf("%04x %04x", plain, shifted)
+		if got := scanCodes[klcKeys[key.Key][0]]; got != want {
+			t.Errorf("klc types %q with %s, want %q", got, key.Key, want)
+		}
+	}
+}
+
+// xkbKeyLine matches a key of an XKB symbols block with its two levels
+var xkbKeyLine = regexp.MustCompile(`(?m)^    key <(\w+)> \{ \[ (U[0-9A-F]{4}), (U[0-9A-F]{4}) \] \};`)
+
+func TestExportXKB(t *testing.T) {
+	layout := standardLayout()
+	keys, _ := exportKeys(layout)
+	data, err := ExportLayout(layout, EXPORT_XKB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	start := strings.Index(text, `xkb_symbols "standard" {`)
+	if start < 0 || !strings.HasSuffix(text, "\n};\n") || strings.Count(text, "{") != strings.Count(text, "}") {
+		t.Fatalf("xkb is not a single symbols block:\n%s", text)
+	}
+	symbols := make(map[string]string)
+	for _, match := range xkbKeyLine.FindAllStringSubmatch(text[start:], -1) {
+		symbols[match[1]] = match[2] + " " + match[3]
+	}
+	if len(symbols) != len(keys) {
+		t.Errorf("xkb has %d keys, want %d", len(symbols), len(keys))
+	}
+	for _, key := range keys {
+		want := fmt.Sprintf("U%04X U%04X", []rune(key.Plain)[0], []rune(key.Shifted)[0])
+		if got := symbols[xkbKeys[key.Key]]; got != want {
+			t.Errorf("xkb types %q with %s, want %q", got, key.Key, want)
+		}
+	}
+}
+
+func TestCheckGolden(t *testing.T) {
+	// a changed golden file is reported
+	dir := t.TempDir()
+	data, err := ioutil.ReadFile(filepath.Join(goldenDir, "standard.xkb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "standard.xkb")
+	if err = ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if mismatched, err := CheckGolden(dir, false); err != nil || len(mismatched) != 1 || mismatched[0] != path {
+		t.Errorf("CheckGolden on a changed file = %v, %v, want %s", mismatched, err, path)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// unknownRegion stands in for documents collected without a region
+const unknownRegion = "unknown"
+
+// defaultEraWeights is the split between modern vernacular and Literary
+// Chinese called for by the sampling design
+const defaultEraWeights = "modern=0.7,classical=0.3"
+
+// Stratum is a group of corpus documents sharing a region and era
+type Stratum struct {
+	Region string
+	Era    string
+}
+
+// StratumInfo describes how much of the corpus a stratum provided and how
+// much it counts for once weighted
+type StratumInfo struct {
+	Region    string
+	Era       string
+	Documents int
+	Chars     int
+	Raw       float64
+	Weight    float64
+}
+
+// SymbolFrequency is a single bar of the histograms: the raw count of a
+// Zhuyin symbol and its share of all symbols before and after weighting
+type SymbolFrequency struct {
+	Symbol   string
+	Count    int
+	Raw      float64
+	Weighted float64
+}
+
+// FrequencyReport is the result of the frequency analysis
+type FrequencyReport struct {
+	Strata  []StratumInfo
+	Symbols []SymbolFrequency
+}
+
+// FrequencyAnalysis bins the Zhuyin symbols of a corpus per stratum
+type FrequencyAnalysis struct {
+	annotator *Annotator
+	documents map[Stratum]int
+	chars     map[Stratum]int
+	counts    map[Stratum]map[string]int
+	unknown   int
+}
+
+// NewFrequencyAnalysis returns an empty analysis reading from ref
+func NewFrequencyAnalysis(ref *ReferenceStore) *FrequencyAnalysis {
+	return &FrequencyAnalysis{
+		annotator: NewAnnotator(ref),
+		documents: make(map[Stratum]int),
+		chars:     make(map[Stratum]int),
+		counts:    make(map[Stratum]map[string]int),
+	}
+}
+
+// toneSymbol returns the tone mark of a tone number, including the usually
+// unwritten first tone mark
+func toneSymbol(tone int) string {
+	for mark, n := range toneMarks {
+		if n == tone {
+			return mark
+		}
+	}
+	return ""
+}
+
+// Add bins the symbols of every character of a document
+func (fa *FrequencyAnalysis) Add(doc *CorpusDocument) {
+	stratum := Stratum{doc.Region, doc.Era}
+	if stratum.Region == "" {
+		stratum.Region = unknownRegion
+	}
+	counts, ok := fa.counts[stratum]
+	if !ok {
+		counts = make(map[string]int)
+		fa.counts[stratum] = counts
+	}
+	fa.documents[stratum]++
+
+	for _, paragraph := range doc.Paragraphs {
+		for _, a := range fa.annotator.Annotate(paragraph) {
+			if a.Zhuyin == "" {
+				cjk, _ := cjkCount(a.Text)
+				fa.unknown += cjk
+				continue
+			}
+			fa.chars[stratum]++
+			for _, symbol := range annotationSymbols(a) {
+				counts[symbol]++
+			}
+		}
+	}
+}
+
+// ParseWeights parses a comma separated list of name=weight pairs
+func ParseWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("weight %q is not name=weight", pair)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("weight %q is not a non-negative number", pair)
+		}
+		weights[strings.TrimSpace(fields[0])] = weight
+	}
+	return weights, nil
+}
+
+// shares returns the share of the weighted histogram given to each stratum.
+// Regions get their weight (equal when regionWeights is empty) and split it
+// between the eras they have text for, by era weight. Strata whose region or
+// era has no weight are left out
+func (fa *FrequencyAnalysis) shares(regionWeights, eraWeights map[string]float64) map[Stratum]float64 {
+	eraTotals := make(map[string]float64)
+	for stratum := range fa.counts {
+		if fa.chars[stratum] > 0 {
+			eraTotals[stratum.Region] += eraWeights[stratum.Era]
+		}
+	}
+
+	regionTotal := 0.0
+	regions := make(map[string]float64)
+	for region, eraTotal := range eraTotals {
+		if eraTotal == 0 {
+			continue
+		}
+		weight := 1.0
+		if len(regionWeights) > 0 {
+			weight = regionWeights[region]
+		}
+		regions[region] = weight
+		regionTotal += weight
+	}
+
+	shares := make(map[Stratum]float64)
+	if regionTotal == 0 {
+		return shares
+	}
+	for stratum := range fa.counts {
+		if fa.chars[stratum] == 0 || regions[stratum.Region] == 0 {
+			continue
+		}
+		shares[stratum] = regions[stratum.Region] / regionTotal *
+			eraWeights[stratum.Era] / eraTotals[stratum.Region]
+	}
+	return shares
+}
+
+// Report returns the raw and weighted histograms, most frequent weighted
+// symbol first, together with a description of every stratum
+func (fa *FrequencyAnalysis) Report(regionWeights, eraWeights map[string]float64) *FrequencyReport {
+	shares := fa.shares(regionWeights, eraWeights)
+	report := &FrequencyReport{}
+
+	totalChars := 0
+	for _, chars := range fa.chars {
+		totalChars += chars
+	}
+
+	raw := make(map[string]int)
+	weighted := make(map[string]float64)
+	totalSymbols := 0
+	for stratum, counts := range fa.counts {
+		stratumSymbols := 0
+		for _, count := range counts {
+			stratumSymbols += count
+		}
+		for symbol, count := range counts {
+			raw[symbol] += count
+			if shares[stratum] > 0 {
+				weighted[symbol] += shares[stratum] * float64(count) / float64(stratumSymbols)
+			}
+		}
+		totalSymbols += stratumSymbols
+
+		info := StratumInfo{stratum.Region, stratum.Era, fa.documents[stratum], fa.chars[stratum], 0, shares[stratum]}
+		if totalChars > 0 {
+			info.Raw = float64(fa.chars[stratum]) / float64(totalChars)
+		}
+		report.Strata = append(report.Strata, info)
+	}
+
+	for symbol, count := range raw {
+		report.Symbols = append(report.Symbols, SymbolFrequency{
+			symbol, count, float64(count) / float64(totalSymbols), weighted[symbol],
+		})
+	}
+
+	sort.Slice(report.Strata, func(i, j int) bool {
+		a, b := report.Strata[i], report.Strata[j]
+		if a.Region != b.Region {
+			return a.Region < b.Region
+		}
+		return a.Era < b.Era
+	})
+	sort.Slice(report.Symbols, func(i, j int) bool {
+		a, b := report.Symbols[i], report.Symbols[j]
+		if a.Weighted != b.Weighted {
+			return a.Weighted > b.Weighted
+		}
+		if a.Raw != b.Raw {
+			return a.Raw > b.Raw
+		}
+		return a.Symbol < b.Symbol
+	})
+	return report
+}
+
+// histogramBar draws a share as a bar of up to width blocks, scaled to max
+func histogramBar(share, max float64, width int) string {
+	if max <= 0 {
+		return ""
+	}
+	return strings.Repeat("█", int(share/max*float64(width)+0.5))
+}
+
+// WriteText writes the report as tables with raw and weighted histograms
+func (report *FrequencyReport) WriteText(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "REGION\tERA\tDOCS\tCHARS\tRAW\tWEIGHTED")
+	for _, s := range report.Strata {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%.1f%%\t%.1f%%\n",
+			s.Region, s.Era, s.Documents, s.Chars, s.Raw*100, s.Weight*100)
+	}
+	fmt.Fprintln(table)
+
+	maxRaw, maxWeighted := 0.0, 0.0
+	for _, s := range report.Symbols {
+		if s.Raw > maxRaw {
+			maxRaw = s.Raw
+		}
+		if s.Weighted > maxWeighted {
+			maxWeighted = s.Weighted
+		}
+	}
+	fmt.Fprintln(table, "SYMBOL\tCOUNT\tRAW\t\tWEIGHTED\t")
+	for _, s := range report.Symbols {
+		fmt.Fprintf(table, "%s\t%d\t%.2f%%\t%s\t%.2f%%\t%s\n", s.Symbol, s.Count,
+			s.Raw*100, histogramBar(s.Raw, maxRaw, 30),
+			s.Weighted*100, histogramBar(s.Weighted, maxWeighted, 30))
+	}
+	return table.Flush()
+}
+
+// RunFrequency is the frequency command: it bins the Zhuyin symbols of the
+// named corpus files, or standard input, and writes the histograms to
+// standard output
+func RunFrequency(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("frequency", flag.ExitOnError)
+	regionsFlag := flags.String("regions", "", "Region weights as region=weight,..., empty for equal weights")
+	erasFlag := flags.String("eras", defaultEraWeights, "Era weights as era=weight,...")
+	format := flags.String("format", FORMAT_TEXT, "Output format: text or json")
+	flags.Parse(args)
+
+	regionWeights, err := ParseWeights(*regionsFlag)
+	if err != nil {
+		return err
+	}
+	eraWeights, err := ParseWeights(*erasFlag)
+	if err != nil {
+		return err
+	}
+	if *format != FORMAT_TEXT && *format != FORMAT_JSON {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	analysis := NewFrequencyAnalysis(ref)
+	var inputs []io.Reader
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		inputs = append(inputs, file)
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, os.Stdin)
+	}
+	for _, in := range inputs {
+		err := ReadCorpus(in, func(doc *CorpusDocument) error {
+			analysis.Add(doc)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if analysis.unknown > 0 {
+		logger.Warn("characters without a reading were skipped", "count", analysis.unknown)
+	}
+
+	report := analysis.Report(regionWeights, eraWeights)
+	for _, s := range report.Strata {
+		if s.Weight == 0 {
+			logger.Warn("stratum has no weight and is left out of the weighted histogram",
+				"region", s.Region, "era", s.Era)
+		}
+	}
+	if *format == FORMAT_JSON {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+	return report.WriteText(os.Stdout)
+}
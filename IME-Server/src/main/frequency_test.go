@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseWeights(t *testing.T) {
+	got, err := ParseWeights(" tw=2, cn = 0.5,hk=0,")
+	want := map[string]float64{"tw": 2, "cn": 0.5, "hk": 0}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseWeights = %v, %v, want %v", got, err, want)
+	}
+	for _, bad := range []string{"tw", "tw=-1", "tw=many"} {
+		if _, err := ParseWeights(bad); err == nil {
+			t.Errorf("ParseWeights(%q) accepted", bad)
+		}
+	}
+}
+
+// testCorpus has two eras from Taiwan, one from China and a document without
+// a region from an era that has no weight, whose 你 has no reading
+var testCorpus = []*CorpusDocument{
+	{"a", "tw", "modern", "", 2, []string{"我", "我"}},
+	{"b", "tw", "classical", "", 1, []string{"走"}},
+	{"c", "cn", "modern", "", 1, []string{"們"}},
+	{"d", "", "medieval", "", 2, []string{"我你"}},
+}
+
+// near reports whether two shares are equal up to rounding
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func testAnalysis(t *testing.T) *FrequencyAnalysis {
+	t.Helper()
+	fa := NewFrequencyAnalysis(newTestReference(t))
+	for _, doc := range testCorpus {
+		fa.Add(doc)
+	}
+	if fa.unknown != 1 {
+		t.Errorf("%d characters without a reading, want 1", fa.unknown)
+	}
+	return fa
+}
+
+func TestFrequencyShares(t *testing.T) {
+	fa := testAnalysis(t)
+	eras := map[string]float64{"modern": 0.7, "classical": 0.3}
+	tests := []struct {
+		regions map[string]float64
+		want    map[Stratum]float64
+	}{
+		// equal regions, Taiwan splitting its half between its eras and
+		// China keeping its half for the only era it has
+		{nil, map[Stratum]float64{
+			{"tw", "modern"}: 0.35, {"tw", "classical"}: 0.15, {"cn", "modern"}: 0.5,
+		}},
+		{map[string]float64{"tw": 3, "cn": 1}, map[Stratum]float64{
+			{"tw", "modern"}: 0.525, {"tw", "classical"}: 0.225, {"cn", "modern"}: 0.25,
+		}},
+		// a region without a weight is left out
+		{map[string]float64{"tw": 1}, map[Stratum]float64{
+			{"tw", "modern"}: 0.7, {"tw", "classical"}: 0.3,
+		}},
+	}
+	for _, test := range tests {
+		got := fa.shares(test.regions, eras)
+		ok := len(got) == len(test.want)
+		for stratum, share := range test.want {
+			ok = ok && near(got[stratum], share)
+		}
+		if !ok {
+			t.Errorf("shares(%v) = %v, want %v", test.regions, got, test.want)
+		}
+	}
+}
+
+func TestFrequencyReport(t *testing.T) {
+	report := testAnalysis(t).Report(map[string]float64{"tw": 3, "cn": 1},
+		map[string]float64{"modern": 0.7, "classical": 0.3})
+
+	strata := []StratumInfo{
+		{"cn", "modern", 1, 1, 0.2, 0.25},
+		{"tw", "classical", 1, 1, 0.2, 0.225},
+		{"tw", "modern", 1, 2, 0.4, 0.525},
+		{unknownRegion, "medieval", 1, 1, 0.2, 0},
+	}
+	if len(report.Strata) != len(strata) {
+		t.Fatalf("strata = %v, want %v", report.Strata, strata)
+	}
+	for i, s := range report.Strata {
+		want := strata[i]
+		if s.Region != want.Region || s.Era != want.Era || s.Documents != want.Documents ||
+			s.Chars != want.Chars || !near(s.Raw, want.Raw) || !near(s.Weight, want.Weight) {
+			t.Errorf("stratum %d = %+v, want %+v", i, s, want)
+		}
+	}
+
+	// 我 is a third of the symbols of Taiwan's modern text and 走 of its
+	// classical text, while the medieval 我 only counts before weighting
+	want := map[string]SymbolFrequency{
+		"ˇ": {"ˇ", 4, 4.0 / 15, 0.525/3 + 0.225/3},
+		"ㄨ": {"ㄨ", 3, 3.0 / 15, 0.525 / 3},
+		"ㄗ": {"ㄗ", 1, 1.0 / 15, 0.225 / 3},
+		"ㄇ": {"ㄇ", 1, 1.0 / 15, 0.25 / 3},
+	}
+	if len(report.Symbols) != 8 || report.Symbols[0].Symbol != "ˇ" {
+		t.Errorf("symbols = %v, want 8 with ˇ first", report.Symbols)
+	}
+	total := 0.0
+	for _, s := range report.Symbols {
+		total += s.Weighted
+		if w, ok := want[s.Symbol]; ok && (s.Count != w.Count || !near(s.Raw, w.Raw) || !near(s.Weighted, w.Weighted)) {
+			t.Errorf("symbol %s = %+v, want %+v", s.Symbol, s, w)
+		}
+	}
+	if !near(total, 1) {
+		t.Errorf("weighted shares add up to %v", total)
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Conflict policies of imports: what to do with the frequency of an entry
+// already in the dictionary
+const (
+	POLICY_KEEP    = "keep"
+	POLICY_REPLACE = "replace"
+	POLICY_SUM     = "sum"
+)
+
+// tableParsers read the entries of an imported table in each format
+var tableParsers = map[string]func(io.Reader) ([]ImportEntry, int, error){
+	TABLE_CIN:  ParseCin,
+	TABLE_RIME: ParseRime,
+}
+
+// ImportReading is the reading of one character of an imported entry. The
+// tone is -1 when the source does not give it
+type ImportReading struct {
+	Zhuyin string
+	Pinyin string
+	Tone   int
+}
+
+// ImportEntry is a character or phrase read from an imported table, with
+// the reading of each of its characters. Ranked marks a Freq that only
+// ranks the entry among those of its key, for tables without frequencies:
+// it is given to new rows but never replaces a stored frequency
+type ImportEntry struct {
+	Text     string
+	Readings []ImportReading
+	Freq     int
+	Ranked   bool
+}
+
+// ImportRequest is an object that asks the DB thread to merge entries into
+// the dictionary, or with DryRun set to report what merging would change
+type ImportRequest struct {
+	Entries   []ImportEntry
+	Policy    string
+	DryRun    bool
+	WriteBack chan *ImportResult
+}
+
+// ImportResult counts the rows an import added, updated or left alone and
+// lists every change, as a diff. Err is set when the import failed and was
+// rolled back
+type ImportResult struct {
+	Added   int
+	Updated int
+	Kept    int
+	Skipped int
+	Changes []string
+	Err     error `json:"-"`
+}
+
+// Zhuyin symbol classes, in the order they appear in a syllable
+const (
+	zhuyinInitial = iota + 1
+	zhuyinMedial
+	zhuyinFinal
+	zhuyinTone
+)
+
+// zhuyinClass returns the class of a Zhuyin symbol or tone mark, or 0
+func zhuyinClass(symbol string) int {
+	if isTone(symbol) && !strings.ContainsAny(symbol, "12345") {
+		return zhuyinTone
+	}
+	if !isZhuyin(symbol) {
+		return 0
+	}
+	r := []rune(symbol)[0]
+	switch {
+	case r <= 'ㄙ':
+		return zhuyinInitial
+	case r >= 'ㄧ' && r <= 'ㄩ':
+		return zhuyinMedial
+	}
+	return zhuyinFinal
+}
+
+// SegmentZhuyin splits a run of Zhuyin symbols and tone marks into
+// syllables. A syllable ends at its tone mark, or with the first tone when
+// the next symbol cannot continue it
+func SegmentZhuyin(symbols []string) ([]ImportReading, bool) {
+	var readings []ImportReading
+	current, stage := "", 0
+	for _, symbol := range symbols {
+		class := zhuyinClass(symbol)
+		switch {
+		case class == 0:
+			return nil, false
+		case class == zhuyinTone:
+			if current == "" {
+				return nil, false
+			}
+			readings = append(readings, ImportReading{current, "", toneMarks[symbol]})
+			current, stage = "", 0
+			continue
+		case class <= stage:
+			readings = append(readings, ImportReading{current, "", 1})
+			current, stage = "", 0
+		}
+		current += symbol
+		stage = class
+	}
+	if current != "" {
+		readings = append(readings, ImportReading{current, "", 1})
+	}
+	for i := range readings {
+		readings[i].Pinyin, _ = ZhuyinToPinyin(readings[i].Zhuyin)
+	}
+	return readings, len(readings) > 0
+}
+
+// parseSyllable reads a single syllable given in Zhuyin or Pinyin
+func parseSyllable(syllable string) (ImportReading, bool) {
+	var symbols []string
+	for _, r := range syllable {
+		symbols = append(symbols, string(r))
+	}
+	// the neutral tone mark may be written before the syllable
+	if len(symbols) > 1 && symbols[0] == "˙" {
+		symbols = append(symbols[1:], symbols[0])
+	}
+	if len(symbols) > 0 && zhuyinClass(symbols[0]) != 0 {
+		readings, ok := SegmentZhuyin(symbols)
+		if !ok || len(readings) != 1 {
+			return ImportReading{}, false
+		}
+		return readings[0], true
+	}
+	zhuyin, tone, ok := PinyinToZhuyin(syllable)
+	if !ok {
+		return ImportReading{}, false
+	}
+	pinyin, _ := ZhuyinToPinyin(zhuyin)
+	return ImportReading{zhuyin, pinyin, tone}, true
+}
+
+// ParseCin reads the entries of a .cin table, mapping its keys to Zhuyin
+// through the %keyname section. The format has no weights, so entries of
+// the same key are ranked following their order. It returns the number of
+// entries that could not be read as Zhuyin
+func ParseCin(r io.Reader) ([]ImportEntry, int, error) {
+	keyNames := make(map[rune]string)
+	section := ""
+	var entries []ImportEntry
+	rank := make(map[string]int)
+	keys := []string{}
+	skipped := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "%") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && (fields[1] == "begin" || fields[1] == "end") {
+				section = ""
+				if fields[1] == "begin" {
+					section = fields[0]
+				}
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch section {
+		case "%keyname":
+			keyNames[[]rune(fields[0])[0]] = fields[1]
+		case "%chardef":
+			var symbols []string
+			for _, key := range fields[0] {
+				symbols = append(symbols, keyNames[key])
+			}
+			readings, ok := SegmentZhuyin(symbols)
+			if !ok || len(readings) != len([]rune(fields[1])) {
+				skipped++
+				continue
+			}
+			entries = append(entries, ImportEntry{fields[1], readings, 0, true})
+			keys = append(keys, fields[0])
+			rank[fields[0]]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, err
+	}
+	if len(keyNames) == 0 {
+		return nil, skipped, errors.New("no %keyname section")
+	}
+
+	// the first of the entries sharing a key gets the highest rank
+	seen := make(map[string]int)
+	for i := range entries {
+		entries[i].Freq = rank[keys[i]] - seen[keys[i]]
+		seen[keys[i]]++
+	}
+	return entries, skipped, nil
+}
+
+// ParseRime reads the entries of a Rime dict.yaml. Codes may be Zhuyin or
+// Pinyin, with syllables separated by spaces. It returns the number of
+// entries whose code could not be read
+func ParseRime(r io.Reader) ([]ImportEntry, int, error) {
+	var entries []ImportEntry
+	skipped := 0
+	inBody := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !inBody {
+			inBody = strings.TrimSpace(line) == "..."
+			continue
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || fields[1] == "" {
+			skipped++
+			continue
+		}
+
+		var readings []ImportReading
+		for _, syllable := range strings.Fields(fields[1]) {
+			reading, ok := parseSyllable(syllable)
+			if !ok {
+				readings = nil
+				break
+			}
+			readings = append(readings, reading)
+		}
+		if len(readings) == 0 || len(readings) != len([]rune(fields[0])) {
+			skipped++
+			continue
+		}
+
+		freq := 0
+		if len(fields) > 2 {
+			weight, err := strconv.ParseFloat(strings.TrimSuffix(fields[2], "%"), 64)
+			if err == nil {
+				freq = int(weight)
+			}
+		}
+		entries = append(entries, ImportEntry{fields[0], readings, freq, false})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, err
+	}
+	if !inBody {
+		return nil, skipped, errors.New("no end of the YAML header (...)")
+	}
+	return entries, skipped, nil
+}
+
+// Import merges entries into the dictionary, resolving frequency
+// conflicts by policy. With dryRun set nothing is written
+func (ref ReferenceStore) Import(entries []ImportEntry, policy string, dryRun bool) *ImportResult {
+	writeBack := make(chan *ImportResult)
+	metrics.QueueAdd(1)
+	ref.importQueue <- &ImportRequest{entries, policy, dryRun, writeBack}
+	result := <-writeBack
+	metrics.QueueAdd(-1)
+	return result
+}
+
+// importer is the state of an import running on the DB thread: the rows
+// read or written so far, so that a dry run sees its own changes
+type importer struct {
+	ref        ReferenceStore
+	request    *ImportRequest
+	result     *ImportResult
+	characters map[string][]Character
+	phrases    map[string]*Phrase
+	nextId     int
+}
+
+// charactersOf returns the rows of a character
+func (im *importer) charactersOf(char string) []Character {
+	if rows, ok := im.characters[char]; ok {
+		return rows
+	}
+	var rows []Character
+	stmt, err := im.ref.conn.Prepare(`SELECT id, character, COALESCE(zhuyin, ''), COALESCE(pinyin, ''),
+						COALESCE(tone, 0), COALESCE(definition, ''), COALESCE(freq, 0)
+						FROM characters WHERE character = ? ORDER BY freq DESC`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare character search", "err", err)
+		return nil
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(char); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while selecting", "err", err)
+		return nil
+	}
+	for stmt.Next() {
+		var c Character
+		if err = stmt.Scan(&c.Id, &c.Character, &c.Zhuyin, &c.Pinyin, &c.Tone, &c.Definition, &c.Freq); err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting row data", "err", err)
+			continue
+		}
+		rows = append(rows, c)
+	}
+	im.characters[char] = rows
+	return rows
+}
+
+// lastInsertId returns the id of the row just inserted
+func (im *importer) lastInsertId() (int, error) {
+	stmt, err := im.ref.conn.Prepare("SELECT last_insert_rowid()")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(); err != nil {
+		return 0, err
+	}
+	id := 0
+	if stmt.Next() {
+		err = stmt.Scan(&id)
+	}
+	return id, err
+}
+
+// mergeFreq returns the frequency of an existing row after importing freq
+func (im *importer) mergeFreq(old, freq int) int {
+	switch im.request.Policy {
+	case POLICY_REPLACE:
+		return freq
+	case POLICY_SUM:
+		return old + freq
+	}
+	return old
+}
+
+// character resolves the row of a character reading, adding it if missing.
+// A reading without a tone must match an existing row
+func (im *importer) character(char string, reading ImportReading, freq int, updateFreq bool) (*Character, error) {
+	rows := im.charactersOf(char)
+	for i := range rows {
+		c := &rows[i]
+		if c.Zhuyin != reading.Zhuyin || (reading.Tone >= 0 && c.Tone != reading.Tone) {
+			continue
+		}
+		if !updateFreq {
+			return c, nil
+		}
+		merged := im.mergeFreq(c.Freq, freq)
+		if merged == c.Freq {
+			im.result.Kept++
+			return c, nil
+		}
+		im.result.Changes = append(im.result.Changes,
+			fmt.Sprintf("~ character %s %s%d freq %d -> %d", char, c.Zhuyin, c.Tone, c.Freq, merged))
+		im.result.Updated++
+		if !im.request.DryRun {
+			if err := im.ref.conn.Exec("UPDATE characters SET freq = ? WHERE id = ?", merged, c.Id); err != nil {
+				return nil, err
+			}
+		}
+		c.Freq = merged
+		return c, nil
+	}
+	if reading.Tone < 0 {
+		return nil, nil
+	}
+
+	pinyin := reading.Pinyin
+	if pinyin == "" {
+		pinyin, _ = ZhuyinToPinyin(reading.Zhuyin)
+	}
+	c := Character{im.nextId, char, reading.Zhuyin, pinyin, reading.Tone, "", freq, ""}
+	im.nextId--
+	if !im.request.DryRun {
+		err := im.ref.conn.Exec(`INSERT INTO characters(character, zhuyin, pinyin, tone, definition, freq)
+						VALUES(?, ?, ?, ?, '', ?)`, char, c.Zhuyin, c.Pinyin, c.Tone, c.Freq)
+		if err != nil {
+			return nil, err
+		}
+		if c.Id, err = im.lastInsertId(); err != nil {
+			return nil, err
+		}
+	}
+	im.result.Changes = append(im.result.Changes,
+		fmt.Sprintf("+ character %s %s%d (%s) freq %d", char, c.Zhuyin, c.Tone, c.Pinyin, c.Freq))
+	im.result.Added++
+	im.characters[char] = append(rows, c)
+	rows = im.characters[char]
+	return &rows[len(rows)-1], nil
+}
+
+// phrase adds or updates the phrase row linked to a character row. The
+// frequency of an existing row is kept unless updateFreq is set
+func (im *importer) phrase(text string, c *Character, freq int, updateFreq bool) error {
+	key := text + "\x00" + strconv.Itoa(c.Id)
+	existing, ok := im.phrases[key]
+	if !ok && c.Id > 0 {
+		stmt, err := im.ref.conn.Prepare(`SELECT id, character, phrase, COALESCE(definition, ''), COALESCE(freq, 0)
+							FROM phrases WHERE phrase = ? AND character = ?`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Finalize()
+		if err = stmt.Exec(text, c.Id); err != nil {
+			return err
+		}
+		if stmt.Next() {
+			existing = &Phrase{}
+			err = stmt.Scan(&existing.Id, &existing.Character, &existing.Phrase, &existing.Definition, &existing.Freq)
+			if err != nil {
+				return err
+			}
+			ok = true
+		}
+	}
+
+	if ok {
+		merged := existing.Freq
+		if updateFreq {
+			merged = im.mergeFreq(existing.Freq, freq)
+		}
+		if merged == existing.Freq {
+			im.result.Kept++
+		} else {
+			im.result.Changes = append(im.result.Changes,
+				fmt.Sprintf("~ phrase %s on %s %s%d freq %d -> %d", text, c.Character, c.Zhuyin, c.Tone, existing.Freq, merged))
+			im.result.Updated++
+			if !im.request.DryRun {
+				if err := im.ref.conn.Exec("UPDATE phrases SET freq = ? WHERE id = ?", merged, existing.Id); err != nil {
+					return err
+				}
+			}
+			existing.Freq = merged
+		}
+		im.phrases[key] = existing
+		return nil
+	}
+
+	if !im.request.DryRun {
+		err := im.ref.conn.Exec("INSERT INTO phrases(character, phrase, definition, freq) VALUES(?, ?, '', ?)",
+			c.Id, text, freq)
+		if err != nil {
+			return err
+		}
+	}
+	im.result.Changes = append(im.result.Changes,
+		fmt.Sprintf("+ phrase %s on %s %s%d freq %d", text, c.Character, c.Zhuyin, c.Tone, freq))
+	im.result.Added++
+	im.phrases[key] = &Phrase{0, c.Id, text, "", freq}
+	return nil
+}
+
+// polyphonic reports whether a character has more than one reading
+func (im *importer) polyphonic(char string) bool {
+	readings := make(map[string]bool)
+	for _, c := range im.charactersOf(char) {
+		readings[c.Zhuyin+strconv.Itoa(c.Tone)] = true
+	}
+	return len(readings) > 1
+}
+
+// entry merges a single entry. A phrase is linked to the rows of its
+// polyphonic characters, whose reading it decides, or to the row of its
+// first character if none is polyphonic
+func (im *importer) entry(entry ImportEntry) error {
+	chars := []rune(entry.Text)
+	if len(chars) == 1 {
+		added := im.result.Added
+		c, err := im.character(entry.Text, entry.Readings[0], entry.Freq, !entry.Ranked)
+		if err == nil && c == nil {
+			im.result.Skipped++
+			im.result.Changes = append(im.result.Changes,
+				fmt.Sprintf("! skipped %s %s: no tone and no matching character", entry.Text, entry.Readings[0].Zhuyin))
+		} else if c != nil && entry.Ranked && im.result.Added == added {
+			im.result.Kept++
+		}
+		return err
+	}
+
+	rows := make([]*Character, len(chars))
+	for i, char := range chars {
+		c, err := im.character(string(char), entry.Readings[i], 0, false)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			im.result.Skipped++
+			im.result.Changes = append(im.result.Changes,
+				fmt.Sprintf("! skipped %s: no tone and no matching character for %c", entry.Text, char))
+			return nil
+		}
+		copied := *c
+		rows[i] = &copied
+	}
+
+	linked := false
+	for i, char := range chars {
+		if im.polyphonic(string(char)) {
+			if err := im.phrase(entry.Text, rows[i], entry.Freq, !entry.Ranked); err != nil {
+				return err
+			}
+			linked = true
+		}
+	}
+	if !linked {
+		return im.phrase(entry.Text, rows[0], entry.Freq, !entry.Ranked)
+	}
+	return nil
+}
+
+// importTransaction runs an import in a single transaction, store adding
+// the entries and counting them in result. The import is rolled back when
+// store fails, the result then holding only the error. Called only by the
+// DB thread
+func (ref ReferenceStore) importTransaction(result *ImportResult, store func() error) *ImportResult {
+	if err := ref.conn.Exec("BEGIN"); err != nil {
+		metrics.Error("db_import")
+		logger.Error("unable to begin the import", "err", err)
+		return &ImportResult{Err: fmt.Errorf("unable to begin the import: %v", err)}
+	}
+	if err := store(); err != nil {
+		metrics.Error("db_import")
+		logger.Error("import failed, rolling back", "err", err)
+		ref.conn.Exec("ROLLBACK")
+		return &ImportResult{Err: err}
+	}
+	if err := ref.conn.Exec("COMMIT"); err != nil {
+		metrics.Error("db_import")
+		logger.Error("unable to commit the import", "err", err)
+		ref.conn.Exec("ROLLBACK")
+		return &ImportResult{Err: fmt.Errorf("unable to commit the import: %v", err)}
+	}
+	return result
+}
+
+// importFailed is the error of an import failing on an entry
+func importFailed(entry string, err error) error {
+	return fmt.Errorf("import of %s failed: %v", entry, err)
+}
+
+// ApplyImport is the base import function called only by the DB thread.
+// The import runs in a single transaction, and the cache is emptied once
+// the dictionary has changed
+func (ref ReferenceStore) ApplyImport(request *ImportRequest) *ImportResult {
+	im := &importer{ref, request, &ImportResult{}, make(map[string][]Character), make(map[string]*Phrase), -1}
+	result := ref.importTransaction(im.result, func() error {
+		for _, entry := range request.Entries {
+			if err := im.entry(entry); err != nil {
+				return importFailed(entry.Text, err)
+			}
+		}
+		return nil
+	})
+	if result.Err == nil && !request.DryRun && result.Added+result.Updated > 0 {
+		for key := range ref.GlobalCache {
+			delete(ref.GlobalCache, key)
+		}
+	}
+	return result
+}
+
+// RunImport is the import command: it merges .cin and Rime tables into the
+// dictionary, or with -dryrun prints the changes it would make
+func RunImport(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "Table format: cin or rime, empty to tell by the file extension")
+	policy := flags.String("policy", POLICY_KEEP, "Frequency of entries already present: keep, replace or sum")
+	dryRun := flags.Bool("dryrun", false, "Print the changes without writing them")
+	flags.Parse(args)
+
+	switch *policy {
+	case POLICY_KEEP, POLICY_REPLACE, POLICY_SUM:
+	default:
+		return fmt.Errorf("unknown policy %q", *policy)
+	}
+	if flags.NArg() == 0 {
+		return errors.New("no table to import")
+	}
+
+	var entries []ImportEntry
+	for _, name := range flags.Args() {
+		tableFormat := *format
+		if tableFormat == "" {
+			tableFormat = TABLE_CIN
+			if ext := filepath.Ext(name); ext == ".yaml" || ext == ".yml" {
+				tableFormat = TABLE_RIME
+			}
+		}
+		parser, ok := tableParsers[tableFormat]
+		if !ok {
+			return fmt.Errorf("unknown table format %q", tableFormat)
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		parsed, skipped, err := parser(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if skipped > 0 {
+			logger.Warn("entries without a Zhuyin or Pinyin reading were skipped", "file", name, "count", skipped)
+		}
+		entries = append(entries, parsed...)
+	}
+
+	result := ref.Import(entries, *policy, *dryRun)
+	if result.Err != nil {
+		return result.Err
+	}
+	if *dryRun {
+		for _, change := range result.Changes {
+			fmt.Println(change)
+		}
+	}
+	logger.Info("import finished", "dryrun", *dryRun, "added", result.Added, "updated", result.Updated,
+		"kept", result.Kept, "skipped", result.Skipped)
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"code.google.com/p/gosqlite/sqlite"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSegmentZhuyin(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []ImportReading
+	}{
+		{"ㄨㄛˇ", []ImportReading{{"ㄨㄛ", "wo", 3}}},
+		{"ㄨㄛ", []ImportReading{{"ㄨㄛ", "wo", 1}}},
+		{"ㄧㄣˊㄏㄤˊ", []ImportReading{{"ㄧㄣ", "yin", 2}, {"ㄏㄤ", "hang", 2}}},
+		{"ㄨㄛˇㄇㄣ˙", []ImportReading{{"ㄨㄛ", "wo", 3}, {"ㄇㄣ", "men", 5}}},
+		// a symbol that cannot continue the syllable starts the next one
+		{"ㄊㄚㄇㄣ˙", []ImportReading{{"ㄊㄚ", "ta", 1}, {"ㄇㄣ", "men", 5}}},
+	}
+	for _, test := range tests {
+		var symbols []string
+		for _, r := range test.input {
+			symbols = append(symbols, string(r))
+		}
+		got, ok := SegmentZhuyin(symbols)
+		if !ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SegmentZhuyin(%s) = %v, %v, want %v", test.input, got, ok, test.want)
+		}
+	}
+	for _, bad := range [][]string{{"ˇ"}, {"a"}, {"ㄨ", "x"}} {
+		if got, ok := SegmentZhuyin(bad); ok {
+			t.Errorf("SegmentZhuyin(%v) = %v, want failure", bad, got)
+		}
+	}
+}
+
+func TestParseCin(t *testing.T) {
+	cin := `# comment
+%gen_inp
+%ename test
+%keyname begin
+j ㄨ
+i ㄛ
+3 ˇ
+u ㄧ
+p ㄣ
+6 ˊ
+c ㄏ
+; ㄤ
+%keyname end
+%chardef begin
+ji3 我
+ji3 沃
+ji 窩
+up6c;6 銀行
+xx 錯
+%chardef end
+`
+	entries, skipped, err := ParseCin(strings.NewReader(cin))
+	if err != nil || skipped != 1 {
+		t.Fatalf("ParseCin: %v, skipped %d, want 1", err, skipped)
+	}
+	want := []ImportEntry{
+		{"我", []ImportReading{{"ㄨㄛ", "wo", 3}}, 2, true},
+		{"沃", []ImportReading{{"ㄨㄛ", "wo", 3}}, 1, true},
+		{"窩", []ImportReading{{"ㄨㄛ", "wo", 1}}, 1, true},
+		{"銀行", []ImportReading{{"ㄧㄣ", "yin", 2}, {"ㄏㄤ", "hang", 2}}, 1, true},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("ParseCin = %v, want %v", entries, want)
+	}
+
+	if _, _, err = ParseCin(strings.NewReader("%chardef begin\nji 窩\n%chardef end\n")); err == nil {
+		t.Error("ParseCin accepted a table without %keyname")
+	}
+}
+
+func TestParseRime(t *testing.T) {
+	rime := `# Rime dictionary
+---
+name: test
+...
+
+我	wo3	100
+銀行	yín háng	5%
+窩	ㄨㄛ
+行	
+錯	xyz	1
+`
+	entries, skipped, err := ParseRime(strings.NewReader(rime))
+	if err != nil || skipped != 2 {
+		t.Fatalf("ParseRime: %v, skipped %d, want 2", err, skipped)
+	}
+	want := []ImportEntry{
+		{"我", []ImportReading{{"ㄨㄛ", "wo", 3}}, 100, false},
+		{"銀行", []ImportReading{{"ㄧㄣ", "yin", 2}, {"ㄏㄤ", "hang", 2}}, 5, false},
+		{"窩", []ImportReading{{"ㄨㄛ", "wo", 1}}, 0, false},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("ParseRime = %v, want %v", entries, want)
+	}
+
+	if _, _, err = ParseRime(strings.NewReader("我\two3\n")); err == nil {
+		t.Error("ParseRime accepted a dictionary without a YAML header")
+	}
+}
+
+func TestImport(t *testing.T) {
+	ref := newTestReference(t)
+	entries := []ImportEntry{
+		{"汐", []ImportReading{{"ㄒㄧ", "xi", 1}}, 5, false},
+		{"我", []ImportReading{{"ㄨㄛ", "wo", 3}}, 7, false},
+	}
+	if result := ref.Import(entries, POLICY_SUM, true); result.Added != 1 || result.Updated != 1 || result.Err != nil {
+		t.Errorf("dry run = %+v, want 1 added and 1 updated", result)
+	}
+	if _, n := ref.GetByChar("汐"); n != 0 {
+		t.Error("dry run wrote to the database")
+	}
+	if result := ref.Import(entries, POLICY_SUM, false); result.Added != 1 || result.Updated != 1 || result.Err != nil {
+		t.Errorf("import = %+v, want 1 added and 1 updated", result)
+	}
+	if list, n := ref.GetByChar("我"); n != 1 || (*list)[0].Freq != 107 {
+		t.Errorf("summed frequency of 我 = %v", *list)
+	}
+}
+
+func TestImportRanked(t *testing.T) {
+	ref := newTestReference(t)
+	entries := []ImportEntry{
+		{"我", []ImportReading{{"ㄨㄛ", "wo", 3}}, 2, true},
+		{"汐", []ImportReading{{"ㄒㄧ", "xi", 1}}, 1, true},
+		{"銀行", []ImportReading{{"ㄧㄣ", "yin", 2}, {"ㄏㄤ", "hang", 2}}, 1, true},
+	}
+	result := ref.Import(entries, POLICY_REPLACE, false)
+	if result.Err != nil || result.Added != 1 || result.Kept != 2 || result.Updated != 0 {
+		t.Fatalf("import = %+v, want 汐 added and the stored frequencies kept", result)
+	}
+	if list, _ := ref.GetByChar("我"); (*list)[0].Freq != 100 {
+		t.Errorf("rank replaced the frequency of 我: %v", *list)
+	}
+	if list, _ := ref.GetByChar("銀行"); (*list)[0].Freq != 90 {
+		t.Errorf("rank replaced the frequency of 銀行: %v", *list)
+	}
+	if list, _ := ref.GetByChar("汐"); len(*list) != 1 || (*list)[0].Freq != 1 {
+		t.Errorf("new row = %v, want its rank as frequency", *list)
+	}
+}
+
+// brokenReference returns a store over testCharacters and the phrase 銀行
+// without table. The table is dropped through a connection of the test's
+// own before the store opens, as only the DB thread may use the store's
+func brokenReference(t *testing.T, table string) *ReferenceStore {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "test.db")
+	conn, err := sqlite.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = Migrate(conn, LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range testCharacters {
+		err = conn.Exec("INSERT INTO characters(id, character, zhuyin, pinyin, tone, definition, freq) VALUES(?, ?, ?, ?, ?, ?, ?)",
+			c.Id, c.Character, c.Zhuyin, c.Pinyin, c.Tone, c.Definition, c.Freq)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = execAll(conn, "INSERT INTO phrases(character, phrase, definition, freq) VALUES(7, '銀行', 'bank', 90)",
+		"DROP TABLE "+table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := NewReference(name, false)
+	t.Cleanup(ref.Close)
+	return ref
+}
+
+// writeTestFile writes data to a file named name in a temporary directory
+func writeTestFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImportFailures(t *testing.T) {
+	ximport := []ImportEntry{{"汐", []ImportReading{{"ㄒㄧ", "xi", 1}}, 5, false}}
+	tests := []struct {
+		name  string
+		table string
+		run   func(t *testing.T, ref *ReferenceStore) error
+	}{
+		{"Import", "characters", func(t *testing.T, ref *ReferenceStore) error {
+			return ref.Import(ximport, POLICY_KEEP, false).Err
+		}},
+		{"RunImport", "characters", func(t *testing.T, ref *ReferenceStore) error {
+			return RunImport(ref, []string{writeTestFile(t, "test.yaml", "---\n...\n汐\txi1\t5\n")})
+		}},
+		{"ImportTranslations", "definitions", func(t *testing.T, ref *ReferenceStore) error {
+			entries, _, _ := ParseCedict(strings.NewReader(testCedict))
+			return ref.ImportTranslations("de", entries).Err
+		}},
+		{"RunImportDefinitions", "definitions", func(t *testing.T, ref *ReferenceStore) error {
+			return RunImportDefinitions(ref, []string{"-lang", "de", writeTestFile(t, "handedict.u8", testCedict)})
+		}},
+		{"ImportDialect", "dialect_readings", func(t *testing.T, ref *ReferenceStore) error {
+			readings := []DialectReading{{-1, "我", DIALECT_HOKKIEN, "ㆣㄨㄚ", 2, "guá", "I", 100}}
+			return ref.ImportDialect(readings).Err
+		}},
+		{"ImportJyutping", "characters", func(t *testing.T, ref *ReferenceStore) error {
+			return ref.ImportJyutping(map[string]string{"我": "ngo5"}).Err
+		}},
+		{"RunImportUnihan", "characters", func(t *testing.T, ref *ReferenceStore) error {
+			return RunImportUnihan(ref, []string{writeTestFile(t, "Unihan_Readings.txt", testUnihan)})
+		}},
+		{"UserDictionary", "user_entries", func(t *testing.T, ref *ReferenceStore) error {
+			entries := []UserEntry{{-1, "alice", "我們", []ImportReading{{"ㄨㄛ", "wo", 3}, {"ㄇㄣ", "men", 5}}, 1, false}}
+			return ref.UserDictionary(UserDictRequest{User: "alice", Action: USERDICT_IMPORT, Entries: entries}).Err
+		}},
+		// 走 has no phrases, but they cannot be checked
+		{"AdminDelete", "phrases", func(t *testing.T, ref *ReferenceStore) error {
+			err := ref.Admin(AdminRequest{User: "alice", Action: ADMIN_DELETE, Kind: DEFINITION_CHARACTER, Id: 9}).Err
+			if c := ref.Admin(AdminRequest{Action: ADMIN_GET, Kind: DEFINITION_CHARACTER, Id: 9}); c.Err != nil {
+				t.Errorf("character row gone: %v", c.Err)
+			}
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ref := brokenReference(t, test.table)
+			if err := test.run(t, ref); err == nil {
+				t.Errorf("%s succeeded without the %s table", test.name, test.table)
+			}
+		})
+	}
+}
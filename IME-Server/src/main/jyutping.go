@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jyutpingInitials are the initials of Jyutping, two letter ones first
+var jyutpingInitials = []string{"ng", "gw", "kw",
+	"b", "p", "m", "f", "d", "t", "n", "l", "g", "k", "h", "w", "z", "c", "s", "j"}
+
+// jyutpingFinals are the finals of Jyutping, including the syllabic
+// nasals m and ng
+var jyutpingFinals = map[string]bool{
+	"aa": true, "aai": true, "aau": true, "aam": true, "aan": true, "aang": true, "aap": true, "aat": true, "aak": true,
+	"a": true, "ai": true, "au": true, "am": true, "an": true, "ang": true, "ap": true, "at": true, "ak": true,
+	"e": true, "ei": true, "eu": true, "em": true, "en": true, "eng": true, "ep": true, "et": true, "ek": true,
+	"i": true, "iu": true, "im": true, "in": true, "ing": true, "ip": true, "it": true, "ik": true,
+	"o": true, "oi": true, "ou": true, "om": true, "on": true, "ong": true, "op": true, "ot": true, "ok": true,
+	"oe": true, "oeng": true, "oet": true, "oek": true, "eoi": true, "eon": true, "eot": true,
+	"u": true, "ui": true, "um": true, "un": true, "ung": true, "up": true, "ut": true, "uk": true,
+	"yu": true, "yun": true, "yut": true,
+	"m": true, "ng": true,
+}
+
+// maxJyutpingLength is the length of the longest Jyutping syllable with
+// its tone, as in gwaang3
+const maxJyutpingLength = 7
+
+// JyutpingImportRequest is an object that asks the DB thread to store the
+// Jyutping readings of characters
+type JyutpingImportRequest struct {
+	Readings  map[string]string
+	WriteBack chan *ImportResult
+}
+
+// JyutpingLookupRequest is an object that asks the DB thread for the
+// characters read as a Jyutping syllable, or the phrases read as several.
+// Syllables without a tone digit match any tone
+type JyutpingLookupRequest struct {
+	Syllables []string
+	WriteBack chan *CharLookupResponse
+}
+
+// ParseJyutping separates a Jyutping syllable from its tone, 1 to 6, and
+// checks that it is valid Cantonese. The tone is -1 when none is given
+func ParseJyutping(input string) (string, int, bool) {
+	syllable := strings.ToLower(strings.TrimSpace(input))
+	tone := -1
+	if n := len(syllable); n > 1 && syllable[n-1] >= '0' && syllable[n-1] <= '9' {
+		tone, syllable = int(syllable[n-1]-'0'), syllable[:n-1]
+		if tone < 1 || tone > 6 {
+			return "", tone, false
+		}
+	}
+	if jyutpingFinals[syllable] {
+		return syllable, tone, true
+	}
+	for _, initial := range jyutpingInitials {
+		if strings.HasPrefix(syllable, initial) && jyutpingFinals[syllable[len(initial):]] {
+			final := syllable[len(initial):]
+			// the nasals m and ng are syllables on their own, only h takes them
+			if (final == "m" || final == "ng") && initial != "h" {
+				continue
+			}
+			return syllable, tone, true
+		}
+	}
+	return "", tone, false
+}
+
+// SegmentJyutping splits Jyutping typed without spaces, such as nei5hou2
+// or neihou, into syllables. Of the possible splits it keeps the one with
+// the fewest syllables. It returns false if the input cannot be split
+func SegmentJyutping(input string) ([]string, bool) {
+	input = strings.ToLower(strings.Join(strings.Fields(input), ""))
+	if input == "" {
+		return nil, false
+	}
+	// best[i] is the split of input[:i] with the fewest syllables
+	best := make([][]string, len(input)+1)
+	best[0] = []string{}
+	for i := 0; i < len(input); i++ {
+		if best[i] == nil {
+			continue
+		}
+		for j := i + 1; j <= len(input) && j-i <= maxJyutpingLength; j++ {
+			syllable := input[i:j]
+			// a tone digit belongs to the syllable before it
+			if j < len(input) && input[j] >= '0' && input[j] <= '9' {
+				continue
+			}
+			if _, _, ok := ParseJyutping(syllable); !ok {
+				continue
+			}
+			if best[j] == nil || len(best[i])+1 < len(best[j]) {
+				best[j] = append(append([]string{}, best[i]...), syllable)
+			}
+		}
+	}
+	split := best[len(input)]
+	return split, len(split) > 0
+}
+
+// GetByJyutping retrieves full candidate characters, given Jyutping. Input
+// of several syllables is segmented and retrieves the phrases read so
+func (ref ReferenceStore) GetByJyutping(jyutping string) (*[]Character, int, error) {
+	syllables, ok := SegmentJyutping(jyutping)
+	if !ok {
+		return nil, 0, fmt.Errorf("%q is not Jyutping", jyutping)
+	}
+	result, count := ref.GetByJyutpingSyllables(syllables)
+	return result, count, nil
+}
+
+// GetByJyutpingSyllables retrieves the characters read as a Jyutping
+// syllable, or the phrases whose characters are read as the syllables
+func (ref ReferenceStore) GetByJyutpingSyllables(syllables []string) (*[]Character, int) {
+	start := time.Now()
+	writeBack := make(chan *CharLookupResponse)
+	metrics.QueueAdd(1)
+	ref.jyutpingQueue <- &JyutpingLookupRequest{syllables, writeBack}
+	response := <-writeBack
+	metrics.QueueAdd(-1)
+	metrics.ObserveQuery("jyutping", time.Since(start))
+	return &response.CharList, response.NumResults
+}
+
+// jyutpingPattern returns the LIKE pattern matching a syllable as a word
+// of the jyutping column. A syllable without tone matches by prefix,
+// listing the completions of partly typed ones
+func jyutpingPattern(input string) string {
+	syllable, tone, _ := ParseJyutping(input)
+	if tone >= 0 {
+		return fmt.Sprintf("%% %s%d %%", syllable, tone)
+	}
+	return "% " + syllable + "%"
+}
+
+// GetJyutping is the base Jyutping lookup function called only by the DB
+// thread. The jyutping column lists every reading of a character, so the
+// syllable is matched as a word of it. Characters with several Mandarin
+// readings are listed once, by their most frequent row
+func (ref ReferenceStore) GetJyutping(request *JyutpingLookupRequest) *CharLookupResponse {
+	if len(request.Syllables) != 1 {
+		return ref.GetJyutpingPhrases(request)
+	}
+	pattern := jyutpingPattern(request.Syllables[0])
+	searchStmt, err := ref.conn.Prepare(`SELECT id, character, COALESCE(zhuyin, ''), COALESCE(pinyin, ''),
+						COALESCE(tone, 0), COALESCE(definition, ''), MAX(COALESCE(freq, 0)) AS best, jyutping
+						FROM characters WHERE ' ' || jyutping || ' ' LIKE ?
+						GROUP BY character ORDER BY best DESC LIMIT 50`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare jyutping search", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	defer searchStmt.Finalize()
+
+	if err = searchStmt.Exec(pattern); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while selecting", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	var charList []Character
+	for searchStmt.Next() {
+		var c Character
+		err = searchStmt.Scan(&c.Id, &c.Character, &c.Zhuyin, &c.Pinyin, &c.Tone, &c.Definition, &c.Freq, &c.Jyutping)
+		if err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting row data", "err", err)
+			continue
+		}
+		charList = append(charList, c)
+	}
+	return &CharLookupResponse{charList, len(charList)}
+}
+
+// GetJyutpingPhrases is the base Jyutping phrase lookup function called
+// only by the DB thread: the phrases with a character read as each of the
+// syllables, in turn. The candidates carry the syllables as their Jyutping
+func (ref ReferenceStore) GetJyutpingPhrases(request *JyutpingLookupRequest) *CharLookupResponse {
+	if len(request.Syllables) == 0 {
+		return &CharLookupResponse{nil, 0}
+	}
+	conditions := make([]string, len(request.Syllables))
+	var args []interface{}
+	for i, syllable := range request.Syllables {
+		conditions[i] = fmt.Sprintf(`substr(phrase, %d, 1) IN
+						(SELECT character FROM characters WHERE ' ' || jyutping || ' ' LIKE ?)`, i+1)
+		args = append(args, jyutpingPattern(syllable))
+	}
+	searchStmt, err := ref.conn.Prepare(`SELECT MIN(id), phrase, COALESCE(MAX(definition), ''), MAX(COALESCE(freq, 0)) AS best
+						FROM phrases WHERE length(phrase) = ` + strconv.Itoa(len(request.Syllables)) + ` AND ` +
+		strings.Join(conditions, " AND ") + `
+						GROUP BY phrase ORDER BY best DESC LIMIT 50`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare jyutping phrase search", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	defer searchStmt.Finalize()
+
+	if err = searchStmt.Exec(args...); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while selecting", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	var charList []Character
+	for searchStmt.Next() {
+		c := Character{Jyutping: strings.Join(request.Syllables, " ")}
+		if err = searchStmt.Scan(&c.Id, &c.Character, &c.Definition, &c.Freq); err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting phrase data", "err", err)
+			continue
+		}
+		charList = append(charList, c)
+	}
+	return &CharLookupResponse{charList, len(charList)}
+}
+
+// ParseUnihanCantonese reads the kCantonese readings of Unihan_Readings.txt,
+// by character. Readings that are not valid Jyutping are left out and
+// counted
+func ParseUnihanCantonese(r io.Reader) (map[string]string, int, error) {
+	readings := make(map[string]string)
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 || fields[1] != "kCantonese" || !strings.HasPrefix(fields[0], "U+") {
+			continue
+		}
+		var code rune
+		if _, err := fmt.Sscanf(fields[0][2:], "%X", &code); err != nil {
+			skipped++
+			continue
+		}
+		var valid []string
+		for _, reading := range strings.Fields(fields[2]) {
+			if _, tone, ok := ParseJyutping(reading); ok && tone > 0 {
+				valid = append(valid, reading)
+			} else {
+				skipped++
+			}
+		}
+		if len(valid) > 0 {
+			readings[string(code)] = strings.Join(valid, " ")
+		}
+	}
+	return readings, skipped, scanner.Err()
+}
+
+// ImportJyutping stores the Jyutping readings of characters on all their
+// rows, replacing those stored before
+func (ref ReferenceStore) ImportJyutping(readings map[string]string) *ImportResult {
+	writeBack := make(chan *ImportResult)
+	metrics.QueueAdd(1)
+	ref.jyutpingImportQueue <- &JyutpingImportRequest{readings, writeBack}
+	result := <-writeBack
+	metrics.QueueAdd(-1)
+	return result
+}
+
+// storeJyutping sets the Jyutping readings of the rows of a character
+func (ref ReferenceStore) storeJyutping(char, jyutping string, result *ImportResult) error {
+	stmt, err := ref.conn.Prepare("SELECT COALESCE(jyutping, '') FROM characters WHERE character = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(char); err != nil {
+		return err
+	}
+	rows, changed := 0, 0
+	for stmt.Next() {
+		var old string
+		if err = stmt.Scan(&old); err != nil {
+			return err
+		}
+		rows++
+		if old != jyutping {
+			changed++
+		}
+	}
+	switch {
+	case rows == 0:
+		result.Skipped++
+		return nil
+	case changed == 0:
+		result.Kept++
+		return nil
+	}
+	result.Updated++
+	return ref.conn.Exec("UPDATE characters SET jyutping = ? WHERE character = ?", jyutping, char)
+}
+
+// ApplyJyutpingImport is the base Jyutping import function called only by
+// the DB thread. The import runs in a single transaction
+func (ref ReferenceStore) ApplyJyutpingImport(request *JyutpingImportRequest) *ImportResult {
+	result := &ImportResult{}
+	imported := ref.importTransaction(result, func() error {
+		for char, jyutping := range request.Readings {
+			if err := ref.storeJyutping(char, jyutping, result); err != nil {
+				return importFailed(char, err)
+			}
+		}
+		return nil
+	})
+	if imported.Err == nil {
+		// cached candidates carry the old readings
+		for key := range ref.GlobalCache {
+			delete(ref.GlobalCache, key)
+		}
+	}
+	return imported
+}
+
+// RunImportUnihan is the importunihan command: it stores the Cantonese
+// readings of Unihan_Readings.txt in the jyutping column
+func RunImportUnihan(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("importunihan", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("no Unihan_Readings.txt to import")
+	}
+
+	readings := make(map[string]string)
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		parsed, skipped, err := ParseUnihanCantonese(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if skipped > 0 {
+			logger.Warn("readings that are not Jyutping were skipped", "file", name, "count", skipped)
+		}
+		for char, jyutping := range parsed {
+			readings[char] = jyutping
+		}
+	}
+
+	result := ref.ImportJyutping(readings)
+	if result.Err != nil {
+		return result.Err
+	}
+	logger.Info("jyutping imported", "updated", result.Updated, "kept", result.Kept, "unmatched", result.Skipped)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJyutping(t *testing.T) {
+	tests := []struct {
+		input    string
+		syllable string
+		tone     int
+		ok       bool
+	}{
+		{"nei5", "nei", 5, true},
+		{" NEI5 ", "nei", 5, true},
+		{"hou", "hou", -1, true},
+		{"gwaang3", "gwaang", 3, true},
+		{"jyut6", "jyut", 6, true},
+		{"ngo5", "ngo", 5, true},
+		{"m4", "m", 4, true},
+		{"hm4", "hm", 4, true},
+		{"ng5", "ng", 5, true},
+		{"sm4", "", 4, false},
+		{"nei7", "", 7, false},
+		{"nei0", "", 0, false},
+		{"xyz", "", -1, false},
+		{"", "", -1, false},
+	}
+	for _, test := range tests {
+		syllable, tone, ok := ParseJyutping(test.input)
+		if syllable != test.syllable || tone != test.tone || ok != test.ok {
+			t.Errorf("ParseJyutping(%q) = %q, %d, %v, want %q, %d, %v", test.input, syllable, tone, ok,
+				test.syllable, test.tone, test.ok)
+		}
+	}
+}
+
+func TestSegmentJyutping(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"nei5hou2", []string{"nei5", "hou2"}},
+		{"neihou", []string{"nei", "hou"}},
+		{"nei5 hou2", []string{"nei5", "hou2"}},
+		{"NGO5", []string{"ngo5"}},
+		{"ngan4hong4", []string{"ngan4", "hong4"}},
+		{"gwongdung", []string{"gwong", "dung"}},
+		// the fewest syllables win over si ng
+		{"sing", []string{"sing"}},
+		{"m4goi1", []string{"m4", "goi1"}},
+		{"nei7", nil},
+		{"xyz", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		got, ok := SegmentJyutping(test.input)
+		if ok != (test.want != nil) || test.want != nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SegmentJyutping(%q) = %v, %v, want %v", test.input, got, ok, test.want)
+		}
+	}
+}
+
+// testUnihan holds kCantonese readings, one of which is not Jyutping
+const testUnihan = "# Unihan_Readings.txt\n" +
+	"U+6211\tkCantonese\tngo5\n" +
+	"U+884C\tkCantonese\thaang4 hang4 hong4\n" +
+	"U+9280\tkCantonese\tngan4 xx9\n" +
+	"U+9280\tkMandarin\tyín\n"
+
+// importUnihan imports testUnihan into ref through the importunihan command
+func importUnihan(t *testing.T, ref *ReferenceStore) {
+	t.Helper()
+	readings, skipped, err := ParseUnihanCantonese(strings.NewReader(testUnihan))
+	if err != nil || skipped != 1 || readings["行"] != "haang4 hang4 hong4" || len(readings) != 3 {
+		t.Fatalf("ParseUnihanCantonese = %v, skipped %d, %v", readings, skipped, err)
+	}
+	unihan := filepath.Join(t.TempDir(), "Unihan_Readings.txt")
+	if err = ioutil.WriteFile(unihan, []byte(testUnihan), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = RunImportUnihan(ref, []string{unihan}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetByJyutping(t *testing.T) {
+	ref := newTestReference(t)
+	importUnihan(t, ref)
+
+	result, n, err := ref.GetByJyutping("hang4")
+	if err != nil || n != 1 || (*result)[0].Character != "行" || (*result)[0].Id != 6 {
+		t.Errorf("GetByJyutping(hang4) = %v, %v, want 行 once, by its most frequent row", *result, err)
+	}
+	if _, n, _ = ref.GetByJyutping("ng"); n != 2 {
+		t.Errorf("GetByJyutping(ng) found %d, want the completions ngo5 and ngan4", n)
+	}
+	for _, input := range []string{"ngan4hong4", "ngan hong", "nganhong4"} {
+		result, n, err = ref.GetByJyutping(input)
+		if err != nil || n != 1 || (*result)[0].Character != "銀行" || (*result)[0].Definition != "bank" {
+			t.Errorf("GetByJyutping(%s) = %v, %v, want the phrase", input, *result, err)
+		}
+	}
+	if _, n, err = ref.GetByJyutping("ngan4hang2"); err != nil || n != 0 {
+		t.Errorf("GetByJyutping(ngan4hang2) found %d, %v, want no phrase", n, err)
+	}
+	if _, _, err = ref.GetByJyutping("xyz"); err == nil {
+		t.Error("GetByJyutping(xyz) looked up")
+	}
+}
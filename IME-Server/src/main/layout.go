@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LayoutKey is a single key of a soft keyboard. Key is the character the
+// key produces on a US QWERTY keyboard, which identifies its position
+type LayoutKey struct {
+	Key     string
+	Row     int
+	Column  int
+	Symbol  string
+	Shifted string
+}
+
+// LayoutRow is a row of keys, with its horizontal offset from the left
+// edge of the keyboard in key widths
+type LayoutRow struct {
+	Offset float64
+	Keys   []LayoutKey
+}
+
+// ToneKey maps a tone number to the key that types it
+type ToneKey struct {
+	Tone   int
+	Key    string
+	Symbol string
+}
+
+// Layout is a named Zhuyin keyboard layout
+type Layout struct {
+	Name        string
+	Description string
+	Rows        []LayoutRow
+	ToneKeys    []ToneKey
+}
+
+// qwertyRows are the unshifted and shifted characters of the four
+// character rows of a US QWERTY keyboard
+var qwertyRows = [][2]string{
+	{"1234567890-=", "!@#$%^&*()_+"},
+	{"qwertyuiop[]", "QWERTYUIOP{}"},
+	{"asdfghjkl;'", "ASDFGHJKL:\""},
+	{"zxcvbnm,./", "ZXCVBNM<>?"},
+}
+
+// qwertyOffsets are the stagger of the QWERTY rows, in key widths from
+// the left edge of the backtick key
+var qwertyOffsets = []float64{1, 1.5, 1.75, 2.25}
+
+// layoutStore holds every known layout by name
+var layoutStore = struct {
+	sync.RWMutex
+	layouts map[string]*Layout
+}{layouts: map[string]*Layout{"standard": standardLayout()}}
+
+// standardLayout returns the standard (Dachen) Zhuyin layout found on
+// keyboards sold in Taiwan
+func standardLayout() *Layout {
+	return NewQwertyLayout("standard", "Standard (Dachen) Zhuyin layout", map[string]string{
+		"1": "ㄅ", "2": "ㄉ", "3": "ˇ", "4": "ˋ", "5": "ㄓ", "6": "ˊ", "7": "˙", "8": "ㄚ", "9": "ㄞ", "0": "ㄢ", "-": "ㄦ",
+		"q": "ㄆ", "w": "ㄊ", "e": "ㄍ", "r": "ㄐ", "t": "ㄔ", "y": "ㄗ", "u": "ㄧ", "i": "ㄛ", "o": "ㄟ", "p": "ㄣ",
+		"a": "ㄇ", "s": "ㄋ", "d": "ㄎ", "f": "ㄑ", "g": "ㄕ", "h": "ㄘ", "j": "ㄨ", "k": "ㄜ", "l": "ㄠ", ";": "ㄤ",
+		"z": "ㄈ", "x": "ㄌ", "c": "ㄏ", "v": "ㄒ", "b": "ㄖ", "n": "ㄙ", "m": "ㄩ", ",": "ㄝ", ".": "ㄡ", "/": "ㄥ",
+	}, []ToneKey{{1, " ", "ˉ"}, {2, "6", "ˊ"}, {3, "3", "ˇ"}, {4, "4", "ˋ"}, {5, "7", "˙"}})
+}
+
+// NewQwertyLayout builds a layout on the QWERTY key positions, given the
+// Zhuyin symbol typed by each QWERTY key. Keys without a symbol keep their
+// QWERTY character
+func NewQwertyLayout(name, description string, symbols map[string]string, toneKeys []ToneKey) *Layout {
+	layout := &Layout{Name: name, Description: description, ToneKeys: toneKeys}
+	for row, chars := range qwertyRows {
+		plain, shifted := []rune(chars[0]), []rune(chars[1])
+		layoutRow := LayoutRow{Offset: qwertyOffsets[row]}
+		for column := range plain {
+			key := string(plain[column])
+			symbol, ok := symbols[key]
+			if !ok {
+				symbol = key
+			}
+			layoutRow.Keys = append(layoutRow.Keys, LayoutKey{key, row, column, symbol, string(shifted[column])})
+		}
+		layout.Rows = append(layout.Rows, layoutRow)
+	}
+	return layout
+}
+
+// Validate checks that a layout is usable: it has a name, its keys are at
+// positions of the QWERTY character rows and no Zhuyin symbol is on more
+// than one key
+func (layout *Layout) Validate() error {
+	if layout.Name == "" {
+		return errors.New("layout has no name")
+	}
+	seen := make(map[string]string)
+	for _, row := range layout.Rows {
+		for _, key := range row.Keys {
+			if key.Row < 0 || key.Row >= len(qwertyRows) {
+				return fmt.Errorf("layout %s: key %q is on row %d, rows are 0 to %d", layout.Name, key.Key, key.Row, len(qwertyRows)-1)
+			}
+			if columns := len([]rune(qwertyRows[key.Row][0])); key.Column < 0 || key.Column >= columns {
+				return fmt.Errorf("layout %s: key %q is in column %d, row %d has columns 0 to %d",
+					layout.Name, key.Key, key.Column, key.Row, columns-1)
+			}
+			if !isZhuyin(key.Symbol) && !isTone(key.Symbol) {
+				continue
+			}
+			if other, ok := seen[key.Symbol]; ok {
+				return fmt.Errorf("layout %s: symbol %s is on keys %q and %q", layout.Name, key.Symbol, other, key.Key)
+			}
+			seen[key.Symbol] = key.Key
+		}
+	}
+	return nil
+}
+
+// KeyOf returns the key typing a Zhuyin symbol or tone mark on layout
+func (layout *Layout) KeyOf(symbol string) (string, bool) {
+	if tone, ok := toneMarks[symbol]; ok {
+		for _, toneKey := range layout.ToneKeys {
+			if toneKey.Tone == tone {
+				return toneKey.Key, true
+			}
+		}
+		return "", false
+	}
+	for _, row := range layout.Rows {
+		for _, key := range row.Keys {
+			if key.Symbol == symbol {
+				return key.Key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// GetLayout returns the layout registered under name
+func GetLayout(name string) (*Layout, bool) {
+	layoutStore.RLock()
+	defer layoutStore.RUnlock()
+	layout, ok := layoutStore.layouts[name]
+	return layout, ok
+}
+
+// LayoutNames returns the names of all registered layouts, sorted
+func LayoutNames() []string {
+	layoutStore.RLock()
+	defer layoutStore.RUnlock()
+	names := make([]string, 0, len(layoutStore.layouts))
+	for name := range layoutStore.layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RegisterLayout validates a layout and makes it available by name,
+// replacing any layout of the same name
+func RegisterLayout(layout *Layout) error {
+	if err := layout.Validate(); err != nil {
+		return err
+	}
+	layoutStore.Lock()
+	layoutStore.layouts[layout.Name] = layout
+	layoutStore.Unlock()
+	return nil
+}
+
+// LoadLayout reads a layout definition from a JSON file
+func LoadLayout(path string) (*Layout, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var layout Layout
+	if err = json.Unmarshal(data, &layout); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &layout, nil
+}
+
+// LoadLayouts registers every *.json layout definition in dir
+func LoadLayouts(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		layout, err := LoadLayout(path)
+		if err != nil {
+			return err
+		}
+		if err = RegisterLayout(layout); err != nil {
+			return err
+		}
+		logger.Info("loaded layout", "name", layout.Name, "path", path)
+	}
+	return nil
+}
+
+// layoutHandler serves /layout/ with the list of layout names and
+// /layout/<name> with the named layout
+func (serv *ServerParams) layoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/layout"), "/")
+
+	var data interface{}
+	if name == "" {
+		data = LayoutNames()
+	} else if layout, ok := GetLayout(name); ok {
+		data = layout
+	} else {
+		metrics.Error("not_found")
+		w.WriteHeader(http.StatusNotFound)
+		bytearray, _ := json.Marshal(Response{"", RESPONSE_ERROR, "unknown layout", 0, nil, 0})
+		w.Write(bytearray)
+		return
+	}
+	bytearray, _ := json.Marshal(Response{"", RESPONSE_OK, data, 0, nil, 0})
+	w.Write(bytearray)
+}
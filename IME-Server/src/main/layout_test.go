@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateStandardLayout(t *testing.T) {
+	if err := standardLayout().Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*Layout)
+		want string
+	}{
+		{"no name", func(l *Layout) { l.Name = "" }, "no name"},
+		{"row too large", func(l *Layout) { l.Rows[0].Keys[0].Row = 7 }, "row 7"},
+		{"negative row", func(l *Layout) { l.Rows[0].Keys[0].Row = -1 }, "row -1"},
+		{"column too large", func(l *Layout) { l.Rows[3].Keys[0].Column = 10 }, "column 10"},
+		{"negative column", func(l *Layout) { l.Rows[1].Keys[2].Column = -3 }, "column -3"},
+		{"duplicate symbol", func(l *Layout) { l.Rows[1].Keys[0].Symbol = "ㄅ" }, "symbol ㄅ"},
+	}
+	for _, test := range tests {
+		layout := standardLayout()
+		test.edit(layout)
+		err := layout.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: Validate() = %v, want an error about %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestKeyOf(t *testing.T) {
+	layout := standardLayout()
+	for symbol, want := range map[string]string{"ㄅ": "1", "ㄨ": "j", "ˇ": "3", "ˉ": " "} {
+		if key, ok := layout.KeyOf(symbol); !ok || key != want {
+			t.Errorf("KeyOf(%s) = %q, %v, want %q", symbol, key, ok, want)
+		}
+	}
+	if _, ok := layout.KeyOf("a"); ok {
+		t.Error("KeyOf found a key for a non-Zhuyin symbol")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is the minimum level written by logger, adjustable at runtime
+var logLevel = new(slog.LevelVar)
+
+// logger is the leveled, structured logger used throughout the server
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// SetLogLevel sets the minimum log level by name: debug, info, warn or error.
+// Unknown names leave the level unchanged
+func SetLogLevel(name string) {
+	switch strings.ToLower(name) {
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+	case "info":
+		logLevel.Set(slog.LevelInfo)
+	case "warn":
+		logLevel.Set(slog.LevelWarn)
+	case "error":
+		logLevel.Set(slog.LevelError)
+	default:
+		logger.Warn("unknown log level", "level", name)
+	}
+}
@@ -3,21 +3,209 @@ package main
 import (
 	"flag"
 	"fmt"
-	"strconv"
+	"os"
+	"strings"
+	"time"
 )
 
-func main() {
-	fmt.Println("\n********* Initializing Server **********")
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command [command flags]]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  serve     run the IME server (default)")
+	fmt.Fprintln(os.Stderr, "  repl      interactive lookups against the DB")
+	fmt.Fprintln(os.Stderr, "  annotate  annotate Chinese text with Zhuyin/Pinyin")
+	fmt.Fprintln(os.Stderr, "  ruby      add <ruby> readings to an HTML document")
+	fmt.Fprintln(os.Stderr, "  collect   gather Chinese text from HTML/text archives into a corpus")
+	fmt.Fprintln(os.Stderr, "  frequency weighted Zhuyin symbol histograms of a corpus")
+	fmt.Fprintln(os.Stderr, "  simulate  compare the typing effort of layouts on a corpus")
+	fmt.Fprintln(os.Stderr, "  export    write a layout as an XKB, Windows .klc or macOS .keylayout file")
+	fmt.Fprintln(os.Stderr, "  exportdict write the dictionary as a .cin, ibus, fcitx or Rime table")
+	fmt.Fprintln(os.Stderr, "  import    merge .cin and Rime tables into the dictionary")
+	fmt.Fprintln(os.Stderr, "  importdefs store HanDeDict/CFDICT (CEDICT format) definitions in a language")
+	fmt.Fprintln(os.Stderr, "  importdialect store Hokkien or Hakka readings in extended Zhuyin")
+	fmt.Fprintln(os.Stderr, "  importunihan store the Cantonese (Jyutping) readings of Unihan_Readings.txt")
+	fmt.Fprintln(os.Stderr, "  admin     show, add, edit or remove characters and phrases, or list the audit trail")
+	fmt.Fprintln(os.Stderr, "  userdict  import or export a user's own dictionary, as text or .cin")
+	fmt.Fprintln(os.Stderr, "  migrate   apply pending schema migrations, or list them with -status")
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
 
+func main() {
 	dbName := flag.String("db", "main.db", "Path to Chinese character DB")
 	cacheFlag := flag.Bool("cache", true, "Use the cache?")
+	logFlag := flag.String("loglevel", "info", "Minimum log level: debug, info, warn, error")
+	addrFlag := flag.String("addr", ":8081", "Address to listen on")
+	maxConnsFlag := flag.Int("maxconns", 256, "Maximum simultaneous connections, 0 for no limit")
+	rateFlag := flag.Float64("ratelimit", 20, "Requests per second allowed per client, 0 for no limit")
+	burstFlag := flag.Int("burst", 40, "Request burst allowed per client")
+	originsFlag := flag.String("origins", "", "Comma separated list of allowed browser origins, empty for any")
+	dictFlag := flag.String("dict", "", "Address of a DICT server for missing definitions, e.g. localhost:2628")
+	dictNameFlag := flag.String("dictname", "!", "DICT dictionary to use: a name, ! for the first match or * for all")
+	dictTimeoutFlag := flag.Duration("dicttimeout", 2*time.Second, "Timeout of DICT lookups")
+	migrateFlag := flag.Bool("migrate", true, "Apply pending schema migrations on start, otherwise refuse an out of date database")
+	adminTokensFlag := flag.String("admintokens", "", "File of \"user token\" lines allowed to use the admin API, empty to disable it")
+	userTokensFlag := flag.String("usertokens", "", "File of \"user token\" lines of users with their own dictionary, empty for none")
+	layoutsFlag := flag.String("layouts", "", "Directory of additional keyboard layout definitions (*.json)")
+	flag.Usage = usage
 	flag.Parse()
+	SetLogLevel(*logFlag)
+	AutoMigrate = *migrateFlag
+
+	if *layoutsFlag != "" {
+		if err := LoadLayouts(*layoutsFlag); err != nil {
+			logger.Error("unable to load layouts", "dir", *layoutsFlag, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	command, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		command, args = flag.Arg(0), flag.Args()[1:]
+	}
+
+	switch command {
+	case "serve":
+		fmt.Println("\n********* Initializing Server **********")
+
+		var origins []string
+		for _, origin := range strings.Split(*originsFlag, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+
+		var adminTokens map[string]string
+		if *adminTokensFlag != "" {
+			var err error
+			if adminTokens, err = LoadTokens(*adminTokensFlag); err != nil {
+				logger.Error("unable to load the admin tokens", "path", *adminTokensFlag, "err", err)
+				os.Exit(1)
+			}
+		}
+		var userTokens map[string]string
+		if *userTokensFlag != "" {
+			var err error
+			if userTokens, err = LoadTokens(*userTokensFlag); err != nil {
+				logger.Error("unable to load the user tokens", "path", *userTokensFlag, "err", err)
+				os.Exit(1)
+			}
+		}
 
-	ref := NewReference(*dbName, *cacheFlag)
-	InitServer(ref)
-	_, num := ref.GetByChar("我")
-	_, num = ref.GetByPinyin("wo3")
-	_, num = ref.GetByPinyin("wo3")
-	ref.Close()
-	fmt.Println("num" + strconv.Itoa(num))
+		ref := NewReference(*dbName, *cacheFlag)
+		InitServer(ref, ServerConfig{*addrFlag, *maxConnsFlag, *rateFlag, *burstFlag, origins,
+			*dictFlag, *dictNameFlag, *dictTimeoutFlag, adminTokens, userTokens})
+		ref.Close()
+	case "repl":
+		ref := NewReference(*dbName, *cacheFlag)
+		RunRepl(ref, args, os.Stdin, os.Stdout)
+		ref.Close()
+	case "annotate":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunAnnotate(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("annotate failed", "err", err)
+			os.Exit(1)
+		}
+	case "ruby":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunRuby(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("ruby conversion failed", "err", err)
+			os.Exit(1)
+		}
+	case "frequency":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunFrequency(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("frequency analysis failed", "err", err)
+			os.Exit(1)
+		}
+	case "simulate":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunSimulate(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("simulation failed", "err", err)
+			os.Exit(1)
+		}
+	case "collect":
+		if err := RunCollect(args); err != nil {
+			logger.Error("collect failed", "err", err)
+			os.Exit(1)
+		}
+	case "exportdict":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunExportDict(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("dictionary export failed", "err", err)
+			os.Exit(1)
+		}
+	case "import":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunImport(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("import failed", "err", err)
+			os.Exit(1)
+		}
+	case "importdefs":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunImportDefinitions(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("definition import failed", "err", err)
+			os.Exit(1)
+		}
+	case "importdialect":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunImportDialect(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("dialect import failed", "err", err)
+			os.Exit(1)
+		}
+	case "importunihan":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunImportUnihan(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("unihan import failed", "err", err)
+			os.Exit(1)
+		}
+	case "admin":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunAdmin(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("admin failed", "err", err)
+			os.Exit(1)
+		}
+	case "userdict":
+		ref := NewReference(*dbName, *cacheFlag)
+		err := RunUserDict(ref, args)
+		ref.Close()
+		if err != nil {
+			logger.Error("userdict failed", "err", err)
+			os.Exit(1)
+		}
+	case "migrate":
+		if err := RunMigrate(*dbName, args); err != nil {
+			logger.Error("migration failed", "err", err)
+			os.Exit(1)
+		}
+	case "export":
+		if err := RunExport(args); err != nil {
+			logger.Error("export failed", "err", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		usage()
+		os.Exit(2)
+	}
 }
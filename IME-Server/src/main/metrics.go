@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the query latency histogram
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// histogram is a cumulative latency histogram in the Prometheus sense
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// observe records a single latency sample
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// Metrics is an object that collects server statistics and exposes them
+// in the Prometheus text exposition format
+type Metrics struct {
+	lock           sync.Mutex
+	queries        map[string]uint64
+	latency        map[string]*histogram
+	errors         map[string]uint64
+	cacheHits      uint64
+	cacheMisses    uint64
+	dictHits       uint64
+	dictMisses     uint64
+	queueDepth     int64
+	activeSessions int64
+}
+
+// metrics is the process wide statistics collector
+var metrics = NewMetrics()
+
+// NewMetrics returns an empty Metrics object
+func NewMetrics() *Metrics {
+	return &Metrics{
+		queries: make(map[string]uint64),
+		latency: make(map[string]*histogram),
+		errors:  make(map[string]uint64),
+	}
+}
+
+// ObserveQuery counts a query of the given type along with its latency
+func (m *Metrics) ObserveQuery(queryType string, elapsed time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.queries[queryType]++
+	h, ok := m.latency[queryType]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[queryType] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// CacheHit counts a lookup served from the in-memory cache
+func (m *Metrics) CacheHit() {
+	m.lock.Lock()
+	m.cacheHits++
+	m.lock.Unlock()
+}
+
+// CacheMiss counts a lookup that had to go to the DB
+func (m *Metrics) CacheMiss() {
+	m.lock.Lock()
+	m.cacheMisses++
+	m.lock.Unlock()
+}
+
+// DictCacheHit counts a DICT definition served from the definition cache
+func (m *Metrics) DictCacheHit() {
+	m.lock.Lock()
+	m.dictHits++
+	m.lock.Unlock()
+}
+
+// DictCacheMiss counts a definition that had to go to the DICT server
+func (m *Metrics) DictCacheMiss() {
+	m.lock.Lock()
+	m.dictMisses++
+	m.lock.Unlock()
+}
+
+// Error counts an error of the given kind
+func (m *Metrics) Error(kind string) {
+	m.lock.Lock()
+	m.errors[kind]++
+	m.lock.Unlock()
+}
+
+// QueueAdd adjusts the number of requests waiting on the DB thread
+func (m *Metrics) QueueAdd(delta int64) {
+	m.lock.Lock()
+	m.queueDepth += delta
+	m.lock.Unlock()
+}
+
+// SessionAdd adjusts the number of open WebSocket sessions
+func (m *Metrics) SessionAdd(delta int64) {
+	m.lock.Lock()
+	m.activeSessions += delta
+	m.lock.Unlock()
+}
+
+// sortedKeys returns the keys of a label map in a stable order
+func sortedKeys(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelEscaper escapes a label value as the text format asks, which only
+// knows these three escapes
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label returns a label pair for the text format
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// Expose writes all metrics to w in the Prometheus text format
+func (m *Metrics) Expose(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintln(w, "# HELP ime_queries_total Number of lookups by query type.")
+	fmt.Fprintln(w, "# TYPE ime_queries_total counter")
+	for _, queryType := range sortedKeys(m.queries) {
+		fmt.Fprintf(w, "ime_queries_total{%s} %d\n", label("type", queryType), m.queries[queryType])
+	}
+
+	fmt.Fprintln(w, "# HELP ime_query_duration_seconds Lookup latency by query type.")
+	fmt.Fprintln(w, "# TYPE ime_query_duration_seconds histogram")
+	for _, queryType := range sortedKeys(m.queries) {
+		h, typeLabel := m.latency[queryType], label("type", queryType)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "ime_query_duration_seconds_bucket{%s,le=\"%g\"} %d\n", typeLabel, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "ime_query_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", typeLabel, h.count)
+		fmt.Fprintf(w, "ime_query_duration_seconds_sum{%s} %g\n", typeLabel, h.sum)
+		fmt.Fprintf(w, "ime_query_duration_seconds_count{%s} %d\n", typeLabel, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP ime_cache_hits_total Lookups served from the in-memory cache.")
+	fmt.Fprintln(w, "# TYPE ime_cache_hits_total counter")
+	fmt.Fprintf(w, "ime_cache_hits_total %d\n", m.cacheHits)
+	fmt.Fprintln(w, "# HELP ime_cache_misses_total Lookups that went to the database.")
+	fmt.Fprintln(w, "# TYPE ime_cache_misses_total counter")
+	fmt.Fprintf(w, "ime_cache_misses_total %d\n", m.cacheMisses)
+
+	fmt.Fprintln(w, "# HELP ime_dict_cache_hits_total DICT definitions served from the definition cache.")
+	fmt.Fprintln(w, "# TYPE ime_dict_cache_hits_total counter")
+	fmt.Fprintf(w, "ime_dict_cache_hits_total %d\n", m.dictHits)
+	fmt.Fprintln(w, "# HELP ime_dict_cache_misses_total DICT definitions that went to the DICT server.")
+	fmt.Fprintln(w, "# TYPE ime_dict_cache_misses_total counter")
+	fmt.Fprintf(w, "ime_dict_cache_misses_total %d\n", m.dictMisses)
+
+	fmt.Fprintln(w, "# HELP ime_db_queue_depth Requests waiting on the DB thread.")
+	fmt.Fprintln(w, "# TYPE ime_db_queue_depth gauge")
+	fmt.Fprintf(w, "ime_db_queue_depth %d\n", m.queueDepth)
+
+	fmt.Fprintln(w, "# HELP ime_websocket_sessions Open WebSocket sessions.")
+	fmt.Fprintln(w, "# TYPE ime_websocket_sessions gauge")
+	fmt.Fprintf(w, "ime_websocket_sessions %d\n", m.activeSessions)
+
+	fmt.Fprintln(w, "# HELP ime_errors_total Errors by kind.")
+	fmt.Fprintln(w, "# TYPE ime_errors_total counter")
+	for _, kind := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "ime_errors_total{%s} %d\n", label("kind", kind), m.errors[kind])
+	}
+}
+
+// metricsHandler serves the collected metrics
+func (serv *ServerParams) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Expose(w)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleLine matches a sample of the text format: a name, optional labels
+// with escaped values and a number
+var sampleLine = regexp.MustCompile(`^([a-z_]+)(\{[a-z]+="(?:[^"\\\n]|\\[\\"n])*"(?:,[a-z]+="(?:[^"\\\n]|\\[\\"n])*")*\})? [-+0-9.eInf]+$`)
+
+// scrape returns the lines served by metricsHandler
+func scrape(t *testing.T) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	(&ServerParams{}).metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if content := w.Header().Get("Content-Type"); !strings.HasPrefix(content, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", content)
+	}
+	return strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+}
+
+func TestMetricsFormat(t *testing.T) {
+	// the global collector is shared with the other tests, so only samples
+	// of labels no other test uses are checked
+	metrics.ObserveQuery("test", 700*time.Microsecond)
+	metrics.ObserveQuery("test", 300*time.Millisecond)
+	metrics.ObserveQuery("test", 2*time.Second)
+	// only backslash, quote and newline are escaped, a tab is written as is
+	metrics.Error("test \"quoted\" \\ back\nslash\ttab")
+
+	help := make(map[string]bool)
+	types := make(map[string]string)
+	samples := make(map[string]string)
+	for _, line := range scrape(t) {
+		fields := strings.SplitN(line, " ", 4)
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			help[fields[2]] = true
+		case strings.HasPrefix(line, "# TYPE "):
+			if !help[fields[2]] || len(fields) != 4 {
+				t.Errorf("%q is not after the HELP of its metric", line)
+			}
+			types[fields[2]] = fields[3]
+		default:
+			match := sampleLine.FindStringSubmatch(line)
+			if match == nil {
+				t.Errorf("%q is not a sample", line)
+				continue
+			}
+			family := match[1]
+			if types[family] == "" {
+				family = regexp.MustCompile(`_(bucket|sum|count)$`).ReplaceAllString(family, "")
+			}
+			if types[family] == "" {
+				t.Errorf("%q has no TYPE", line)
+			}
+			samples[line[:strings.LastIndex(line, " ")]] = line[strings.LastIndex(line, " ")+1:]
+		}
+	}
+
+	wantTypes := map[string]string{
+		"ime_queries_total": "counter", "ime_query_duration_seconds": "histogram",
+		"ime_cache_hits_total": "counter", "ime_db_queue_depth": "gauge",
+		"ime_websocket_sessions": "gauge", "ime_errors_total": "counter",
+	}
+	for name, want := range wantTypes {
+		if types[name] != want {
+			t.Errorf("TYPE of %s = %q, want %s", name, types[name], want)
+		}
+	}
+
+	// buckets are cumulative, the slowest sample only counts in +Inf
+	want := map[string]string{
+		`ime_queries_total{type="test"}`:                                         "3",
+		`ime_query_duration_seconds_bucket{type="test",le="0.0005"}`:             "0",
+		`ime_query_duration_seconds_bucket{type="test",le="0.001"}`:              "1",
+		`ime_query_duration_seconds_bucket{type="test",le="0.25"}`:               "1",
+		`ime_query_duration_seconds_bucket{type="test",le="0.5"}`:                "2",
+		`ime_query_duration_seconds_bucket{type="test",le="1"}`:                  "2",
+		`ime_query_duration_seconds_bucket{type="test",le="+Inf"}`:               "3",
+		`ime_query_duration_seconds_sum{type="test"}`:                            "2.3007",
+		`ime_query_duration_seconds_count{type="test"}`:                          "3",
+		`ime_errors_total{kind="test \"quoted\" \\ back\nslash` + "\t" + `tab"}`: "1",
+	}
+	for sample, value := range want {
+		if samples[sample] != value {
+			t.Errorf("%s = %q, want %s", sample, samples[sample], value)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"code.google.com/p/gosqlite/sqlite"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Migration is a versioned change to the schema of the database. Apply
+// must also work on databases made before versions were tracked, which
+// may already have some of its tables
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(conn *sqlite.Conn) error
+}
+
+// migrations are the changes to the schema, in version order. Released
+// migrations must never be edited, only followed by new ones
+var migrations = []Migration{
+	{1, "characters and phrases", func(conn *sqlite.Conn) error {
+		return execAll(conn,
+			`CREATE TABLE IF NOT EXISTS characters( id INTEGER PRIMARY KEY AUTOINCREMENT,
+								character VARCHAR(4),
+								zhuyin VARCHAR(12),
+								pinyin VARCHAR(5),
+								tone INTEGER,
+								definition TEXT,
+								freq INT )`,
+			`CREATE TABLE IF NOT EXISTS phrases( id INTEGER PRIMARY KEY AUTOINCREMENT,
+							     character INT,
+							     phrase VARCHAR(50),
+							     definition TEXT,
+							     freq INT )`)
+	}},
+	{2, "definitions per language", func(conn *sqlite.Conn) error {
+		return execAll(conn,
+			`CREATE TABLE IF NOT EXISTS definitions( id INTEGER PRIMARY KEY AUTOINCREMENT,
+								 kind VARCHAR(10),
+								 entry INT,
+								 lang VARCHAR(8),
+								 definition TEXT,
+								 UNIQUE(kind, entry, lang) )`,
+			`CREATE INDEX IF NOT EXISTS definitions_lang ON definitions(lang, kind)`)
+	}},
+	{3, "Hokkien and Hakka readings", func(conn *sqlite.Conn) error {
+		return execAll(conn,
+			`CREATE TABLE IF NOT EXISTS dialect_readings( id INTEGER PRIMARY KEY AUTOINCREMENT,
+								      character VARCHAR(50),
+								      dialect VARCHAR(8),
+								      zhuyin VARCHAR(60),
+								      tone INTEGER,
+								      romanization VARCHAR(60),
+								      definition TEXT,
+								      freq INT )`,
+			`CREATE INDEX IF NOT EXISTS dialect_readings_zhuyin ON dialect_readings(dialect, zhuyin)`)
+	}},
+	{4, "Cantonese readings", func(conn *sqlite.Conn) error {
+		return addColumn(conn, "characters", "jyutping", "VARCHAR(40)")
+	}},
+	{5, "audit trail of admin changes", func(conn *sqlite.Conn) error {
+		return execAll(conn,
+			`CREATE TABLE IF NOT EXISTS audit_log( id INTEGER PRIMARY KEY AUTOINCREMENT,
+							       at TEXT,
+							       user VARCHAR(50),
+							       action VARCHAR(10),
+							       kind VARCHAR(10),
+							       entry INT,
+							       before TEXT,
+							       after TEXT )`)
+	}},
+	{6, "user dictionaries", func(conn *sqlite.Conn) error {
+		return execAll(conn,
+			`CREATE TABLE IF NOT EXISTS user_entries( id INTEGER PRIMARY KEY AUTOINCREMENT,
+								  user VARCHAR(50),
+								  word VARCHAR(50),
+								  reading VARCHAR(120),
+								  zhuyin VARCHAR(12),
+								  tone INTEGER,
+								  weight INT,
+								  UNIQUE(user, word, reading) )`,
+			`CREATE INDEX IF NOT EXISTS user_entries_zhuyin ON user_entries(user, zhuyin)`)
+	}},
+}
+
+// LatestSchemaVersion is the schema version this build works with
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// execAll runs statements in order, stopping at the first that fails
+func execAll(conn *sqlite.Conn, statements ...string) error {
+	for _, statement := range statements {
+		if err := conn.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to a table unless the table already has it
+func addColumn(conn *sqlite.Conn, table, column, decl string) error {
+	stmt, err := conn.Prepare("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(); err != nil {
+		return err
+	}
+	for stmt.Next() {
+		var cid, name, kind, notNull, dflt, pk string
+		if err = stmt.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	return conn.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+}
+
+// hasTable reports whether the database has a table
+func hasTable(conn *sqlite.Conn, table string) (bool, error) {
+	stmt, err := conn.Prepare("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?")
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(table); err != nil {
+		return false, err
+	}
+	return stmt.Next(), nil
+}
+
+// SchemaVersion returns the version of the database schema, 0 for a
+// database no migration was applied to. It never writes to the database
+func SchemaVersion(conn *sqlite.Conn) (int, error) {
+	if ok, err := hasTable(conn, "schema_version"); !ok || err != nil {
+		return 0, err
+	}
+	stmt, err := conn.Prepare("SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(); err != nil {
+		return 0, err
+	}
+	version := 0
+	if stmt.Next() {
+		err = stmt.Scan(&version)
+	}
+	return version, err
+}
+
+// Migrate applies the migrations after the database's version, up to and
+// including target. Each runs in its own transaction, together with the
+// record of its version, so a failed migration leaves the database at the
+// version before it. It returns the migrations applied
+func Migrate(conn *sqlite.Conn, target int) ([]Migration, error) {
+	err := conn.Exec(`CREATE TABLE IF NOT EXISTS schema_version( version INTEGER PRIMARY KEY,
+								  description TEXT,
+								  applied TEXT )`)
+	if err != nil {
+		return nil, err
+	}
+	version, err := SchemaVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this build's %d", version, LatestSchemaVersion())
+	}
+
+	var applied []Migration
+	for _, migration := range migrations {
+		if migration.Version <= version || migration.Version > target {
+			continue
+		}
+		if err = conn.Exec("BEGIN"); err != nil {
+			return applied, err
+		}
+		err = migration.Apply(conn)
+		if err == nil {
+			err = conn.Exec("INSERT INTO schema_version(version, description, applied) VALUES(?, ?, ?)",
+				migration.Version, migration.Description, time.Now().UTC().Format(time.RFC3339))
+		}
+		if err == nil {
+			err = conn.Exec("COMMIT")
+		}
+		if err != nil {
+			conn.Exec("ROLLBACK")
+			metrics.Error("db_migrate")
+			return applied, fmt.Errorf("migration %d (%s): %v", migration.Version, migration.Description, err)
+		}
+		logger.Info("schema migrated", "version", migration.Version, "description", migration.Description)
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// CheckSchema makes sure the database is at the latest schema version,
+// migrating it when auto is set and failing otherwise
+func CheckSchema(conn *sqlite.Conn, auto bool) error {
+	if auto {
+		_, err := Migrate(conn, LatestSchemaVersion())
+		return err
+	}
+	version, err := SchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	if version != LatestSchemaVersion() {
+		return fmt.Errorf("database schema version is %d, this build needs %d: run the migrate command",
+			version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// WriteSchemaStatus lists the migrations with the database's version
+func WriteSchemaStatus(out io.Writer, conn *sqlite.Conn) error {
+	version, err := SchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "schema version %d, latest %d\n", version, LatestSchemaVersion())
+	for _, migration := range migrations {
+		state := "pending"
+		if migration.Version <= version {
+			state = "applied"
+		}
+		fmt.Fprintf(out, "  %3d  %-8s %s\n", migration.Version, state, migration.Description)
+	}
+	return nil
+}
+
+// RunMigrate is the migrate command: it applies the pending migrations to
+// the database, or lists them
+func RunMigrate(dbName string, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := flags.Bool("status", false, "Only list the migrations and the database's version")
+	target := flags.Int("to", LatestSchemaVersion(), "Version to migrate up to")
+	flags.Parse(args)
+
+	conn, err := sqlite.Open(dbName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !*status {
+		applied, err := Migrate(conn, *target)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(os.Stdout, "nothing to migrate")
+		}
+	}
+	return WriteSchemaStatus(os.Stdout, conn)
+}
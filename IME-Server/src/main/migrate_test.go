@@ -0,0 +1,137 @@
+package main
+
+import (
+	"code.google.com/p/gosqlite/sqlite"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// openLegacyDB returns a connection to a database made before versions
+// were tracked: the characters and phrases tables, without jyutping
+func openLegacyDB(t *testing.T) (*sqlite.Conn, string) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "legacy.db")
+	conn, err := sqlite.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	err = execAll(conn,
+		`CREATE TABLE characters( id INTEGER PRIMARY KEY AUTOINCREMENT, character VARCHAR(4), zhuyin VARCHAR(12),
+					  pinyin VARCHAR(5), tone INTEGER, definition TEXT, freq INT )`,
+		`CREATE TABLE phrases( id INTEGER PRIMARY KEY AUTOINCREMENT, character INT, phrase VARCHAR(50),
+				       definition TEXT, freq INT )`,
+		`INSERT INTO characters(character, zhuyin, pinyin, tone, definition, freq) VALUES('我', 'ㄨㄛ', 'wo', 3, 'I, me', 100)`,
+		`INSERT INTO phrases(character, phrase, definition, freq) VALUES(1, '我們', 'we', 80)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, name
+}
+
+// assertNoVersionTable fails the test if the schema_version table exists
+func assertNoVersionTable(t *testing.T, conn *sqlite.Conn, after string) {
+	t.Helper()
+	if ok, err := hasTable(conn, "schema_version"); ok || err != nil {
+		t.Errorf("%s created the schema_version table (%v)", after, err)
+	}
+}
+
+func TestSchemaVersionReadOnly(t *testing.T) {
+	conn, name := openLegacyDB(t)
+	if version, err := SchemaVersion(conn); version != 0 || err != nil {
+		t.Errorf("SchemaVersion = %d, %v, want 0", version, err)
+	}
+	assertNoVersionTable(t, conn, "SchemaVersion")
+	if err := CheckSchema(conn, false); err == nil {
+		t.Error("CheckSchema accepted an unversioned database")
+	}
+	assertNoVersionTable(t, conn, "CheckSchema")
+	if err := WriteSchemaStatus(ioutil.Discard, conn); err != nil {
+		t.Error(err)
+	}
+	assertNoVersionTable(t, conn, "WriteSchemaStatus")
+	if err := RunMigrate(name, []string{"-status"}); err != nil {
+		t.Error(err)
+	}
+	assertNoVersionTable(t, conn, "migrate -status")
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	conn, _ := openLegacyDB(t)
+
+	applied, err := Migrate(conn, 3)
+	if err != nil || len(applied) != 3 {
+		t.Fatalf("Migrate to 3 applied %d, %v", len(applied), err)
+	}
+	if version, _ := SchemaVersion(conn); version != 3 {
+		t.Errorf("version after migrating to 3 = %d", version)
+	}
+	if applied, err = Migrate(conn, LatestSchemaVersion()); err != nil || len(applied) != LatestSchemaVersion()-3 {
+		t.Fatalf("Migrate to latest applied %d, %v", len(applied), err)
+	}
+	if err = CheckSchema(conn, false); err != nil {
+		t.Error(err)
+	}
+	if applied, err = Migrate(conn, LatestSchemaVersion()); err != nil || len(applied) != 0 {
+		t.Errorf("second Migrate applied %d, %v", len(applied), err)
+	}
+
+	// the rows made before the migrations are kept, with the new column
+	stmt, err := conn.Prepare("SELECT character, COALESCE(jyutping, '') FROM characters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	var char, jyutping string
+	if !stmt.Next() || stmt.Scan(&char, &jyutping) != nil || char != "我" {
+		t.Errorf("character row lost in the migration")
+	}
+	for _, table := range []string{"definitions", "dialect_readings", "audit_log", "user_entries"} {
+		if ok, _ := hasTable(conn, table); !ok {
+			t.Errorf("migration did not create %s", table)
+		}
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	conn, _ := openLegacyDB(t)
+	defer func(saved []Migration) { migrations = saved }(migrations)
+	broken := Migration{LatestSchemaVersion() + 1, "broken", func(conn *sqlite.Conn) error {
+		if err := conn.Exec("CREATE TABLE half_done( id INTEGER )"); err != nil {
+			return err
+		}
+		return errors.New("broken")
+	}}
+	migrations = append(append([]Migration{}, migrations...), broken)
+
+	applied, err := Migrate(conn, LatestSchemaVersion())
+	if err == nil || len(applied) != LatestSchemaVersion()-1 {
+		t.Fatalf("Migrate applied %d, %v, want all but the broken one and an error", len(applied), err)
+	}
+	if version, _ := SchemaVersion(conn); version != broken.Version-1 {
+		t.Errorf("version after a failed migration = %d, want %d", version, broken.Version-1)
+	}
+	if ok, _ := hasTable(conn, "half_done"); ok {
+		t.Error("failed migration was not rolled back")
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	conn, _ := openLegacyDB(t)
+	if _, err := Migrate(conn, LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Exec("INSERT INTO schema_version(version, description, applied) VALUES(?, 'future', '')",
+		LatestSchemaVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(conn, LatestSchemaVersion()); err == nil {
+		t.Error("migrated a database newer than the build")
+	}
+}
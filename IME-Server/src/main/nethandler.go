@@ -1,112 +1,406 @@
 package main
 
 import (
+	"code.google.com/p/go.net/netutil"
 	"code.google.com/p/go.net/websocket"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
 	ZHUYIN_QUERY    int = 0
 	PINYIN_QUERY    int = 1
 	DEFINITON_QUERY int = 2
+	CHAR_QUERY      int = 3
+	COMPOSE_QUERY   int = 4
+	DIALECT_QUERY   int = 5
+	JYUTPING_QUERY  int = 6
 )
 
-// Socket is a struct containing WebSocket a connection handle
-type socket struct {
-	io.ReadWriter
-	done chan bool
+const (
+	RESPONSE_OK           int = 0
+	RESPONSE_ERROR        int = 1
+	RESPONSE_RATE_LIMITED int = 2
+)
+
+// shutdownTimeout bounds how long a stopping server waits for the
+// requests in progress
+const shutdownTimeout = 10 * time.Second
+
+// ServerConfig is a struct that holds the listening address and the
+// limits applied to clients
+type ServerConfig struct {
+	Addr      string
+	MaxConns  int
+	RateLimit float64
+	RateBurst int
+
+	// AllowedOrigins lists the browser origins, e.g. https://example.com,
+	// that may use the API. Empty allows any origin
+	AllowedOrigins []string
+
+	// DictAddr is the address of a DICT server filling in missing
+	// definitions, empty for none. DictName selects its dictionary
+	DictAddr    string
+	DictName    string
+	DictTimeout time.Duration
+
+	// AdminTokens holds the admin users by their bearer token. The admin
+	// API is served only when there is at least one
+	AdminTokens map[string]string
+
+	// UserTokens holds the users with a dictionary of their own by their
+	// token. Their words come first in Zhuyin and Pinyin lookups
+	UserTokens map[string]string
 }
 
 // ServerParams is a struct that stores server configuration and handles
 type ServerParams struct {
-	ref *ReferenceStore
+	ref         *ReferenceStore
+	config      ServerConfig
+	limiter     *RateLimiter
+	definitions *DefinitionBackend
+	sockets     *socketSet
+}
+
+// socketSet holds the open WebSocket connections, so that a stopping
+// server can close them and wait for their handlers to return
+type socketSet struct {
+	lock   sync.Mutex
+	conns  map[*websocket.Conn]bool
+	closed bool
+	active sync.WaitGroup
+}
+
+// add registers a connection, returning false once the set is closed. A
+// nil set tracks nothing
+func (s *socketSet) add(ws *websocket.Conn) bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*websocket.Conn]bool)
+	}
+	s.conns[ws] = true
+	s.active.Add(1)
+	return true
+}
+
+// remove forgets a connection whose handler is returning
+func (s *socketSet) remove(ws *websocket.Conn) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	delete(s.conns, ws)
+	s.lock.Unlock()
+	s.active.Done()
+}
+
+// closeAll closes every connection and waits for their handlers
+func (s *socketSet) closeAll() {
+	s.lock.Lock()
+	s.closed = true
+	for ws := range s.conns {
+		ws.Close()
+	}
+	s.lock.Unlock()
+	s.active.Wait()
 }
 
 // Request is a struct that represents the JSON object that is expected
-// to be received by the server as a request
+// to be received by the server as a request. Page and PageSize select a
+// page of candidates, PageSize 0 returning them all at once. For
+// COMPOSE_QUERY, a non-zero PageSize and non-empty SelectionKeys
+// reconfigure the session's composer. RequestID is chosen by the client
+// and echoed back so that it can match responses to requests. More asks
+// for the DICT server's definitions on top of the DB's. Languages lists the
+// preferred definition languages, falling back to English. Dialect is the
+// code of the dialect of DIALECT_QUERY syllables, such as nan or hak, and
+// of the syllables typed by COMPOSE_QUERY keys, Mandarin when empty.
+// Token identifies a user whose own dictionary is merged into lookups
 type Request struct {
-	SessionID string
-	QueryType int
-	Query     string
-	Timestamp int64
+	SessionID     string
+	QueryType     int
+	Query         string
+	Timestamp     int64
+	Page          int
+	PageSize      int
+	SelectionKeys string
+	RequestID     int64
+	More          bool
+	Languages     []string
+	Dialect       string
+	Token         string
 }
 
 // Response is a struct that represents the JSON object that is sent
-// back to the client
+// back to the client. Paging is set for candidate lookups
 type Response struct {
 	SessionID    string
 	ResponseType int
 	Data         interface{}
 	Timestamp    int64
+	Paging       *PageInfo `json:",omitempty"`
+	RequestID    int64     `json:",omitempty"`
+}
+
+// errUnknownQuery is returned for requests of an unknown query type
+var errUnknownQuery = errors.New("unknown query type")
+
+// query dispatches the lookup of a request to the reference store.
+// Definitions are searched in the request's languages, then in English
+func (serv *ServerParams) query(req *Request) (result *[]Character, err error) {
+	switch req.QueryType {
+	case ZHUYIN_QUERY:
+		result, _ = serv.ref.GetByZhuyin(req.Query)
+		zhuyin, tone := serv.ref.SeparatePhonetic(req.Query)
+		result = serv.mergeUserEntries(req, strings.TrimSpace(zhuyin), tone, result)
+	case PINYIN_QUERY:
+		result, _ = serv.ref.GetByPinyin(req.Query)
+		pinyin, tone := serv.ref.SeparatePhonetic(req.Query)
+		if zhuyin, _, ok := PinyinToZhuyin(strings.TrimSpace(pinyin)); ok {
+			result = serv.mergeUserEntries(req, zhuyin, tone, result)
+		}
+	case DEFINITON_QUERY:
+		result, _ = serv.ref.GetByDefinition(req.Query, req.Languages...)
+	case CHAR_QUERY:
+		result, _ = serv.ref.GetByChar(req.Query)
+	case DIALECT_QUERY:
+		result, _, err = serv.ref.GetByDialect(req.Dialect, req.Query)
+	case JYUTPING_QUERY:
+		result, _, err = serv.ref.GetByJyutping(req.Query)
+	default:
+		err = errUnknownQuery
+	}
+	return result, err
 }
 
-// Closes the socket object
-func (s socket) Close() error {
-	s.done <- true
-	return nil
+// mergeUserEntries places the words of the dictionary of the request's
+// user before the candidates read as zhuyin
+func (serv *ServerParams) mergeUserEntries(req *Request, zhuyin string, tone int, result *[]Character) *[]Character {
+	user, ok := tokenUser(req.Token, serv.config.UserTokens)
+	if !ok {
+		return result
+	}
+	merged := serv.ref.MergeUserEntries(user, zhuyin, tone, *result)
+	return &merged
 }
 
-// Handle all GET requests
+// Handle all GET requests: /get/<type>/<query>, or for dialects
+// /get/dialect/<code>/<syllable>
 func (serv *ServerParams) requestHandler(w http.ResponseWriter, r *http.Request) {
+	if !serv.allowRequest(w, r) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	path := strings.Split(r.URL.Path[1:], "/")
-	var returnValue *[]Character
 	if len(path) < 3 {
+		metrics.Error("bad_request")
 		fmt.Fprintf(w, "{code:500}")
 		return
 	}
+	req := &Request{Query: path[2], Languages: ParseLanguages(r.URL.Query().Get("lang")),
+		Token: strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")}
 	switch path[1] {
 	case "zhuyin":
-		returnValue, _ = serv.ref.GetByZhuyin(path[2])
+		req.QueryType = ZHUYIN_QUERY
 	case "pinyin":
-		returnValue, _ = serv.ref.GetByPinyin(path[2])
+		req.QueryType = PINYIN_QUERY
 	case "def":
-		returnValue, _ = serv.ref.GetByDefinition(path[2])
+		req.QueryType = DEFINITON_QUERY
 	case "char":
-		returnValue, _ = serv.ref.GetByChar(path[2])
-	default:
-		{
+		req.QueryType = CHAR_QUERY
+	case "jyutping":
+		req.QueryType = JYUTPING_QUERY
+	case "dialect":
+		// /get/dialect/<code>/<syllable>
+		if len(path) < 4 {
+			metrics.Error("bad_request")
 			fmt.Fprintf(w, "{code:500}")
 			return
 		}
+		req.QueryType, req.Dialect, req.Query = DIALECT_QUERY, path[2], path[3]
+	default:
+		metrics.Error("bad_request")
+		fmt.Fprintf(w, "{code:500}")
+		return
+	}
+	returnValue, err := serv.query(req)
+	if err != nil {
+		metrics.Error("bad_request")
+		logger.Debug("lookup failed", "query", req.Query, "err", err)
+		fmt.Fprintf(w, "{code:500}")
+		return
 	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pagesize"))
+	candidates, paging := paginate(*returnValue, page, pageSize)
+	candidates = serv.ref.Localize(candidates, req.Languages)
+	candidates = serv.definitions.Enrich(candidates, r.URL.Query().Get("more") != "")
 
-	bytearray, _ := json.Marshal(Response{"102", 0, returnValue, 0})
-	fmt.Fprintf(w, string(bytearray))
+	bytearray, _ := json.Marshal(Response{"102", RESPONSE_OK, candidates, 0, paging, 0})
+	w.Write(bytearray)
 }
 
 // errorHandler prints out default error message for GET requests
 func (serv *ServerParams) errorHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.Error("not_found")
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	fmt.Fprintf(w, "{code:500}")
 }
 
-// socketHandler handles WebSocket connections
+// socketHandler handles WebSocket connections. Each message is a JSON
+// encoded Request, answered by a Response carrying the same SessionID
+// and Timestamp. COMPOSE_QUERY requests carry a single key, fed to the
+// composer of their session
 func (serv *ServerParams) socketHandler(ws *websocket.Conn) {
-	s := socket{ws, make(chan bool)}
-	var buffer string
-	fmt.Fscan(s, &buffer)
-	fmt.Println("Received:", buffer)
-	fmt.Fprint(s, "How do you do?")
-	<-s.done
+	if !serv.sockets.add(ws) {
+		return
+	}
+	defer serv.sockets.remove(ws)
+	metrics.SessionAdd(1)
+	defer metrics.SessionAdd(-1)
+	remote := clientIP(ws.Request())
+	composers := NewSessionComposers(serv.ref)
+
+	for {
+		var req Request
+		err := websocket.JSON.Receive(ws, &req)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			metrics.Error("bad_request")
+			logger.Debug("socket receive failed", "remote", remote, "err", err)
+			return
+		}
+		logger.Debug("socket received", "remote", remote, "session", req.SessionID, "type", req.QueryType, "query", req.Query)
+
+		// Limit per client address: session ids are chosen by the client,
+		// so a new one with every message must not get a fresh bucket
+		var resp Response
+		if !serv.limiter.Allow(remote) {
+			metrics.Error("rate_limited")
+			resp = Response{req.SessionID, RESPONSE_RATE_LIMITED, "rate limited", req.Timestamp, nil, req.RequestID}
+		} else if req.QueryType == COMPOSE_QUERY {
+			composer := composers.Get(req.SessionID)
+			user, _ := tokenUser(req.Token, serv.config.UserTokens)
+			composer.SetUser(user)
+			composer.SetPageSize(req.PageSize)
+			if req.SelectionKeys != "" {
+				composer.SetSelectionKeys(req.SelectionKeys)
+			}
+			if err := composer.SetDialect(req.Dialect); err != nil {
+				metrics.Error("bad_request")
+				resp = Response{req.SessionID, RESPONSE_ERROR, err.Error(), req.Timestamp, nil, req.RequestID}
+			} else {
+				resp = Response{req.SessionID, RESPONSE_OK, composer.Key(req.Query), req.Timestamp, nil, req.RequestID}
+			}
+		} else if result, err := serv.query(&req); err == nil {
+			candidates, paging := paginate(*result, req.Page, req.PageSize)
+			candidates = serv.ref.Localize(candidates, req.Languages)
+			candidates = serv.definitions.Enrich(candidates, req.More)
+			resp = Response{req.SessionID, RESPONSE_OK, candidates, req.Timestamp, paging, req.RequestID}
+		} else {
+			metrics.Error("bad_request")
+			resp = Response{req.SessionID, RESPONSE_ERROR, err.Error(), req.Timestamp, nil, req.RequestID}
+		}
+
+		if err = websocket.JSON.Send(ws, resp); err != nil {
+			logger.Debug("socket send failed", "remote", remote, "err", err)
+			return
+		}
+	}
 }
 
-func InitServer(ref *ReferenceStore) {
-	serv := ServerParams{ref}
+// InitServer registers the handlers and serves requests until the
+// listener fails or the process is told to stop. WebSocket connections are
+// closed before it returns, so that the store is no longer in use
+func InitServer(ref *ReferenceStore, config ServerConfig) {
+	serv := ServerParams{ref, config, NewRateLimiter(config.RateLimit, config.RateBurst), nil, &socketSet{}}
+	if config.DictAddr != "" {
+		serv.definitions = NewDefinitionBackend(config.DictAddr, config.DictName, config.DictTimeout)
+	}
 
 	// WebSocket connection handler
-	http.Handle("/socket", websocket.Handler(serv.socketHandler))
+	http.Handle("/socket", websocket.Server{Handshake: serv.checkOrigin, Handler: serv.socketHandler})
 
 	// Old Get request handler
-	http.HandleFunc("/get/", serv.requestHandler)
+	http.HandleFunc("/get/", serv.cors(serv.requestHandler))
+
+	// Text annotation with readings
+	http.HandleFunc("/annotate", serv.cors(serv.annotateHandler))
+
+	// Soft keyboard layouts
+	http.HandleFunc("/layout/", serv.cors(serv.layoutHandler))
+
+	// Dictionary administration
+	if len(config.AdminTokens) > 0 {
+		http.HandleFunc("/admin/", serv.adminHandler)
+	}
+
+	// Users' own dictionaries
+	if len(config.UserTokens) > 0 {
+		http.HandleFunc("/user/dictionary", serv.userDictHandler)
+	}
 
-	// Default not found handler
-	http.HandleFunc("/", serv.errorHandler)
+	// Prometheus metrics
+	http.HandleFunc("/metrics", serv.metricsHandler)
 
-	// Listen and Serve
-	http.ListenAndServe(":8081", nil)
+	// Web frontend, with the default not found handler for anything else
+	http.HandleFunc("/", serv.staticHandler)
+
+	// Listen and Serve, capping the number of simultaneous connections
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		logger.Error("unable to listen", "addr", config.Addr, "err", err)
+		return
+	}
+	if config.MaxConns > 0 {
+		listener = netutil.LimitListener(listener, config.MaxConns)
+	}
+	logger.Info("serving", "addr", config.Addr, "maxconns", config.MaxConns, "ratelimit", config.RateLimit)
+
+	// Stop on SIGINT or SIGTERM, letting the requests in progress finish
+	server := &http.Server{}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	stopped := make(chan bool)
+	go func() {
+		sig := <-stop
+		logger.Info("shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("requests still in progress at shutdown", "err", err)
+		}
+		close(stopped)
+	}()
+
+	if err = server.Serve(listener); err == http.ErrServerClosed {
+		<-stopped
+		logger.Info("server stopped")
+	} else {
+		logger.Error("server stopped", "err", err)
+	}
+	serv.sockets.closeAll()
 }
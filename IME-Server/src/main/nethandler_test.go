@@ -0,0 +1,42 @@
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSocketsClosed(t *testing.T) {
+	serv := &ServerParams{ref: newTestReference(t), limiter: NewRateLimiter(0, 0), sockets: &socketSet{}}
+	server := httptest.NewServer(websocket.Handler(serv.socketHandler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/socket"
+
+	ws, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var resp Response
+	if err = websocket.JSON.Send(ws, Request{QueryType: CHAR_QUERY, Query: "我"}); err == nil {
+		err = websocket.JSON.Receive(ws, &resp)
+	}
+	if err != nil || resp.ResponseType != RESPONSE_OK {
+		t.Fatalf("lookup = %+v, %v", resp, err)
+	}
+
+	// closeAll returns only once the handler has
+	serv.sockets.closeAll()
+	if err = websocket.JSON.Receive(ws, &resp); err == nil {
+		t.Error("connection still open after closeAll")
+	}
+	late, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	if err = websocket.JSON.Receive(late, &resp); err == nil {
+		t.Error("connection accepted after closeAll")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+// defaultPageSize is the number of candidates per page shown by a composer
+// whose client has not asked for a specific size
+const defaultPageSize = 9
+
+// maxPageSize bounds the page size a client may request
+const maxPageSize = 50
+
+// PageInfo describes which slice of a candidate list a response carries
+type PageInfo struct {
+	Page      int
+	PageSize  int
+	PageCount int
+	Total     int
+}
+
+// paginate returns one page of candidates along with its description.
+// A page size of zero or less puts every candidate on a single page, and
+// pages past the end are clamped to the last page
+func paginate(list []Character, page, pageSize int) ([]Character, *PageInfo) {
+	if pageSize <= 0 {
+		pageSize = len(list)
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	if pageSize == 0 {
+		pageSize = 1
+	}
+	info := &PageInfo{
+		PageSize:  pageSize,
+		PageCount: (len(list) + pageSize - 1) / pageSize,
+		Total:     len(list),
+	}
+	if page >= info.PageCount {
+		page = info.PageCount - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+	info.Page = page
+
+	start := page * pageSize
+	end := start + pageSize
+	if end > len(list) {
+		end = len(list)
+	}
+	return list[start:end], info
+}
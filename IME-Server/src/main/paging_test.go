@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+// numbered returns n candidates whose ids are their positions
+func numbered(n int) []Character {
+	list := make([]Character, n)
+	for i := range list {
+		list[i].Id = i
+	}
+	return list
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		total, page, pageSize int
+		first, size           int
+		info                  PageInfo
+	}{
+		{20, 0, 9, 0, 9, PageInfo{0, 9, 3, 20}},
+		{20, 2, 9, 18, 2, PageInfo{2, 9, 3, 20}},
+		{20, 7, 9, 18, 2, PageInfo{2, 9, 3, 20}},
+		{20, -1, 9, 0, 9, PageInfo{0, 9, 3, 20}},
+		{20, 0, 0, 0, 20, PageInfo{0, 20, 1, 20}},
+		{80, 1, 0, 50, 30, PageInfo{1, maxPageSize, 2, 80}},
+		{80, 0, 100, 0, 50, PageInfo{0, maxPageSize, 2, 80}},
+		{0, 0, 9, 0, 0, PageInfo{0, 9, 0, 0}},
+		{0, 0, 0, 0, 0, PageInfo{0, 1, 0, 0}},
+	}
+	for _, test := range tests {
+		page, info := paginate(numbered(test.total), test.page, test.pageSize)
+		if *info != test.info {
+			t.Errorf("paginate(%d, %d, %d) info = %+v, want %+v", test.total, test.page, test.pageSize, *info, test.info)
+		}
+		if len(page) != test.size || len(page) > 0 && page[0].Id != test.first {
+			t.Errorf("paginate(%d, %d, %d) returned %d from %v, want %d from %d",
+				test.total, test.page, test.pageSize, len(page), page, test.size, test.first)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"strings"
+)
+
+// pinyinInitials maps the Pinyin initials to Zhuyin, longest first
+var pinyinInitials = []struct {
+	pinyin string
+	zhuyin string
+}{
+	{"zh", "ㄓ"}, {"ch", "ㄔ"}, {"sh", "ㄕ"},
+	{"b", "ㄅ"}, {"p", "ㄆ"}, {"m", "ㄇ"}, {"f", "ㄈ"}, {"d", "ㄉ"}, {"t", "ㄊ"}, {"n", "ㄋ"}, {"l", "ㄌ"},
+	{"g", "ㄍ"}, {"k", "ㄎ"}, {"h", "ㄏ"}, {"j", "ㄐ"}, {"q", "ㄑ"}, {"x", "ㄒ"},
+	{"r", "ㄖ"}, {"z", "ㄗ"}, {"c", "ㄘ"}, {"s", "ㄙ"},
+}
+
+// pinyinFinals maps the Pinyin finals, in their full spelling without y
+// and w, to Zhuyin
+var pinyinFinals = map[string]string{
+	"a": "ㄚ", "o": "ㄛ", "e": "ㄜ", "ê": "ㄝ", "ai": "ㄞ", "ei": "ㄟ", "ao": "ㄠ", "ou": "ㄡ",
+	"an": "ㄢ", "en": "ㄣ", "ang": "ㄤ", "eng": "ㄥ", "ong": "ㄨㄥ", "er": "ㄦ",
+	"i": "ㄧ", "ia": "ㄧㄚ", "io": "ㄧㄛ", "ie": "ㄧㄝ", "iai": "ㄧㄞ", "iao": "ㄧㄠ", "iou": "ㄧㄡ",
+	"ian": "ㄧㄢ", "in": "ㄧㄣ", "iang": "ㄧㄤ", "ing": "ㄧㄥ", "iong": "ㄩㄥ",
+	"u": "ㄨ", "ua": "ㄨㄚ", "uo": "ㄨㄛ", "uai": "ㄨㄞ", "uei": "ㄨㄟ", "uan": "ㄨㄢ", "uen": "ㄨㄣ",
+	"uang": "ㄨㄤ", "ueng": "ㄨㄥ",
+	"ü": "ㄩ", "üe": "ㄩㄝ", "üan": "ㄩㄢ", "ün": "ㄩㄣ",
+}
+
+// pinyinContractions are the finals shortened after an initial
+var pinyinContractions = map[string]string{"iu": "iou", "ui": "uei", "un": "uen"}
+
+// pinyinSpellings are the spellings of finals without an initial
+var pinyinSpellings = map[string]string{
+	"yi": "i", "ya": "ia", "yo": "io", "ye": "ie", "yai": "iai", "yao": "iao", "you": "iou",
+	"yan": "ian", "yin": "in", "yang": "iang", "ying": "ing", "yong": "iong",
+	"wu": "u", "wa": "ua", "wo": "uo", "wai": "uai", "wei": "uei", "wan": "uan", "wen": "uen",
+	"wang": "uang", "weng": "ueng",
+	"yu": "ü", "yue": "üe", "yuan": "üan", "yun": "ün",
+}
+
+// pinyinToneVowels maps the vowels carrying a tone diacritic to the bare
+// vowel and the tone
+var pinyinToneVowels = map[rune]struct {
+	vowel rune
+	tone  int
+}{
+	'ā': {'a', 1}, 'á': {'a', 2}, 'ǎ': {'a', 3}, 'à': {'a', 4},
+	'ē': {'e', 1}, 'é': {'e', 2}, 'ě': {'e', 3}, 'è': {'e', 4},
+	'ī': {'i', 1}, 'í': {'i', 2}, 'ǐ': {'i', 3}, 'ì': {'i', 4},
+	'ō': {'o', 1}, 'ó': {'o', 2}, 'ǒ': {'o', 3}, 'ò': {'o', 4},
+	'ū': {'u', 1}, 'ú': {'u', 2}, 'ǔ': {'u', 3}, 'ù': {'u', 4},
+	'ǖ': {'ü', 1}, 'ǘ': {'ü', 2}, 'ǚ': {'ü', 3}, 'ǜ': {'ü', 4},
+}
+
+// zhuyinInitials and zhuyinFinals are the reverse of the Pinyin tables
+var zhuyinInitials, zhuyinFinals = map[string]string{}, map[string]string{}
+
+func init() {
+	for _, initial := range pinyinInitials {
+		zhuyinInitials[initial.zhuyin] = initial.pinyin
+	}
+	for pinyin, zhuyin := range pinyinFinals {
+		// ㄨㄥ is ong after an initial and ueng on its own
+		if pinyin != "ueng" {
+			zhuyinFinals[zhuyin] = pinyin
+		}
+	}
+}
+
+// splitPinyinTone separates a Pinyin syllable from its tone, given as a
+// trailing digit or a diacritic. The tone is -1 when none is given
+func splitPinyinTone(syllable string) (string, int) {
+	syllable = strings.ToLower(strings.TrimSpace(syllable))
+	syllable = strings.Replace(syllable, "u:", "ü", -1)
+	syllable = strings.Replace(syllable, "v", "ü", -1)
+
+	tone := -1
+	if n := len(syllable); n > 1 && syllable[n-1] >= '1' && syllable[n-1] <= '5' {
+		tone = int(syllable[n-1] - '0')
+		syllable = syllable[:n-1]
+	}
+	var bare []rune
+	for _, r := range syllable {
+		if marked, ok := pinyinToneVowels[r]; ok {
+			r, tone = marked.vowel, marked.tone
+		}
+		bare = append(bare, r)
+	}
+	return string(bare), tone
+}
+
+// PinyinToZhuyin converts a Hanyu Pinyin syllable, with a tone digit, a
+// tone diacritic or no tone, to Zhuyin. It returns false if the syllable
+// is not valid Pinyin. The tone is -1 when none is given
+func PinyinToZhuyin(syllable string) (string, int, bool) {
+	syllable, tone := splitPinyinTone(syllable)
+	if syllable == "" {
+		return "", tone, false
+	}
+
+	initial, final := "", syllable
+	for _, candidate := range pinyinInitials {
+		if strings.HasPrefix(syllable, candidate.pinyin) && len(syllable) > len(candidate.pinyin) {
+			initial, final = candidate.zhuyin, syllable[len(candidate.pinyin):]
+			break
+		}
+	}
+
+	if initial == "" {
+		if full, ok := pinyinSpellings[final]; ok {
+			final = full
+		}
+	} else {
+		// ü is written u after j, q and x, so jun is jün and not juen
+		if strings.HasPrefix(final, "u") && strings.Contains("ㄐㄑㄒ", initial) {
+			final = "ü" + final[1:]
+		}
+		if full, ok := pinyinContractions[final]; ok {
+			final = full
+		}
+		// the empty final of zhi, chi, shi, ri, zi, ci and si
+		if final == "i" && strings.Contains("ㄓㄔㄕㄖㄗㄘㄙ", initial) {
+			return initial, tone, true
+		}
+	}
+
+	zhuyin, ok := pinyinFinals[final]
+	if !ok {
+		return "", tone, false
+	}
+	return initial + zhuyin, tone, true
+}
+
+// ZhuyinToPinyin converts a Zhuyin syllable without tone to toneless
+// Hanyu Pinyin. It returns false if the syllable is not valid Zhuyin
+func ZhuyinToPinyin(zhuyin string) (string, bool) {
+	var symbols []string
+	for _, r := range zhuyin {
+		if isZhuyin(string(r)) {
+			symbols = append(symbols, string(r))
+		}
+	}
+	if len(symbols) == 0 {
+		return "", false
+	}
+
+	initial, ok := zhuyinInitials[symbols[0]]
+	if ok {
+		symbols = symbols[1:]
+	}
+	final := strings.Join(symbols, "")
+	if final == "" {
+		switch initial {
+		case "zh", "ch", "sh", "r", "z", "c", "s":
+			return initial + "i", true
+		}
+		return "", false
+	}
+
+	pinyin, ok := zhuyinFinals[final]
+	if !ok {
+		return "", false
+	}
+	if initial == "" {
+		if final == "ㄨㄥ" {
+			return "weng", true
+		}
+		for spelling, full := range pinyinSpellings {
+			if full == pinyin {
+				return spelling, true
+			}
+		}
+		return pinyin, true
+	}
+	for short, full := range pinyinContractions {
+		if full == pinyin {
+			pinyin = short
+		}
+	}
+	if strings.HasPrefix(pinyin, "ü") && strings.Contains("jqx", initial) {
+		pinyin = "u" + strings.TrimPrefix(pinyin, "ü")
+	}
+	return initial + pinyin, true
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestPinyinToZhuyin(t *testing.T) {
+	tests := []struct {
+		pinyin string
+		zhuyin string
+		tone   int
+	}{
+		{"wo3", "ㄨㄛ", 3},
+		{"wǒ", "ㄨㄛ", 3},
+		{"wo", "ㄨㄛ", -1},
+		{"zhi1", "ㄓ", 1},
+		{"si4", "ㄙ", 4},
+		{"ju2", "ㄐㄩ", 2},
+		{"lv4", "ㄌㄩ", 4},
+		{"nu:3", "ㄋㄩ", 3},
+		{"yuan2", "ㄩㄢ", 2},
+		{"hang2", "ㄏㄤ", 2},
+		{"xing2", "ㄒㄧㄥ", 2},
+		{"men5", "ㄇㄣ", 5},
+		{"gui4", "ㄍㄨㄟ", 4},
+		{"liu2", "ㄌㄧㄡ", 2},
+		{"lun2", "ㄌㄨㄣ", 2},
+		{"jun4", "ㄐㄩㄣ", 4},
+		{"qun2", "ㄑㄩㄣ", 2},
+		{"xun2", "ㄒㄩㄣ", 2},
+		{"xue2", "ㄒㄩㄝ", 2},
+		{"juan4", "ㄐㄩㄢ", 4},
+		{"er2", "ㄦ", 2},
+		{"a1", "ㄚ", 1},
+	}
+	for _, test := range tests {
+		zhuyin, tone, ok := PinyinToZhuyin(test.pinyin)
+		if !ok || zhuyin != test.zhuyin || tone != test.tone {
+			t.Errorf("PinyinToZhuyin(%s) = %s, %d, %v, want %s, %d", test.pinyin, zhuyin, tone, ok, test.zhuyin, test.tone)
+		}
+	}
+	for _, bad := range []string{"", "xyz", "q", "zh"} {
+		if zhuyin, _, ok := PinyinToZhuyin(bad); ok {
+			t.Errorf("PinyinToZhuyin(%q) = %s, want failure", bad, zhuyin)
+		}
+	}
+}
+
+func TestZhuyinToPinyin(t *testing.T) {
+	for zhuyin, want := range map[string]string{"ㄨㄛ": "wo", "ㄓ": "zhi", "ㄐㄩ": "ju", "ㄌㄩ": "lü", "ㄧㄣ": "yin", "ㄍㄨㄟ": "gui"} {
+		if pinyin, ok := ZhuyinToPinyin(zhuyin); !ok || pinyin != want {
+			t.Errorf("ZhuyinToPinyin(%s) = %s, %v, want %s", zhuyin, pinyin, ok, want)
+		}
+	}
+}
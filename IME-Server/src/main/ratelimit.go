@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bucketIdleTimeout is how long an unused token bucket is kept around
+const bucketIdleTimeout = 10 * time.Minute
+
+// tokenBucket is the rate limiting state of a single client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is an object that enforces a token bucket rate limit
+// per client key, its IP address. now is the clock, replaced in tests
+type RateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewRateLimiter returns a limiter that refills rate tokens per second up to
+// burst tokens. A rate of zero or less disables limiting
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key, returning false if it is empty
+func (rl *RateLimiter) Allow(key string) bool {
+	if rl == nil || rl.rate <= 0 {
+		return true
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{rl.burst, now}
+		rl.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rl.rate
+	if bucket.tokens > rl.burst {
+		bucket.tokens = rl.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweep drops buckets that have not been used recently, so that the map
+// does not grow with every client ever seen. Called with the lock held
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < bucketIdleTimeout {
+		return
+	}
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) > bucketIdleTimeout {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// clientIP extracts the address of the remote client from a request.
+// X-Forwarded-For is ignored, as any client can set it to get a new bucket
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowRequest applies the rate limit to an HTTP API request, answering it
+// with a rate limited response and returning false if the client is over
+// its limit
+func (serv *ServerParams) allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	if serv.limiter.Allow(clientIP(r)) {
+		return true
+	}
+	metrics.Error("rate_limited")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	bytearray, _ := json.Marshal(Response{"", RESPONSE_RATE_LIMITED, "rate limited", 0, nil, 0})
+	w.Write(bytearray)
+	return false
+}
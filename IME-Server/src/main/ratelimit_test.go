@@ -0,0 +1,170 @@
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLimiter returns a limiter whose clock only moves when the returned
+// time is changed
+func fakeLimiter(rate float64, burst int) (*RateLimiter, *time.Time) {
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(rate, burst)
+	rl.lastSweep = clock
+	rl.now = func() time.Time { return clock }
+	return rl, &clock
+}
+
+// allowed returns how many of n requests of key are allowed
+func allowed(rl *RateLimiter, key string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if rl.Allow(key) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	rl, clock := fakeLimiter(2, 3)
+	if n := allowed(rl, "10.0.0.1", 5); n != 3 {
+		t.Errorf("%d requests allowed at once, want the burst of 3", n)
+	}
+	*clock = clock.Add(time.Second)
+	if n := allowed(rl, "10.0.0.1", 5); n != 2 {
+		t.Errorf("%d requests allowed after a second, want the 2 refilled", n)
+	}
+	*clock = clock.Add(250 * time.Millisecond)
+	if n := allowed(rl, "10.0.0.1", 5); n != 0 {
+		t.Errorf("%d requests allowed after a quarter second, want half a token", n)
+	}
+	*clock = clock.Add(250 * time.Millisecond)
+	if n := allowed(rl, "10.0.0.1", 5); n != 1 {
+		t.Errorf("%d requests allowed after half a second, want 1", n)
+	}
+	// a long pause refills no more than the burst
+	*clock = clock.Add(time.Minute)
+	if n := allowed(rl, "10.0.0.1", 5); n != 3 {
+		t.Errorf("%d requests allowed after a minute, want the burst of 3", n)
+	}
+
+	// every key has its own bucket
+	if n := allowed(rl, "10.0.0.2", 5); n != 3 {
+		t.Errorf("%d requests allowed for another client, want 3", n)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl, clock := fakeLimiter(1, 1)
+	rl.Allow("10.0.0.1")
+	*clock = clock.Add(bucketIdleTimeout / 2)
+	rl.Allow("10.0.0.2")
+	*clock = clock.Add(bucketIdleTimeout/2 + time.Second)
+	rl.Allow("10.0.0.3")
+	if _, ok := rl.buckets["10.0.0.1"]; ok || len(rl.buckets) != 2 {
+		t.Errorf("buckets after the sweep = %v, want the idle one dropped", rl.buckets)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	var none *RateLimiter
+	for _, rl := range []*RateLimiter{none, NewRateLimiter(0, 1)} {
+		if n := allowed(rl, "10.0.0.1", 100); n != 100 {
+			t.Errorf("%d of 100 requests allowed without a limit", n)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+		{"192.0.2.1", "", "192.0.2.1"},
+		// X-Forwarded-For is chosen by the client and is not trusted
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/get/zhuyin/a", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := clientIP(r); got != test.want {
+			t.Errorf("clientIP(%s, X-Forwarded-For %q) = %q, want %q", test.remote, test.forwarded, got, test.want)
+		}
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	rl, _ := fakeLimiter(1, 1)
+	serv := &ServerParams{limiter: rl}
+	request := func(remote, forwarded string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/get/zhuyin/a", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		serv.allowRequest(w, r)
+		return w
+	}
+	if w := request("192.0.2.1:1000", "198.51.100.1"); w.Code != http.StatusOK {
+		t.Fatalf("first request = %d", w.Code)
+	}
+	// another port and another forwarded address share the bucket
+	w := request("192.0.2.1:2000", "198.51.100.2")
+	var resp Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusTooManyRequests || resp.ResponseType != RESPONSE_RATE_LIMITED {
+		t.Errorf("second request = %d %s", w.Code, w.Body.String())
+	}
+	if w = request("192.0.2.2:1000", ""); w.Code != http.StatusOK {
+		t.Errorf("request of another client = %d", w.Code)
+	}
+}
+
+func TestSocketRateLimit(t *testing.T) {
+	rl, _ := fakeLimiter(1, 2)
+	serv := &ServerParams{ref: newTestReference(t), limiter: rl, sockets: &socketSet{}}
+	server := httptest.NewServer(websocket.Handler(serv.socketHandler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/socket"
+
+	lookup := func(ws *websocket.Conn, session string) int {
+		var resp Response
+		err := websocket.JSON.Send(ws, Request{SessionID: session, QueryType: CHAR_QUERY, Query: "我"})
+		if err == nil {
+			err = websocket.JSON.Receive(ws, &resp)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.ResponseType
+	}
+	// a new session id, or a new connection, does not get a new bucket
+	first, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	got := []int{lookup(first, "a"), lookup(first, "b"), lookup(first, "c"), lookup(second, "d")}
+	want := []int{RESPONSE_OK, RESPONSE_OK, RESPONSE_RATE_LIMITED, RESPONSE_RATE_LIMITED}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("responses = %v, want %v", got, want)
+			break
+		}
+	}
+}
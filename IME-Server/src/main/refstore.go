@@ -1,19 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"code.google.com/p/gosqlite/sqlite"
-	"encoding/gob"
-	"fmt"
-	"io/ioutil"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // Character is an object that stores a Chinese character
-// along with its various properties- pinyin, zhuyin, definition
+// along with its various properties- pinyin, zhuyin, definition.
+// Jyutping lists its Cantonese readings, separated by spaces
 type Character struct {
 	Id         int
 	Character  string
@@ -22,6 +21,7 @@ type Character struct {
 	Tone       int
 	Definition string
 	Freq       int
+	Jyutping   string
 }
 
 // Phrase is an object that stores a Chinese language phrase string
@@ -36,9 +36,11 @@ type Phrase struct {
 
 // CharLookupRequest is an object that contains a partially filled out
 // character object. It is sent as a query to the DB thread to fetch
-// full character candidates
+// full character candidates. A definition is searched in Language, or in
+// the base definitions when it is empty
 type CharLookupRequest struct {
 	Char      Character
+	Language  string
 	WriteBack chan *CharLookupResponse
 }
 
@@ -49,61 +51,142 @@ type CharLookupResponse struct {
 	NumResults int
 }
 
+// PhraseLookupRequest is an object that asks the DB thread for the phrases
+// in which a character, identified by its row id, takes part
+type PhraseLookupRequest struct {
+	CharacterId int
+	WriteBack   chan []Phrase
+}
+
+// DictionaryDump is the full content of the characters and phrases tables
+type DictionaryDump struct {
+	Characters []Character
+	Phrases    []Phrase
+}
+
+// DumpRequest is an object that asks the DB thread for a DictionaryDump
+type DumpRequest struct {
+	WriteBack chan *DictionaryDump
+}
+
 // ReferenceStore is an object that serves as an in-memory cache for the DB,
-// holds the handle for the DB connection, and holds the request queue channel
-// for character lookup by the DB thread
+// holds the handle for the DB connection, and holds the request queue channels
+// for character and phrase lookup by the DB thread
 type ReferenceStore struct {
-	conn         *sqlite.Conn
-	requestQueue chan *CharLookupRequest
-	GlobalCache  map[string]*CharLookupResponse
+	conn                *sqlite.Conn
+	requestQueue        chan *CharLookupRequest
+	phraseQueue         chan *PhraseLookupRequest
+	dumpQueue           chan *DumpRequest
+	importQueue         chan *ImportRequest
+	definitionQueue     chan *DefinitionsRequest
+	translationQueue    chan *TranslationImportRequest
+	dialectQueue        chan *DialectLookupRequest
+	dialectImportQueue  chan *DialectImportRequest
+	jyutpingQueue       chan *JyutpingLookupRequest
+	jyutpingImportQueue chan *JyutpingImportRequest
+	adminQueue          chan *AdminRequest
+	userDictQueue       chan *UserDictRequest
+	GlobalCache         map[string]*CharLookupResponse
+	dbName              string
+	done                chan bool
+	useCache            bool
 }
 
-// GetByChar retrieves full candidate characters, given a UTF-8 Chinese character
-func (ref ReferenceStore) GetByChar(char string) (*[]Character, int) {
+// lookup sends a partially filled out character to the DB thread and waits
+// for the candidates, recording the query type and latency
+func (ref ReferenceStore) lookup(queryType string, queryInfo Character, language string) *CharLookupResponse {
+	start := time.Now()
 	writeBack := make(chan *CharLookupResponse)
-	char = strings.TrimSpace(char)
-	queryInfo := Character{-1, char, "", "", -1, "", -1}
-	ref.requestQueue <- &CharLookupRequest{queryInfo, writeBack}
+	metrics.QueueAdd(1)
+	ref.requestQueue <- &CharLookupRequest{queryInfo, language, writeBack}
 	response := <-writeBack
+	metrics.QueueAdd(-1)
+	metrics.ObserveQuery(queryType, time.Since(start))
+	return response
+}
+
+// GetByChar retrieves full candidate characters, given a UTF-8 Chinese
+// character. Two or more characters are looked up in the phrases, each
+// candidate carrying the phrase row's id, text, definition and frequency
+func (ref ReferenceStore) GetByChar(char string) (*[]Character, int) {
+	char = strings.TrimSpace(char)
+	queryInfo := Character{-1, char, "", "", -1, "", -1, ""}
+	response := ref.lookup("char", queryInfo, "")
 	return &response.CharList, response.NumResults
 }
 
 // GetByZhuyin retrieves full candidate characters, given a UTF-8 zhuyin string
 func (ref ReferenceStore) GetByZhuyin(zhuyin string) (*[]Character, int) {
 	zhuyin, tone := ref.SeparatePhonetic(zhuyin)
-	writeBack := make(chan *CharLookupResponse)
 	zhuyin = strings.TrimSpace(zhuyin)
 	// take last character and see if number. If so, it's the tone
-	queryInfo := Character{-1, "", zhuyin, "", tone, "", -1}
-	ref.requestQueue <- &CharLookupRequest{queryInfo, writeBack}
-	response := <-writeBack
+	queryInfo := Character{-1, "", zhuyin, "", tone, "", -1, ""}
+	response := ref.lookup("zhuyin", queryInfo, "")
 	return &response.CharList, response.NumResults
 }
 
 // GetByZhuyin retrieves full candidate characters, given a pinyin string
 func (ref ReferenceStore) GetByPinyin(pinyin string) (*[]Character, int) {
 	pinyin, tone := ref.SeparatePhonetic(pinyin)
-	writeBack := make(chan *CharLookupResponse)
 	pinyin = strings.TrimSpace(pinyin)
-	queryInfo := Character{-1, "", "", pinyin, tone, "", -1}
-	ref.requestQueue <- &CharLookupRequest{queryInfo, writeBack}
-	response := <-writeBack
+	queryInfo := Character{-1, "", "", pinyin, tone, "", -1, ""}
+	response := ref.lookup("pinyin", queryInfo, "")
 	return &response.CharList, response.NumResults
 }
 
-// GetByDefinition retreives full candidate characters, given an English definition
-func (ref ReferenceStore) GetByDefinition(definition string) (*[]Character, int) {
-	writeBack := make(chan *CharLookupResponse)
+// GetByDefinition retreives full candidate characters, given a definition.
+// It is searched in each of languages in turn, then in the base English
+// definitions, until one has candidates. Each language is searched once
+func (ref ReferenceStore) GetByDefinition(definition string, languages ...string) (*[]Character, int) {
 	definition = strings.TrimSpace(definition)
-	queryInfo := Character{-1, "", "", "", -1, definition, -1}
-	ref.requestQueue <- &CharLookupRequest{queryInfo, writeBack}
-	response := <-writeBack
+	queryInfo := Character{-1, "", "", "", -1, definition, -1, ""}
+	var response *CharLookupResponse
+	searched := make(map[string]bool)
+	for _, language := range append(append([]string{}, languages...), baseLanguage) {
+		if searched[language] {
+			continue
+		}
+		searched[language] = true
+		if language == baseLanguage {
+			language = ""
+		}
+		if response = ref.lookup("definition", queryInfo, language); response.NumResults > 0 {
+			break
+		}
+	}
 	return &response.CharList, response.NumResults
 }
 
+// GetPhrasesByCharacter retrieves the phrases linked to a character row,
+// that is the phrases in which the character takes that row's reading
+func (ref ReferenceStore) GetPhrasesByCharacter(id int) []Phrase {
+	start := time.Now()
+	writeBack := make(chan []Phrase)
+	metrics.QueueAdd(1)
+	ref.phraseQueue <- &PhraseLookupRequest{id, writeBack}
+	phrases := <-writeBack
+	metrics.QueueAdd(-1)
+	metrics.ObserveQuery("phrase", time.Since(start))
+	return phrases
+}
+
+// Dump retrieves every character and phrase, for bulk exports
+func (ref ReferenceStore) Dump() *DictionaryDump {
+	start := time.Now()
+	writeBack := make(chan *DictionaryDump)
+	metrics.QueueAdd(1)
+	ref.dumpQueue <- &DumpRequest{writeBack}
+	dump := <-writeBack
+	metrics.QueueAdd(-1)
+	metrics.ObserveQuery("dump", time.Since(start))
+	return dump
+}
+
 // GetToneFromPhonetic extracts the numerical tone from pinyin/zhuyin
 // Thus, this doesn't work with accented text or with encodings that have
-// characters within the range of ascii numbers
+// characters within the range of ascii numbers. It reads Mandarin only:
+// dialect syllables, with their own symbols, tone marks and checked tones,
+// are separated and validated by Dialect.Syllable
 func (ref ReferenceStore) SeparatePhonetic(input string) (string, int) {
 	// Match anything that is not 0-9 up to a maximum of 12 characters
 	// (3 UTF-8 Zhuyin characters = 3 x 4 bytes = 12 chars)
@@ -128,30 +211,45 @@ func (ref ReferenceStore) Get(partialChar Character) *CharLookupResponse {
 		toneString = strconv.Itoa(partialChar.Tone)
 	}
 
+	if utf8.RuneCountInString(partialChar.Character) > 1 {
+		return ref.GetPhraseCandidates(partialChar.Character)
+	}
+
 	// first, check the cache
 	if val, ok := ref.GlobalCache[partialChar.Zhuyin+toneString]; ok {
+		metrics.CacheHit()
 		return val
 	}
 	if val, ok := ref.GlobalCache[partialChar.Pinyin+toneString]; ok {
+		metrics.CacheHit()
 		return val
 	}
+	metrics.CacheMiss()
 
-	searchStmt, _ := ref.conn.Prepare(`SELECT * FROM characters WHERE
+	searchStmt, err := ref.conn.Prepare(`SELECT id, character, zhuyin, pinyin, tone, definition, freq,
+						COALESCE(jyutping, '') FROM characters WHERE
 						character LIKE ? AND
 						zhuyin LIKE ? AND
 						pinyin LIKE ? AND
 						tone LIKE ? AND
 						definition LIKE ?
 						ORDER BY freq DESC LIMIT 50`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare character search", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	defer searchStmt.Finalize()
 
-	err := searchStmt.Exec(
+	err = searchStmt.Exec(
 		"%"+partialChar.Character+"%",
 		"%"+partialChar.Zhuyin+"%",
 		"%"+partialChar.Pinyin+"%",
 		"%"+toneString+"%",
 		"%"+partialChar.Definition+"%")
 	if err != nil {
-		fmt.Println("Error while Selecting: %s", err)
+		metrics.Error("db_select")
+		logger.Error("error while selecting", "err", err)
 	}
 
 	var charList []Character
@@ -163,21 +261,24 @@ func (ref ReferenceStore) Get(partialChar Character) *CharLookupResponse {
 			&resultChar.Pinyin,
 			&resultChar.Tone,
 			&resultChar.Definition,
-			&resultChar.Freq)
+			&resultChar.Freq,
+			&resultChar.Jyutping)
 		if err != nil {
-			fmt.Printf("Error while getting row data: %s\n", err)
-			os.Exit(1)
+			metrics.Error("db_scan")
+			logger.Error("error while getting row data", "err", err)
+			continue
 		}
 
-		fmt.Printf("Id => %d\n", resultChar.Id)
-		fmt.Printf("Title => %s\n", resultChar.Character)
+		logger.Debug("row", "id", resultChar.Id, "character", resultChar.Character)
 		charList = append(charList, resultChar)
 	}
 
 	var response = &CharLookupResponse{charList, len(charList)}
 
-	// Cache results, if there are any
-	if len(charList) > 0 {
+	// Cache results of reading lookups, if there are any. Character and
+	// definition lookups are not keyed by reading and are never cached
+	isReadingQuery := partialChar.Character == "" && partialChar.Definition == ""
+	if len(charList) > 0 && isReadingQuery {
 		var firstChar Character
 		firstChar = charList[0]
 
@@ -199,54 +300,211 @@ func (ref ReferenceStore) Get(partialChar Character) *CharLookupResponse {
 	return response
 }
 
+// GetPhrases is the base phrase lookup function called only by the DB thread
+func (ref ReferenceStore) GetPhrases(characterId int) ([]Phrase, error) {
+	searchStmt, err := ref.conn.Prepare(`SELECT id, character, phrase, COALESCE(definition, ''), COALESCE(freq, 0)
+						FROM phrases WHERE character = ?
+						ORDER BY freq DESC`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare phrase search", "err", err)
+		return nil, err
+	}
+	defer searchStmt.Finalize()
+
+	if err = searchStmt.Exec(characterId); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while selecting phrases", "err", err)
+		return nil, err
+	}
+
+	var phrases []Phrase
+	for searchStmt.Next() {
+		var phrase Phrase
+		err = searchStmt.Scan(&phrase.Id, &phrase.Character, &phrase.Phrase, &phrase.Definition, &phrase.Freq)
+		if err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting phrase data", "err", err)
+			continue
+		}
+		phrases = append(phrases, phrase)
+	}
+	return phrases, nil
+}
+
+// GetPhraseCandidates is the base phrase text lookup function called only
+// by the DB thread
+func (ref ReferenceStore) GetPhraseCandidates(phrase string) *CharLookupResponse {
+	searchStmt, err := ref.conn.Prepare(`SELECT id, phrase, COALESCE(definition, ''), COALESCE(freq, 0)
+						FROM phrases WHERE phrase = ?
+						ORDER BY freq DESC LIMIT 50`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare phrase search", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	defer searchStmt.Finalize()
+
+	if err = searchStmt.Exec(phrase); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while selecting phrases", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+
+	var charList []Character
+	for searchStmt.Next() {
+		var candidate Character
+		err = searchStmt.Scan(&candidate.Id, &candidate.Character, &candidate.Definition, &candidate.Freq)
+		if err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting phrase data", "err", err)
+			continue
+		}
+		charList = append(charList, candidate)
+	}
+	return &CharLookupResponse{charList, len(charList)}
+}
+
+// GetAll is the base dump function called only by the DB thread
+func (ref ReferenceStore) GetAll() *DictionaryDump {
+	dump := &DictionaryDump{}
+	charStmt, err := ref.conn.Prepare(`SELECT id, character, COALESCE(zhuyin, ''), COALESCE(pinyin, ''),
+						COALESCE(tone, 0), COALESCE(definition, ''), COALESCE(freq, 0), COALESCE(jyutping, '')
+						FROM characters ORDER BY id`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare character dump", "err", err)
+		return dump
+	}
+	defer charStmt.Finalize()
+	if err = charStmt.Exec(); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while dumping characters", "err", err)
+		return dump
+	}
+	for charStmt.Next() {
+		var c Character
+		err = charStmt.Scan(&c.Id, &c.Character, &c.Zhuyin, &c.Pinyin, &c.Tone, &c.Definition, &c.Freq, &c.Jyutping)
+		if err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting row data", "err", err)
+			continue
+		}
+		dump.Characters = append(dump.Characters, c)
+	}
+
+	phraseStmt, err := ref.conn.Prepare(`SELECT id, character, phrase, COALESCE(definition, ''), COALESCE(freq, 0)
+						FROM phrases ORDER BY id`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare phrase dump", "err", err)
+		return dump
+	}
+	defer phraseStmt.Finalize()
+	if err = phraseStmt.Exec(); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while dumping phrases", "err", err)
+		return dump
+	}
+	for phraseStmt.Next() {
+		var phrase Phrase
+		err = phraseStmt.Scan(&phrase.Id, &phrase.Character, &phrase.Phrase, &phrase.Definition, &phrase.Freq)
+		if err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting phrase data", "err", err)
+			continue
+		}
+		dump.Phrases = append(dump.Phrases, phrase)
+	}
+	return dump
+}
+
 // requestThread is the "DB thread", an internal running goroutine
-// that handles lookup requests coming into the requestQueue channel
+// that handles lookup requests coming into the request queue channels.
+// It closes done once the request queue is closed
 func (ref ReferenceStore) requestThread() {
-	for request := range ref.requestQueue {
-		request.WriteBack <- ref.Get(request.Char)
+	for {
+		select {
+		case request, ok := <-ref.requestQueue:
+			if !ok {
+				close(ref.done)
+				return
+			}
+			if request.Language != "" {
+				request.WriteBack <- ref.GetByTranslation(request.Char.Definition, request.Language)
+			} else {
+				request.WriteBack <- ref.Get(request.Char)
+			}
+		case request := <-ref.phraseQueue:
+			phrases, _ := ref.GetPhrases(request.CharacterId)
+			request.WriteBack <- phrases
+		case request := <-ref.dumpQueue:
+			request.WriteBack <- ref.GetAll()
+		case request := <-ref.importQueue:
+			request.WriteBack <- ref.ApplyImport(request)
+		case request := <-ref.definitionQueue:
+			request.WriteBack <- ref.GetDefinitions(request)
+		case request := <-ref.translationQueue:
+			request.WriteBack <- ref.ApplyTranslationImport(request)
+		case request := <-ref.dialectQueue:
+			request.WriteBack <- ref.GetDialectReadings(request)
+		case request := <-ref.dialectImportQueue:
+			request.WriteBack <- ref.ApplyDialectImport(request)
+		case request := <-ref.jyutpingQueue:
+			request.WriteBack <- ref.GetJyutping(request)
+		case request := <-ref.jyutpingImportQueue:
+			request.WriteBack <- ref.ApplyJyutpingImport(request)
+		case request := <-ref.adminQueue:
+			request.WriteBack <- ref.ApplyAdmin(request)
+		case request := <-ref.userDictQueue:
+			request.WriteBack <- ref.ApplyUserDictionary(request)
+		}
 	}
 }
 
-// Cleans up chan and shuts down, saving the cache
+// Cleans up chan and shuts down, saving the cache once the DB thread has
+// stopped using it and the database. A store opened without the cache
+// leaves the saved one alone
 func (ref ReferenceStore) Close() {
 	close(ref.requestQueue)
+	<-ref.done
+	if err := ref.conn.Close(); err != nil {
+		logger.Warn("unable to close the database", "db", ref.dbName, "err", err)
+	}
 
-	// write cache to file
-	buffer := new(bytes.Buffer)
-	enc := gob.NewEncoder(buffer)
-	err := enc.Encode(&ref)
-	if err != nil {
-		panic(err)
+	if !ref.useCache {
+		return
 	}
-	err = ioutil.WriteFile("globalCache.gob", buffer.Bytes(), 0600)
-	if err != nil {
-		panic(err)
+
+	// write cache to file
+	if err := WriteSnapshot(ref.dbName, ref.GlobalCache); err != nil {
+		logger.Warn("unable to save the cache snapshot", "path", snapshotPath(ref.dbName), "err", err)
 	}
 }
 
+// AutoMigrate has NewReference apply pending schema migrations. When it is
+// off NewReference refuses a database whose schema is not up to date
+var AutoMigrate = true
+
 // NewReference initializes the database and returns a Reference object
 func NewReference(dbName string, useCache bool) *ReferenceStore {
-	ref := ReferenceStore{nil, make(chan *CharLookupRequest), make(map[string]*CharLookupResponse)}
+	ref := ReferenceStore{nil, make(chan *CharLookupRequest), make(chan *PhraseLookupRequest), make(chan *DumpRequest), make(chan *ImportRequest),
+		make(chan *DefinitionsRequest), make(chan *TranslationImportRequest),
+		make(chan *DialectLookupRequest), make(chan *DialectImportRequest),
+		make(chan *JyutpingLookupRequest), make(chan *JyutpingImportRequest),
+		make(chan *AdminRequest), make(chan *UserDictRequest), make(map[string]*CharLookupResponse), dbName, make(chan bool), useCache}
 	conn, err := sqlite.Open(dbName)
 	if err != nil {
-		fmt.Println("Unable to open the database: %s", err)
+		logger.Error("unable to open the database", "db", dbName, "err", err)
 		os.Exit(1)
 	}
 	ref.conn = conn
 
-	// Create and initialize the database, if it is not yet populated
-	ref.conn.Exec(`CREATE TABLE IF NOT EXISTS characters( id INTEGER PRIMARY KEY AUTOINCREMENT,
-							      character VARCHAR(4),
-							      zhuyin VARCHAR(12),
-							      pinyin VARCHAR(5),
-							      tone INTEGER, 
-							      definition TEXT,
-							      freq INT );`)
-	ref.conn.Exec(`CREATE TABLE IF NOT EXISTS phrases( id INTEGER PRIMARY KEY AUTOINCREMENT,
-							   character INT,
-							   phrase VARCHAR(50),
-							   definition TEXT,
-							   freq INT) `)
+	// Create the database, or bring its schema up to date
+	if err = CheckSchema(ref.conn, AutoMigrate); err != nil {
+		logger.Error("database schema is not usable", "db", dbName, "err", err)
+		os.Exit(1)
+	}
 
 	//insertSql := `INSERT INTO characters(character, zhuyin, pinyin, tone, definition, freq)
 	//		      VALUES("我","WO","wo",3,"I, me", 0);`
@@ -258,20 +516,7 @@ func NewReference(dbName string, useCache bool) *ReferenceStore {
 
 	// load from caches
 	if useCache {
-
-		// clean up cache and build new objects
-		cacheFP, err := ioutil.ReadFile("globalCache.gob")
-		if err == nil {
-
-			cacheBytes := bytes.NewBuffer(cacheFP)
-			cacheGobObj := gob.NewDecoder(cacheBytes)
-			err = cacheGobObj.Decode(&ref)
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			fmt.Println("Error loading globalCache.gob, continuing")
-		}
+		ref.GlobalCache = LoadSnapshot(dbName)
 	}
 
 	// Start the DB thread
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testCharacters are the rows of the test database
+var testCharacters = []Character{
+	{1, "我", "ㄨㄛ", "wo", 3, "I, me", 100, ""},
+	{2, "窩", "ㄨㄛ", "wo", 1, "nest", 20, ""},
+	{3, "握", "ㄨㄛ", "wo", 4, "grasp", 30, ""},
+	{4, "沃", "ㄨㄛ", "wo", 4, "fertile", 10, ""},
+	{5, "們", "ㄇㄣ", "men", 5, "plural marker", 80, ""},
+	{6, "行", "ㄒㄧㄥ", "xing", 2, "walk", 50, ""},
+	{7, "行", "ㄏㄤ", "hang", 2, "row, profession", 40, ""},
+	{8, "銀", "ㄧㄣ", "yin", 2, "silver", 30, ""},
+	{9, "走", "ㄗㄡ", "zou", 3, "walk", 60, ""},
+}
+
+// newTestReference returns a reference store on a fresh database in a
+// temporary directory, holding testCharacters and the phrase 銀行
+func newTestReference(t *testing.T) *ReferenceStore {
+	t.Helper()
+	ref := NewReference(filepath.Join(t.TempDir(), "test.db"), false)
+	t.Cleanup(ref.Close)
+	for _, c := range testCharacters {
+		err := ref.conn.Exec("INSERT INTO characters(id, character, zhuyin, pinyin, tone, definition, freq) VALUES(?, ?, ?, ?, ?, ?, ?)",
+			c.Id, c.Character, c.Zhuyin, c.Pinyin, c.Tone, c.Definition, c.Freq)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ref.conn.Exec("INSERT INTO phrases(character, phrase, definition, freq) VALUES(7, '銀行', 'bank', 90)"); err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func TestGetByZhuyin(t *testing.T) {
+	ref := newTestReference(t)
+	result, n := ref.GetByZhuyin("ㄨㄛ4")
+	if n != 2 || (*result)[0].Character != "握" || (*result)[1].Character != "沃" {
+		t.Errorf("GetByZhuyin(ㄨㄛ4) = %v, want 握 then 沃", *result)
+	}
+	if _, n = ref.GetByZhuyin("ㄨㄛ"); n != 4 {
+		t.Errorf("GetByZhuyin(ㄨㄛ) found %d, want the 4 of every tone", n)
+	}
+}
+
+func TestGetByCharPhrase(t *testing.T) {
+	ref := newTestReference(t)
+	result, n := ref.GetByChar("銀行")
+	if n != 1 || (*result)[0].Character != "銀行" || (*result)[0].Definition != "bank" {
+		t.Errorf("GetByChar(銀行) = %v, want the phrase", *result)
+	}
+	if _, n = ref.GetByChar("行走"); n != 0 {
+		t.Errorf("GetByChar(行走) found %d, want no phrase", n)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// pinyinSyllable matches a single toneless Hanyu Pinyin syllable
+var pinyinSyllable = regexp.MustCompile(`^(zh|ch|sh|[bpmfdtnlgkhjqxrzcsyw])?` +
+	`(iang|iong|uang|ang|eng|ing|ong|ian|iao|uai|uan|ai|ei|ao|ou|an|en|er|ia|ie|iu|in|ua|uo|ui|un|ue|ve|üe|a|o|e|i|u|v|ü)$`)
+
+// replOptions are the settings toggled from the REPL prompt
+type replOptions struct {
+	queryType string
+	tone      bool
+	fuzzy     bool
+	limit     int
+	languages []string
+}
+
+// replHelp lists the REPL commands
+const replHelp = `Type zhuyin (ㄨㄛˇ or ㄨㄛ3), pinyin (wo3), characters (我) or English (I)
+to look up candidates. Commands:
+  :type auto|zhuyin|pinyin|char|def   force the query type (default auto)
+  :type nan|hak                       look up Hokkien or Hakka readings in extended Zhuyin
+  :type jyutping                      look up Cantonese readings (nei5, neihou)
+  :tone on|off                        honour or ignore typed tones
+  :fuzzy on|off                       substring (on) or exact (off) reading match
+  :limit N                            show at most N candidates
+  :lang de,ja                         preferred definition languages, none for English
+  :metrics                            print the lookup statistics so far
+  :help                               show this help
+  :quit                               leave
+`
+
+// RunRepl reads queries from in and prints candidate tables to out until
+// in is exhausted or :quit is entered
+func RunRepl(ref *ReferenceStore, args []string, in io.Reader, out io.Writer) {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	limit := flags.Int("limit", 20, "Number of candidates to show")
+	fuzzy := flags.Bool("fuzzy", true, "Match readings as substrings")
+	tone := flags.Bool("tone", true, "Honour typed tones")
+	lang := flags.String("lang", "", "Comma separated preferred definition languages")
+	flags.Parse(args)
+
+	options := &replOptions{"auto", *tone, *fuzzy, *limit, ParseLanguages(*lang)}
+	fmt.Fprint(out, replHelp)
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			if !replCommand(options, line[1:], out) {
+				return
+			}
+			continue
+		}
+		replQuery(ref, options, line, out)
+	}
+}
+
+// replCommand applies a colon command, returning false on :quit
+func replCommand(options *replOptions, line string, out io.Writer) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	arg := ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+
+	switch fields[0] {
+	case "q", "quit", "exit":
+		return false
+	case "h", "help":
+		fmt.Fprint(out, replHelp)
+	case "type":
+		switch arg {
+		case "auto", "zhuyin", "pinyin", "char", "def", "jyutping", DIALECT_HOKKIEN, DIALECT_HAKKA:
+			options.queryType = arg
+		default:
+			fmt.Fprintln(out, "type must be one of auto, zhuyin, pinyin, char, def, jyutping, nan, hak")
+		}
+	case "tone":
+		options.tone = arg != "off"
+	case "fuzzy":
+		options.fuzzy = arg != "off"
+	case "limit":
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			options.limit = n
+		} else {
+			fmt.Fprintln(out, "limit must be a positive number")
+		}
+	case "lang":
+		options.languages = ParseLanguages(arg)
+	case "metrics":
+		metrics.Expose(out)
+		return true
+	default:
+		fmt.Fprintf(out, "unknown command :%s, try :help\n", fields[0])
+		return true
+	}
+	fmt.Fprintf(out, "type=%s tone=%v fuzzy=%v limit=%d lang=%s\n", options.queryType, options.tone, options.fuzzy, options.limit,
+		strings.Join(options.languages, ","))
+	return true
+}
+
+// detectQueryType guesses what kind of input a query is
+func detectQueryType(query string) string {
+	r, _ := utf8.DecodeRuneInString(query)
+	switch {
+	case isZhuyin(string(r)):
+		return "zhuyin"
+	case unicode.Is(unicode.Han, r):
+		return "char"
+	}
+	lower := strings.ToLower(query)
+	if n := len(lower); n > 1 && lower[n-1] >= '0' && lower[n-1] <= '6' {
+		lower = lower[:n-1]
+	}
+	// without an initial, syllables starting with i, u or ü are spelled
+	// with y or w, so English words such as I are not read as Pinyin
+	if m := pinyinSyllable.FindStringSubmatch(lower); m != nil && (m[1] != "" || strings.IndexAny(m[2], "iuvü") != 0) {
+		return "pinyin"
+	}
+	return "def"
+}
+
+// replaceToneMarks turns trailing Zhuyin tone marks into tone numbers
+func replaceToneMarks(zhuyin string) string {
+	for mark, tone := range toneMarks {
+		if strings.HasSuffix(zhuyin, mark) {
+			return strings.TrimSuffix(zhuyin, mark) + strconv.Itoa(tone)
+		}
+	}
+	return zhuyin
+}
+
+// replQuery runs a single lookup and prints the candidates
+func replQuery(ref *ReferenceStore, options *replOptions, query string, out io.Writer) {
+	queryType := options.queryType
+	if queryType == "auto" {
+		queryType = detectQueryType(query)
+	}
+	if queryType == "zhuyin" {
+		query = replaceToneMarks(query)
+	}
+	reading, tone := ref.SeparatePhonetic(query)
+	if dialect, ok := GetDialect(queryType); ok {
+		var err error
+		if reading, tone, err = dialect.Syllable(query); err != nil {
+			fmt.Fprintln(out, err)
+			return
+		}
+		if !options.tone {
+			query, tone = reading, -1
+		}
+	}
+	var syllables []string
+	if queryType == "jyutping" {
+		var ok bool
+		if syllables, ok = SegmentJyutping(query); !ok {
+			fmt.Fprintf(out, "%q is not Jyutping\n", query)
+			return
+		}
+		reading, tone, _ = ParseJyutping(syllables[0])
+		if len(syllables) > 1 {
+			reading, tone = strings.Join(syllables, " "), -1
+			fmt.Fprintf(out, "syllables: %s\n", reading)
+		}
+		if !options.tone {
+			for i, syllable := range syllables {
+				syllables[i], _, _ = ParseJyutping(syllable)
+			}
+		}
+	}
+	if !options.tone && (queryType == "zhuyin" || queryType == "pinyin") {
+		query, tone = reading, -1
+	}
+
+	start := time.Now()
+	var result *[]Character
+	switch queryType {
+	case "zhuyin":
+		result, _ = ref.GetByZhuyin(query)
+	case "pinyin":
+		result, _ = ref.GetByPinyin(query)
+	case "char":
+		result, _ = ref.GetByChar(query)
+	case DIALECT_HOKKIEN, DIALECT_HAKKA:
+		result, _, _ = ref.GetByDialect(queryType, query)
+	case "jyutping":
+		result, _ = ref.GetByJyutpingSyllables(syllables)
+	default:
+		result, _ = ref.GetByDefinition(query, options.languages...)
+	}
+	elapsed := time.Since(start)
+
+	var candidates []Character
+	for _, c := range *result {
+		if !options.fuzzy && (queryType == "zhuyin" && c.Zhuyin != reading || queryType == "pinyin" && c.Pinyin != reading) {
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	total := len(candidates)
+	if len(candidates) > options.limit {
+		candidates = candidates[:options.limit]
+	}
+	candidates = ref.Localize(candidates, options.languages)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if queryType == "jyutping" {
+		fmt.Fprintln(w, "#\tChar\tJyutping\tZhuyin\tPinyin\tFreq\tDefinition")
+		for i, c := range candidates {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s%d\t%d\t%s\n", i+1, c.Character, c.Jyutping, c.Zhuyin, c.Pinyin, c.Tone, c.Freq,
+				truncate(c.Definition, 40))
+		}
+	} else {
+		fmt.Fprintln(w, "#\tChar\tZhuyin\tPinyin\tTone\tFreq\tDefinition")
+		for i, c := range candidates {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", i+1, c.Character, c.Zhuyin, c.Pinyin, c.Tone, c.Freq, truncate(c.Definition, 40))
+		}
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%s query %q tone=%d: showing %d of %d in %v\n", queryType, reading, tone, len(candidates), total, elapsed)
+}
+
+// truncate shortens s to at most n runes, marking the cut with an ellipsis
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
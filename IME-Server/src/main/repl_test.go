@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// replSession is a scripted REPL session: every line typed, with text its
+// answer must contain. Lookup answers end with their timing, which varies
+var replSession = []struct {
+	line string
+	want []string
+}{
+	{"ㄨㄛˋ", []string{"握", "沃", `zhuyin query "ㄨㄛ" tone=4: showing 2 of 2`}},
+	{":limit 1", []string{"type=auto tone=true fuzzy=true limit=1 lang=\n"}},
+	{"ㄨㄛ4", []string{"握", "showing 1 of 2"}},
+	{":tone off", []string{"tone=false"}},
+	{"ㄨㄛˇ", []string{"我", `zhuyin query "ㄨㄛ" tone=-1: showing 1 of 4`}},
+	{":limit 20", []string{"limit=20"}},
+	// fuzzy readings match as substrings
+	{"ㄧ", []string{"行", "銀", "showing 2 of 2"}},
+	{":fuzzy off", []string{"fuzzy=false"}},
+	{"ㄧ", []string{"showing 0 of 0"}},
+	{"ㄧㄣ", []string{"銀", "showing 1 of 1"}},
+	{":type pinyin", []string{"type=pinyin"}},
+	{"wo3", []string{`pinyin query "wo" tone=-1: showing 4 of 4`}},
+	{":type klingon", []string{"type must be one of", "type=pinyin"}},
+	{":limit 0", []string{"limit must be a positive number", "limit=20"}},
+	{":bogus", []string{"unknown command :bogus, try :help"}},
+	{":type auto", []string{"type=auto"}},
+	{"walk", []string{"走", "行", `def query "walk"`, "showing 2 of 2"}},
+	{"I", []string{"我", `def query "I"`}},
+	{":lang de,ja", []string{"lang=de,ja"}},
+	{":help", []string{":type auto|zhuyin|pinyin|char|def"}},
+	{":quit", nil},
+}
+
+func TestReplSession(t *testing.T) {
+	var in strings.Builder
+	for _, step := range replSession {
+		in.WriteString(step.line + "\n")
+	}
+	// nothing after :quit is read
+	in.WriteString("我\n")
+
+	var out strings.Builder
+	RunRepl(newTestReference(t), nil, strings.NewReader(in.String()), &out)
+
+	// the help comes first, then every answer follows the prompt
+	answers := strings.Split(out.String(), "> ")
+	if !strings.HasPrefix(answers[0], replHelp) || len(answers) != len(replSession)+1 {
+		t.Fatalf("session of %d answers:\n%s", len(answers)-1, out.String())
+	}
+	for i, step := range replSession {
+		answer := answers[i+1]
+		for _, want := range step.want {
+			if !strings.Contains(answer, want) {
+				t.Errorf("%s answered %q, want %q", step.line, answer, want)
+			}
+		}
+	}
+	if last := answers[len(replSession)]; last != "" {
+		t.Errorf(":quit answered %q", last)
+	}
+}
+
+func TestReplEndOfInput(t *testing.T) {
+	var out strings.Builder
+	RunRepl(newTestReference(t), []string{"-limit", "1", "-tone=false"}, strings.NewReader("\nㄨㄛ"), &out)
+	// the flags set the limit and the tone option
+	if !strings.Contains(out.String(), `zhuyin query "ㄨㄛ" tone=-1: showing 1 of 4`) {
+		t.Errorf("session = %q", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "> \n") {
+		t.Errorf("session ends with %q, want a prompt and a newline", out.String())
+	}
+}
+
+func TestDetectQueryType(t *testing.T) {
+	tests := map[string]string{
+		"ㄨㄛˇ": "zhuyin", "我": "char", "wo3": "pinyin", "zhuang": "pinyin", "ai4": "pinyin", "er": "pinyin",
+		"I": "def", "in": "def", "walk": "def",
+	}
+	for query, want := range tests {
+		if got := detectQueryType(query); got != want {
+			t.Errorf("detectQueryType(%q) = %s, want %s", query, got, want)
+		}
+	}
+}
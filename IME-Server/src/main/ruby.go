@@ -0,0 +1,135 @@
+package main
+
+import (
+	"code.google.com/p/go.net/html"
+	"code.google.com/p/go.net/html/atom"
+	"flag"
+	"io"
+	"os"
+)
+
+// rubySkip are the elements whose text is never annotated: scripts and
+// styles are not prose, ruby is already annotated and the others cannot
+// hold markup
+var rubySkip = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Ruby:     true,
+	atom.Rt:       true,
+	atom.Rp:       true,
+	atom.Title:    true,
+	atom.Textarea: true,
+	atom.Noscript: true,
+}
+
+// RubyConverter adds Zhuyin (or Pinyin) readings over the Chinese text of
+// HTML documents using <ruby> markup
+type RubyConverter struct {
+	annotator *Annotator
+	usePinyin bool
+}
+
+// NewRubyConverter returns a converter reading from ref
+func NewRubyConverter(ref *ReferenceStore, usePinyin bool) *RubyConverter {
+	return &RubyConverter{NewAnnotator(ref), usePinyin}
+}
+
+// Convert parses the HTML document in r and writes it to w with every run
+// of Chinese characters wrapped in <ruby>, each character followed by its
+// reading in <rt>. Existing markup is preserved
+func (rc *RubyConverter) Convert(r io.Reader, w io.Writer) error {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return err
+	}
+	rc.walk(doc)
+	return html.Render(w, doc)
+}
+
+// walk annotates the text nodes below n
+func (rc *RubyConverter) walk(n *html.Node) {
+	if n.Type == html.ElementNode && rubySkip[n.DataAtom] {
+		return
+	}
+	if n.Type == html.TextNode {
+		rc.annotateText(n)
+		return
+	}
+	// annotateText replaces nodes, so find the next sibling first
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		rc.walk(c)
+		c = next
+	}
+}
+
+// elementNode returns a new element node with the given children
+func elementNode(a atom.Atom, children ...*html.Node) *html.Node {
+	n := &html.Node{Type: html.ElementNode, DataAtom: a, Data: a.String()}
+	for _, c := range children {
+		n.AppendChild(c)
+	}
+	return n
+}
+
+// textNode returns a new text node
+func textNode(data string) *html.Node {
+	return &html.Node{Type: html.TextNode, Data: data}
+}
+
+// annotateText replaces a text node by plain text and <ruby> runs
+func (rc *RubyConverter) annotateText(n *html.Node) {
+	annotations := rc.annotator.Annotate(n.Data)
+	annotated := false
+	for _, a := range annotations {
+		if a.Zhuyin != "" {
+			annotated = true
+			break
+		}
+	}
+	if !annotated {
+		return
+	}
+
+	parent := n.Parent
+	var ruby *html.Node
+	for _, a := range annotations {
+		if a.Zhuyin == "" {
+			parent.InsertBefore(textNode(a.Text), n)
+			ruby = nil
+			continue
+		}
+		if ruby == nil {
+			ruby = elementNode(atom.Ruby)
+			parent.InsertBefore(ruby, n)
+		}
+		reading := a.Zhuyin
+		if rc.usePinyin {
+			reading = a.Pinyin
+		}
+		ruby.AppendChild(textNode(a.Text))
+		ruby.AppendChild(elementNode(atom.Rp, textNode("(")))
+		ruby.AppendChild(elementNode(atom.Rt, textNode(reading)))
+		ruby.AppendChild(elementNode(atom.Rp, textNode(")")))
+	}
+	parent.RemoveChild(n)
+}
+
+// RunRuby is the ruby command: it converts the named HTML file, or
+// standard input, to standard output
+func RunRuby(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("ruby", flag.ExitOnError)
+	usePinyin := flags.Bool("pinyin", false, "Annotate with Pinyin instead of Zhuyin")
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	return NewRubyConverter(ref, *usePinyin).Convert(in, os.Stdout)
+}
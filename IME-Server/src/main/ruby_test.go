@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// rubyHead and rubyTail wrap the body of the documents html.Render writes
+const (
+	rubyHead = "<html><head></head><body>"
+	rubyTail = "</body></html>"
+)
+
+func TestRubyConvert(t *testing.T) {
+	rc := NewRubyConverter(newTestReference(t), false)
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"text", "<p>我們去銀行</p>",
+			"<p><ruby>我<rp>(</rp><rt>ㄨㄛˇ</rt><rp>)</rp>們<rp>(</rp><rt>˙ㄇㄣ</rt><rp>)</rp></ruby>去" +
+				"<ruby>銀<rp>(</rp><rt>ㄧㄣˊ</rt><rp>)</rp>行<rp>(</rp><rt>ㄏㄤˊ</rt><rp>)</rp></ruby></p>"},
+		{"markup", `<p class="x">ok <b>走</b>!</p>`,
+			`<p class="x">ok <b><ruby>走<rp>(</rp><rt>ㄗㄡˇ</rt><rp>)</rp></ruby></b>!</p>`},
+		{"no readings", "<p>去 ok</p>", "<p>去 ok</p>"},
+		{"script", "<div><script>var s = '我';</script></div>", "<div><script>var s = '我';</script></div>"},
+		{"style", "<div><style>p::before { content: '我' }</style></div>", "<div><style>p::before { content: '我' }</style></div>"},
+		{"textarea", "<textarea>我們</textarea>", "<textarea>我們</textarea>"},
+		{"noscript", "<div><noscript>我們</noscript></div>", "<div><noscript>我們</noscript></div>"},
+		{"ruby", "<ruby>我<rt>wǒ</rt></ruby>", "<ruby>我<rt>wǒ</rt></ruby>"},
+	}
+	for _, test := range tests {
+		var out strings.Builder
+		if err := rc.Convert(strings.NewReader(test.in), &out); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if want := rubyHead + test.want + rubyTail; out.String() != want {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, out.String(), want)
+		}
+	}
+
+	// the title is in the head
+	var out strings.Builder
+	if err := rc.Convert(strings.NewReader("<title>我們</title><p>我</p>"), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "<html><head><title>我們</title></head><body><p><ruby>我<rp>(</rp><rt>ㄨㄛˇ</rt><rp>)</rp></ruby></p>" + rubyTail
+	if out.String() != want {
+		t.Errorf("title:\n got %s\nwant %s", out.String(), want)
+	}
+}
+
+func TestRubyPinyin(t *testing.T) {
+	var out strings.Builder
+	if err := NewRubyConverter(newTestReference(t), true).Convert(strings.NewReader("<p>銀行</p>"), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := rubyHead + "<p><ruby>銀<rp>(</rp><rt>yin2</rt><rp>)</rp>行<rp>(</rp><rt>hang2</rt><rp>)</rp></ruby></p>" + rubyTail
+	if out.String() != want {
+		t.Errorf("Pinyin:\n got %s\nwant %s", out.String(), want)
+	}
+}
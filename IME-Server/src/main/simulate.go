@@ -0,0 +1,413 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// FORMAT_HTML is the HTML output format of the simulation report
+const FORMAT_HTML = "html"
+
+// Fingers, from the left pinky to the right pinky. Both thumbs share the
+// space bar and are counted as one
+const (
+	FINGER_LEFT_PINKY = iota
+	FINGER_LEFT_RING
+	FINGER_LEFT_MIDDLE
+	FINGER_LEFT_INDEX
+	FINGER_THUMB
+	FINGER_RIGHT_INDEX
+	FINGER_RIGHT_MIDDLE
+	FINGER_RIGHT_RING
+	FINGER_RIGHT_PINKY
+	fingerCount
+)
+
+// fingerNames label the fingers in reports
+var fingerNames = []string{"L pinky", "L ring", "L middle", "L index", "thumb", "R index", "R middle", "R ring", "R pinky"}
+
+// columnFingers is the finger that touch typists use for each QWERTY
+// column, the same on every row
+var columnFingers = []int{
+	FINGER_LEFT_PINKY, FINGER_LEFT_RING, FINGER_LEFT_MIDDLE, FINGER_LEFT_INDEX, FINGER_LEFT_INDEX,
+	FINGER_RIGHT_INDEX, FINGER_RIGHT_INDEX, FINGER_RIGHT_MIDDLE, FINGER_RIGHT_RING,
+	FINGER_RIGHT_PINKY, FINGER_RIGHT_PINKY, FINGER_RIGHT_PINKY,
+}
+
+// Keyboard rows: the four QWERTY character rows and the space bar
+const (
+	ROW_NUMBER = iota
+	ROW_TOP
+	ROW_HOME
+	ROW_BOTTOM
+	ROW_SPACE
+)
+
+// rowEffort is the effort of striking a key on each row with the strongest
+// finger, relative to the home row
+var rowEffort = []float64{3, 1.5, 1, 2, 1}
+
+// fingerEffort scales the effort of a key by the finger striking it
+var fingerEffort = []float64{1.8, 1.4, 1.1, 1, 1, 1, 1.1, 1.4, 1.8}
+
+// Effort added when a finger must strike two different keys in a row, and
+// when one hand jumps across a row
+const (
+	sameFingerEffort = 2.0
+	rowJumpEffort    = 1.0
+)
+
+// keyPosition is where a key lies and which finger strikes it
+type keyPosition struct {
+	Key    string
+	Row    int
+	Finger int
+}
+
+// hand returns -1 for the left hand, 1 for the right and 0 for the thumbs
+func (p keyPosition) hand() int {
+	switch {
+	case p.Finger < FINGER_THUMB:
+		return -1
+	case p.Finger > FINGER_THUMB:
+		return 1
+	}
+	return 0
+}
+
+// effort returns the effort of striking the key alone
+func (p keyPosition) effort() float64 {
+	return rowEffort[p.Row] * fingerEffort[p.Finger]
+}
+
+// keyPositions maps each Zhuyin symbol and tone mark of a layout to the
+// position of the key typing it. Keys off the character rows are left out,
+// so that the symbols on them count as missing
+func keyPositions(layout *Layout) map[string]keyPosition {
+	keys := make(map[string]keyPosition)
+	byKey := make(map[string]keyPosition)
+	for _, row := range layout.Rows {
+		for _, key := range row.Keys {
+			if key.Row < ROW_NUMBER || key.Row >= ROW_SPACE || key.Column < 0 {
+				continue
+			}
+			finger := FINGER_RIGHT_PINKY
+			if key.Column < len(columnFingers) {
+				finger = columnFingers[key.Column]
+			}
+			position := keyPosition{key.Key, key.Row, finger}
+			byKey[key.Key] = position
+			if isZhuyin(key.Symbol) {
+				keys[key.Symbol] = position
+			}
+		}
+	}
+	for _, tone := range layout.ToneKeys {
+		position, ok := byKey[tone.Key]
+		if tone.Key == " " {
+			position, ok = keyPosition{" ", ROW_SPACE, FINGER_THUMB}, true
+		}
+		if ok {
+			keys[toneSymbol(tone.Tone)] = position
+		}
+	}
+	return keys
+}
+
+// readingSymbols returns the Zhuyin symbols typed for a reading, followed
+// by its tone mark. Tone marks within zhuyin are ignored
+func readingSymbols(zhuyin string, tone int) []string {
+	var symbols []string
+	for _, r := range zhuyin {
+		if isZhuyin(string(r)) {
+			symbols = append(symbols, string(r))
+		}
+	}
+	if mark := toneSymbol(tone); mark != "" {
+		symbols = append(symbols, mark)
+	}
+	return symbols
+}
+
+// annotationSymbols returns the Zhuyin symbols typed for an annotated
+// character, followed by its tone mark
+func annotationSymbols(a Annotation) []string {
+	return readingSymbols(a.Zhuyin, a.Tone)
+}
+
+// TypingSample is the symbol and symbol pair counts of a corpus typed in
+// Zhuyin, from which every layout metric is derived
+type TypingSample struct {
+	annotator *Annotator
+	Chars     int
+	unigrams  map[string]int
+	bigrams   map[[2]string]int
+}
+
+// NewTypingSample returns an empty sample reading from ref
+func NewTypingSample(ref *ReferenceStore) *TypingSample {
+	return &TypingSample{NewAnnotator(ref), 0, make(map[string]int), make(map[[2]string]int)}
+}
+
+// Add types every paragraph of a document. Pairs are counted across
+// characters but not across paragraphs
+func (ts *TypingSample) Add(doc *CorpusDocument) {
+	for _, paragraph := range doc.Paragraphs {
+		previous := ""
+		for _, a := range ts.annotator.Annotate(paragraph) {
+			if a.Zhuyin == "" {
+				continue
+			}
+			ts.Chars++
+			for _, symbol := range annotationSymbols(a) {
+				ts.unigrams[symbol]++
+				if previous != "" {
+					ts.bigrams[[2]string{previous, symbol}]++
+				}
+				previous = symbol
+			}
+		}
+	}
+}
+
+// LayoutStats are the results of typing a sample on a layout. Ratios are
+// between 0 and 1; Effort is the estimated effort per character
+type LayoutStats struct {
+	Layout      string
+	Keystrokes  int
+	Missing     int
+	FingerLoad  []float64
+	HomeRow     float64
+	SameFinger  float64
+	Alternation float64
+	RowJumps    float64
+	Effort      float64
+}
+
+// Simulate types the sample on layout. Symbols the layout cannot type are
+// counted as missing and left out of every other metric
+func Simulate(layout *Layout, sample *TypingSample) LayoutStats {
+	keys := keyPositions(layout)
+	stats := LayoutStats{Layout: layout.Name, FingerLoad: make([]float64, fingerCount)}
+
+	effort, home := 0.0, 0
+	for symbol, count := range sample.unigrams {
+		position, ok := keys[symbol]
+		if !ok {
+			stats.Missing += count
+			continue
+		}
+		stats.Keystrokes += count
+		stats.FingerLoad[position.Finger] += float64(count)
+		if position.Row == ROW_HOME {
+			home += count
+		}
+		effort += float64(count) * position.effort()
+	}
+
+	pairs, sameFinger, handPairs, alternation, rowJumps := 0, 0, 0, 0, 0
+	for bigram, count := range sample.bigrams {
+		first, ok1 := keys[bigram[0]]
+		second, ok2 := keys[bigram[1]]
+		if !ok1 || !ok2 {
+			continue
+		}
+		pairs += count
+		if first.Finger == second.Finger && first.Key != second.Key && first.Finger != FINGER_THUMB {
+			sameFinger += count
+			effort += float64(count) * sameFingerEffort
+		}
+		if first.hand() == 0 || second.hand() == 0 {
+			continue
+		}
+		handPairs += count
+		if first.hand() != second.hand() {
+			alternation += count
+		} else if math.Abs(float64(first.Row-second.Row)) >= 2 {
+			rowJumps += count
+			effort += float64(count) * rowJumpEffort
+		}
+	}
+
+	if stats.Keystrokes > 0 {
+		for finger := range stats.FingerLoad {
+			stats.FingerLoad[finger] /= float64(stats.Keystrokes)
+		}
+		stats.HomeRow = float64(home) / float64(stats.Keystrokes)
+	}
+	if pairs > 0 {
+		stats.SameFinger = float64(sameFinger) / float64(pairs)
+	}
+	if handPairs > 0 {
+		stats.Alternation = float64(alternation) / float64(handPairs)
+		stats.RowJumps = float64(rowJumps) / float64(handPairs)
+	}
+	if sample.Chars > 0 {
+		stats.Effort = effort / float64(sample.Chars)
+	}
+	return stats
+}
+
+// simulationRow is a line of the comparison report: a metric and its
+// formatted value for every layout
+type simulationRow struct {
+	Metric string
+	Values []string
+}
+
+// simulationRows lays out the stats of every layout side by side
+func simulationRows(stats []LayoutStats) []simulationRow {
+	percent := func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) }
+	measures := []struct {
+		name  string
+		value func(LayoutStats) string
+	}{
+		{"keystrokes", func(s LayoutStats) string { return fmt.Sprint(s.Keystrokes) }},
+		{"missing symbols", func(s LayoutStats) string { return fmt.Sprint(s.Missing) }},
+		{"home row", func(s LayoutStats) string { return percent(s.HomeRow) }},
+		{"same finger bigrams", func(s LayoutStats) string { return percent(s.SameFinger) }},
+		{"hand alternation", func(s LayoutStats) string { return percent(s.Alternation) }},
+		{"row jumps", func(s LayoutStats) string { return percent(s.RowJumps) }},
+		{"effort per character", func(s LayoutStats) string { return fmt.Sprintf("%.2f", s.Effort) }},
+	}
+
+	var rows []simulationRow
+	for _, metric := range measures {
+		row := simulationRow{Metric: metric.name}
+		for _, s := range stats {
+			row.Values = append(row.Values, metric.value(s))
+		}
+		rows = append(rows, row)
+	}
+	for finger, name := range fingerNames {
+		row := simulationRow{Metric: "load " + name}
+		for _, s := range stats {
+			row.Values = append(row.Values, percent(s.FingerLoad[finger]))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// WriteSimulationText writes the stats of every layout side by side as a
+// text table
+func WriteSimulationText(w io.Writer, sample *TypingSample, stats []LayoutStats) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	names := []string{"characters: " + fmt.Sprint(sample.Chars)}
+	for _, s := range stats {
+		names = append(names, s.Layout)
+	}
+	fmt.Fprintln(table, strings.Join(names, "\t")+"\t")
+	for _, row := range simulationRows(stats) {
+		fmt.Fprintln(table, row.Metric+"\t"+strings.Join(row.Values, "\t")+"\t")
+	}
+	return table.Flush()
+}
+
+// simulationPage is the HTML comparison report
+var simulationPage = template.Must(template.New("simulation").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Layout comparison</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; }
+td { text-align: right; }
+th:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>Layout comparison</h1>
+<p>{{.Chars}} characters typed.</p>
+<table>
+<tr><th>Metric</th>{{range .Stats}}<th>{{.Layout}}</th>{{end}}</tr>
+{{range .Rows}}<tr><th>{{.Metric}}</th>{{range .Values}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteSimulationHTML writes the stats of every layout side by side as an
+// HTML page
+func WriteSimulationHTML(w io.Writer, sample *TypingSample, stats []LayoutStats) error {
+	return simulationPage.Execute(w, struct {
+		Chars int
+		Stats []LayoutStats
+		Rows  []simulationRow
+	}{sample.Chars, stats, simulationRows(stats)})
+}
+
+// RunSimulate is the simulate command: it types the named corpus files, or
+// standard input, on the standard layout and every candidate layout and
+// writes the comparison to standard output
+func RunSimulate(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	compareFlag := flags.String("compare", "", "Comma separated layouts to compare with the standard one, empty for all")
+	format := flags.String("format", FORMAT_TEXT, "Output format: text or html")
+	flags.Parse(args)
+
+	if *format != FORMAT_TEXT && *format != FORMAT_HTML {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	names := []string{"standard"}
+	for _, name := range strings.Split(*compareFlag, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != "standard" {
+			names = append(names, name)
+		}
+	}
+	if *compareFlag == "" {
+		for _, name := range LayoutNames() {
+			if name != "standard" {
+				names = append(names, name)
+			}
+		}
+	}
+	var layouts []*Layout
+	for _, name := range names {
+		layout, ok := GetLayout(name)
+		if !ok {
+			return fmt.Errorf("unknown layout %q", name)
+		}
+		layouts = append(layouts, layout)
+	}
+
+	sample := NewTypingSample(ref)
+	var inputs []io.Reader
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		inputs = append(inputs, file)
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, os.Stdin)
+	}
+	for _, in := range inputs {
+		err := ReadCorpus(in, func(doc *CorpusDocument) error {
+			sample.Add(doc)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var stats []LayoutStats
+	for _, layout := range layouts {
+		stats = append(stats, Simulate(layout, sample))
+	}
+	if *format == FORMAT_HTML {
+		return WriteSimulationHTML(os.Stdout, sample, stats)
+	}
+	return WriteSimulationText(os.Stdout, sample, stats)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// sampleOf returns the typing sample of a document with the paragraphs
+func sampleOf(t *testing.T, paragraphs ...string) *TypingSample {
+	t.Helper()
+	sample := NewTypingSample(newTestReference(t))
+	sample.Add(&CorpusDocument{Paragraphs: paragraphs})
+	return sample
+}
+
+func TestTypingSampleAdd(t *testing.T) {
+	// 去 has no reading, and no pair spans the two paragraphs
+	sample := sampleOf(t, "我們去", "走")
+	if sample.Chars != 3 {
+		t.Errorf("%d characters typed, want 3", sample.Chars)
+	}
+	unigrams := map[string]int{"ㄨ": 1, "ㄛ": 1, "ˇ": 2, "ㄇ": 1, "ㄣ": 1, "˙": 1, "ㄗ": 1, "ㄡ": 1}
+	if !reflect.DeepEqual(sample.unigrams, unigrams) {
+		t.Errorf("unigrams = %v, want %v", sample.unigrams, unigrams)
+	}
+	bigrams := map[[2]string]int{
+		{"ㄨ", "ㄛ"}: 1, {"ㄛ", "ˇ"}: 1, {"ˇ", "ㄇ"}: 1, {"ㄇ", "ㄣ"}: 1, {"ㄣ", "˙"}: 1,
+		{"ㄗ", "ㄡ"}: 1, {"ㄡ", "ˇ"}: 1,
+	}
+	if !reflect.DeepEqual(sample.bigrams, bigrams) {
+		t.Errorf("bigrams = %v, want %v", sample.bigrams, bigrams)
+	}
+}
+
+func TestSimulateStandard(t *testing.T) {
+	// ㄨㄛˇ is typed j i 3, ㄇㄣ˙ a p 7
+	stats := Simulate(standardLayout(), sampleOf(t, "我們"))
+	if stats.Keystrokes != 6 || stats.Missing != 0 {
+		t.Errorf("keystrokes %d, missing %d, want 6 and 0", stats.Keystrokes, stats.Missing)
+	}
+	if stats.HomeRow != 2.0/6 {
+		t.Errorf("home row ratio %v, want 2/6 for j and a", stats.HomeRow)
+	}
+	if stats.Effort <= 0 {
+		t.Errorf("effort %v, want positive", stats.Effort)
+	}
+}
+
+func TestSimulateKeysOffTheRows(t *testing.T) {
+	layout := standardLayout()
+	for i := range layout.Rows[2].Keys {
+		key := &layout.Rows[2].Keys[i]
+		if key.Symbol == "ㄨ" {
+			key.Row = 9
+		}
+		if key.Symbol == "ㄇ" {
+			key.Column = -1
+		}
+	}
+	stats := Simulate(layout, sampleOf(t, "我們"))
+	if stats.Missing != 2 || stats.Keystrokes != 4 {
+		t.Errorf("keystrokes %d, missing %d, want 4 and the 2 symbols off the rows", stats.Keystrokes, stats.Missing)
+	}
+}
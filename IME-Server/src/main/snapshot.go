@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SNAPSHOT_MAGIC starts every cache snapshot
+const SNAPSHOT_MAGIC = "rational-ime cache"
+
+// SNAPSHOT_VERSION is the version of the snapshot format. Snapshots of
+// other versions are discarded
+const SNAPSHOT_VERSION = 1
+
+// SnapshotHeader describes a cache snapshot and the database it was taken
+// from. The cached candidates follow it
+type SnapshotHeader struct {
+	Magic      string
+	Version    int
+	DBSize     int64
+	DBModTime  time.Time
+	DBChecksum string
+	Created    time.Time
+}
+
+// snapshotPath returns the file the cache of a database is saved to
+func snapshotPath(dbName string) string {
+	return dbName + ".snapshot"
+}
+
+// dbChecksum returns the hex encoded SHA-256 of a database file
+func dbChecksum(dbName string) (string, error) {
+	file, err := os.Open(dbName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// NewSnapshotHeader describes the database as it is now
+func NewSnapshotHeader(dbName string) (*SnapshotHeader, error) {
+	info, err := os.Stat(dbName)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := dbChecksum(dbName)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotHeader{SNAPSHOT_MAGIC, SNAPSHOT_VERSION, info.Size(), info.ModTime().UTC(), checksum,
+		time.Now().UTC()}, nil
+}
+
+// Matches checks that a snapshot was taken from the database as it is now.
+// A database whose size and modification time are unchanged is taken to
+// be the same, otherwise its checksum decides
+func (header *SnapshotHeader) Matches(dbName string) error {
+	if header.Magic != SNAPSHOT_MAGIC {
+		return fmt.Errorf("not a cache snapshot")
+	}
+	if header.Version != SNAPSHOT_VERSION {
+		return fmt.Errorf("snapshot format version %d, this build reads %d", header.Version, SNAPSHOT_VERSION)
+	}
+	info, err := os.Stat(dbName)
+	if err != nil {
+		return err
+	}
+	if info.Size() == header.DBSize && info.ModTime().Equal(header.DBModTime) {
+		return nil
+	}
+	checksum, err := dbChecksum(dbName)
+	if err != nil {
+		return err
+	}
+	if checksum != header.DBChecksum {
+		return fmt.Errorf("database changed since the snapshot of %s", header.Created.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// WriteSnapshot saves the cache of a database. The snapshot is written to
+// a temporary file renamed over the old one, so that a snapshot is never
+// left half written
+func WriteSnapshot(dbName string, cache map[string]*CharLookupResponse) error {
+	header, err := NewSnapshotHeader(dbName)
+	if err != nil {
+		return err
+	}
+	path := snapshotPath(dbName)
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	enc := gob.NewEncoder(out)
+	err = enc.Encode(header)
+	if err == nil {
+		err = enc.Encode(cache)
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// ReadSnapshot loads the saved cache of a database. It fails for missing,
+// corrupt or stale snapshots
+func ReadSnapshot(dbName string) (map[string]*CharLookupResponse, error) {
+	file, err := os.Open(snapshotPath(dbName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dec := gob.NewDecoder(bufio.NewReader(file))
+	var header SnapshotHeader
+	if err = dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("corrupt snapshot header: %v", err)
+	}
+	if err = header.Matches(dbName); err != nil {
+		return nil, err
+	}
+	var cache map[string]*CharLookupResponse
+	if err = dec.Decode(&cache); err != nil {
+		return nil, fmt.Errorf("corrupt snapshot: %v", err)
+	}
+	return cache, nil
+}
+
+// LoadSnapshot loads the saved cache of a database, discarding the
+// snapshot when it cannot be used
+func LoadSnapshot(dbName string) map[string]*CharLookupResponse {
+	path := snapshotPath(dbName)
+	cache, err := ReadSnapshot(dbName)
+	switch {
+	case err == nil:
+		logger.Info("cache snapshot loaded", "path", path, "entries", len(cache))
+		return cache
+	case os.IsNotExist(err):
+		logger.Debug("no cache snapshot, starting empty", "path", path)
+	default:
+		logger.Warn("discarding cache snapshot", "path", path, "err", err)
+		os.Remove(path)
+	}
+	return make(map[string]*CharLookupResponse)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"code.google.com/p/gosqlite/sqlite"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// snapshotDB returns a database whose cache was saved on closing, holding
+// the lookup of ㄨㄛ3
+func snapshotDB(t *testing.T) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "test.db")
+	ref := NewReference(name, true)
+	err := ref.conn.Exec("INSERT INTO characters(character, zhuyin, pinyin, tone, definition, freq) VALUES('我', 'ㄨㄛ', 'wo', 3, 'I, me', 100)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, n := ref.GetByZhuyin("ㄨㄛ3"); n != 1 {
+		t.Fatalf("GetByZhuyin(ㄨㄛ3) found %d", n)
+	}
+	ref.Close()
+	return name
+}
+
+// assertDiscarded fails the test unless the snapshot of name is discarded
+// and removed on loading
+func assertDiscarded(t *testing.T, name, why string) {
+	t.Helper()
+	if _, err := ReadSnapshot(name); err == nil {
+		t.Errorf("%s snapshot was read", why)
+	}
+	if cache := LoadSnapshot(name); cache == nil || len(cache) != 0 {
+		t.Errorf("%s snapshot loaded %d entries", why, len(cache))
+	}
+	if _, err := os.Stat(snapshotPath(name)); !os.IsNotExist(err) {
+		t.Errorf("%s snapshot was not removed", why)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	name := snapshotDB(t)
+	cache, err := ReadSnapshot(name)
+	if _, ok := cache["ㄨㄛ3"]; err != nil || !ok {
+		t.Fatalf("ReadSnapshot = %v, %v, want the lookup of ㄨㄛ3", cache, err)
+	}
+
+	ref := NewReference(name, true)
+	defer ref.Close()
+	if _, ok := ref.GlobalCache["ㄨㄛ3"]; !ok || len(ref.GlobalCache) != len(cache) {
+		t.Errorf("reopened cache = %v, want the lookup of ㄨㄛ3", ref.GlobalCache)
+	}
+	if result, n := ref.GetByZhuyin("ㄨㄛ3"); n != 1 || (*result)[0].Character != "我" {
+		t.Errorf("cached GetByZhuyin(ㄨㄛ3) = %v", *result)
+	}
+}
+
+func TestSnapshotStale(t *testing.T) {
+	name := snapshotDB(t)
+	conn, err := sqlite.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Exec("UPDATE characters SET freq = 1")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertDiscarded(t, name, "stale")
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	name := snapshotDB(t)
+	if err := ioutil.WriteFile(snapshotPath(name), []byte("not a snapshot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertDiscarded(t, name, "corrupt")
+
+	// a valid header followed by a cut off cache
+	name = snapshotDB(t)
+	data, err := ioutil.ReadFile(snapshotPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := NewSnapshotHeader(name)
+	file, err := os.Create(snapshotPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gob.NewEncoder(file).Encode(header)
+	file.Write(data[len(data)-8:])
+	file.Close()
+	assertDiscarded(t, name, "truncated")
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	name := snapshotDB(t)
+	header, err := NewSnapshotHeader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Version = SNAPSHOT_VERSION + 1
+	file, err := os.Create(snapshotPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := gob.NewEncoder(file)
+	enc.Encode(header)
+	enc.Encode(map[string]*CharLookupResponse{})
+	file.Close()
+	assertDiscarded(t, name, "newer version")
+}
+
+func TestSnapshotWithoutCache(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	NewReference(name, false).Close()
+	if _, err := os.Stat(snapshotPath(name)); !os.IsNotExist(err) {
+		t.Error("store opened without the cache saved a snapshot")
+	}
+}
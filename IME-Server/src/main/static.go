@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// staticAsset is an embedded frontend file along with its validator
+type staticAsset struct {
+	content []byte
+	etag    string
+}
+
+// staticAssets maps the URL path of each embedded file to its content
+var staticAssets = loadStaticAssets()
+
+// contentTypes overrides the system MIME table for the frontend's own
+// file types, which differs between platforms
+var contentTypes = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+}
+
+// loadStaticAssets reads the embedded frontend into memory
+func loadStaticAssets() map[string]*staticAsset {
+	assets := make(map[string]*staticAsset)
+	fs.WalkDir(staticFiles, "static", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := staticFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha1.Sum(content)
+		assets[strings.TrimPrefix(name, "static")] = &staticAsset{content, `"` + hex.EncodeToString(sum[:8]) + `"`}
+		return nil
+	})
+	return assets
+}
+
+// staticHandler serves the embedded web frontend, falling back to the
+// JSON error handler for unknown paths. HTML pages are revalidated on every
+// load so that a new binary takes effect at once, other assets are cached
+// for a day and revalidated by ETag
+func (serv *ServerParams) staticHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path
+	if strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	asset, ok := staticAssets[name]
+	if !ok || (r.Method != "GET" && r.Method != "HEAD") {
+		serv.errorHandler(w, r)
+		return
+	}
+
+	ext := path.Ext(name)
+	contentType, ok := contentTypes[ext]
+	if !ok {
+		contentType = mime.TypeByExtension(ext)
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if ext == ".html" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+	w.Header().Set("ETag", asset.etag)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(asset.content))
+}
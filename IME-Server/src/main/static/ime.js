@@ -0,0 +1,201 @@
+// RationalIME is a thin web client for the IME server. All composition
+// logic runs on the server; this library only maps physical keys through a
+// keyboard layout, forwards them over the WebSocket and applies the
+// resulting preedit, candidates and commit events to a text field.
+(function (global) {
+	"use strict";
+
+	var COMPOSE_QUERY = 4;
+	var RESPONSE_OK = 0;
+
+	// Keys forwarded to the server by name
+	var NAMED_KEYS = {
+		" ": "Space",
+		"Backspace": "Backspace",
+		"Enter": "Enter",
+		"Escape": "Escape",
+		"PageUp": "PageUp",
+		"PageDown": "PageDown"
+	};
+
+	function RationalIME(options) {
+		this.target = options.target;
+		this.preeditView = options.preedit;
+		this.candidateView = options.candidates;
+		this.keyboard = options.keyboard || null;
+		this.layoutName = options.layout || "standard";
+		this.sessionID = "web-" + Math.random().toString(36).slice(2);
+		this.enabled = true;
+		this.keymap = {};
+		this.state = null;
+		this.pending = [];
+
+		var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+		this.url = options.url || scheme + location.host + "/socket";
+
+		this.target.addEventListener("keydown", this.onKeyDown.bind(this));
+		this.connect();
+		this.setLayout(this.layoutName);
+	}
+
+	// connect opens the WebSocket, reconnecting after it drops
+	RationalIME.prototype.connect = function () {
+		var self = this;
+		this.socket = new WebSocket(this.url);
+		this.socket.onopen = function () {
+			var pending = self.pending;
+			self.pending = [];
+			pending.forEach(function (key) { self.send(key); });
+		};
+		this.socket.onmessage = function (event) {
+			var response = JSON.parse(event.data);
+			if (response.ResponseType === RESPONSE_OK) {
+				self.apply(response.Data);
+			}
+		};
+		this.socket.onclose = function () {
+			setTimeout(function () { self.connect(); }, 1000);
+		};
+	};
+
+	// setLayout fetches a layout from the server and rebuilds the key map
+	RationalIME.prototype.setLayout = function (name) {
+		var self = this;
+		return fetch("/layout/" + encodeURIComponent(name))
+			.then(function (r) { return r.json(); })
+			.then(function (response) {
+				if (response.ResponseType !== RESPONSE_OK) {
+					throw new Error(response.Data);
+				}
+				var layout = response.Data;
+				self.layoutName = layout.Name;
+				self.keymap = {};
+				layout.Rows.forEach(function (row) {
+					row.Keys.forEach(function (key) {
+						if (key.Symbol !== key.Key) {
+							self.keymap[key.Key] = key.Symbol;
+						}
+					});
+				});
+				if (self.keyboard) {
+					self.keyboard.render(layout);
+				}
+				return layout;
+			});
+	};
+
+	// send forwards a key to the server, queueing it while disconnected
+	RationalIME.prototype.send = function (key) {
+		if (this.socket.readyState !== WebSocket.OPEN) {
+			this.pending.push(key);
+			return;
+		}
+		this.socket.send(JSON.stringify({
+			SessionID: this.sessionID,
+			QueryType: COMPOSE_QUERY,
+			Query: key,
+			Timestamp: Date.now()
+		}));
+	};
+
+	// toggle switches between Zhuyin and direct input
+	RationalIME.prototype.toggle = function () {
+		this.enabled = !this.enabled;
+		if (!this.enabled) {
+			this.send("Escape");
+		}
+		return this.enabled;
+	};
+
+	// press sends the key a physical key (or soft keyboard key) stands for
+	RationalIME.prototype.press = function (key) {
+		if (NAMED_KEYS.hasOwnProperty(key)) {
+			this.send(NAMED_KEYS[key]);
+		} else if (this.keymap.hasOwnProperty(key)) {
+			this.send(this.keymap[key]);
+		} else {
+			this.send(key);
+		}
+	};
+
+	RationalIME.prototype.composing = function () {
+		return this.state !== null && this.state.Preedit !== "";
+	};
+
+	RationalIME.prototype.onKeyDown = function (event) {
+		if (event.ctrlKey && event.key === " ") {
+			this.toggle();
+			event.preventDefault();
+			return;
+		}
+		if (!this.enabled || event.ctrlKey || event.altKey || event.metaKey) {
+			return;
+		}
+		var key = event.key;
+		if (key.length !== 1 && !NAMED_KEYS.hasOwnProperty(key)) {
+			return;
+		}
+		// Let editing keys through when there is nothing to compose
+		if (!this.composing() && (key === "Backspace" || key === "Enter" || key === "Escape" ||
+			key === "PageUp" || key === "PageDown")) {
+			return;
+		}
+		event.preventDefault();
+		this.press(key);
+	};
+
+	// insert places text at the caret of the target field
+	RationalIME.prototype.insert = function (text) {
+		var t = this.target;
+		var start = t.selectionStart, end = t.selectionEnd;
+		t.value = t.value.slice(0, start) + text + t.value.slice(end);
+		t.selectionStart = t.selectionEnd = start + text.length;
+	};
+
+	// deleteBack removes the character before the caret
+	RationalIME.prototype.deleteBack = function () {
+		var t = this.target;
+		var start = t.selectionStart, end = t.selectionEnd;
+		if (start === end && start > 0) {
+			start--;
+		}
+		t.value = t.value.slice(0, start) + t.value.slice(end);
+		t.selectionStart = t.selectionEnd = start;
+	};
+
+	// apply renders a CompositionState received from the server
+	RationalIME.prototype.apply = function (state) {
+		var self = this;
+		this.state = state;
+		(state.Events || []).forEach(function (event) {
+			if (event.Type === "commit" || event.Type === "passthrough") {
+				self.insert(event.Text);
+			} else if (event.Type === "backspace") {
+				self.deleteBack();
+			}
+		});
+
+		this.preeditView.textContent = state.Preedit;
+		this.candidateView.innerHTML = "";
+		// Label candidates with the keys that select them, which are not digits
+		var keys = state.SelectionKeys || [];
+		(state.Candidates || []).forEach(function (candidate, i) {
+			var item = document.createElement("li");
+			item.textContent = i < keys.length ? keys[i] + " " + candidate.Character : candidate.Character;
+			item.title = candidate.Definition;
+			item.addEventListener("mousedown", function (event) {
+				event.preventDefault();
+				self.send("Select:" + i);
+			});
+			self.candidateView.appendChild(item);
+		});
+		if (state.PageCount > 1) {
+			var page = document.createElement("li");
+			page.className = "page";
+			page.textContent = (state.Page + 1) + "/" + state.PageCount;
+			this.candidateView.appendChild(page);
+		}
+	};
+
+	global.RationalIME = RationalIME;
+})(this);
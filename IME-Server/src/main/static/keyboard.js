@@ -0,0 +1,56 @@
+// SoftKeyboard renders a layout served by /layout/<name> as clickable keys,
+// showing the Zhuyin symbol of each key with its QWERTY key beneath.
+(function (global) {
+	"use strict";
+
+	var KEY_WIDTH = 2.6; // em
+
+	function SoftKeyboard(container, onPress) {
+		this.container = container;
+		this.onPress = onPress;
+	}
+
+	SoftKeyboard.prototype.render = function (layout) {
+		var self = this;
+		this.container.innerHTML = "";
+		layout.Rows.forEach(function (row) {
+			var line = document.createElement("div");
+			line.className = "row";
+			line.style.paddingLeft = (row.Offset * KEY_WIDTH) + "em";
+			row.Keys.forEach(function (key) {
+				var button = document.createElement("button");
+				button.type = "button";
+				button.className = "key";
+				button.innerHTML = "<span class=\"symbol\"></span><span class=\"qwerty\"></span>";
+				button.firstChild.textContent = key.Symbol;
+				button.lastChild.textContent = key.Key;
+				button.title = "Shift: " + key.Shifted;
+				button.addEventListener("mousedown", function (event) {
+					event.preventDefault();
+					self.onPress(key.Key);
+				});
+				line.appendChild(button);
+			});
+			self.container.appendChild(line);
+		});
+
+		var space = document.createElement("div");
+		space.className = "row";
+		layout.ToneKeys.forEach(function (tone) {
+			if (tone.Key === " ") {
+				var button = document.createElement("button");
+				button.type = "button";
+				button.className = "key space";
+				button.textContent = "Space " + tone.Symbol;
+				button.addEventListener("mousedown", function (event) {
+					event.preventDefault();
+					self.onPress(" ");
+				});
+				space.appendChild(button);
+			}
+		});
+		this.container.appendChild(space);
+	};
+
+	global.SoftKeyboard = SoftKeyboard;
+})(this);
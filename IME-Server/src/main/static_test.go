@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getStatic requests path from the static handler with an If-None-Match
+// header when etag is set
+func getStatic(method, path, etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	(&ServerParams{}).staticHandler(w, r)
+	return w
+}
+
+func TestStaticEmbedded(t *testing.T) {
+	for _, name := range []string{"/index.html", "/ime.js", "/keyboard.js", "/ime.css"} {
+		if asset, ok := staticAssets[name]; !ok || len(asset.content) == 0 || len(asset.etag) != 18 {
+			t.Errorf("%s is not embedded with an ETag", name)
+		}
+	}
+
+	tests := []struct {
+		path        string
+		contentType string
+		cache       string
+	}{
+		{"/", "text/html; charset=utf-8", "no-cache"},
+		{"/index.html", "text/html; charset=utf-8", "no-cache"},
+		{"/ime.js", "text/javascript; charset=utf-8", "public, max-age=86400"},
+		{"/ime.css", "text/css; charset=utf-8", "public, max-age=86400"},
+	}
+	for _, test := range tests {
+		w := getStatic("GET", test.path, "")
+		name := test.path
+		if name == "/" {
+			name = "/index.html"
+		}
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), staticAssets[name].content) {
+			t.Errorf("%s = %d with %d bytes", test.path, w.Code, w.Body.Len())
+		}
+		header := w.Header()
+		if header.Get("Content-Type") != test.contentType || header.Get("Cache-Control") != test.cache ||
+			header.Get("ETag") != staticAssets[name].etag {
+			t.Errorf("%s headers = %v", test.path, header)
+		}
+	}
+}
+
+func TestStaticRevalidate(t *testing.T) {
+	etag := staticAssets["/ime.js"].etag
+	if w := getStatic("GET", "/ime.js", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("matching ETag = %d with %d bytes, want 304", w.Code, w.Body.Len())
+	}
+	if w := getStatic("GET", "/ime.js", `"0123456789abcdef"`); w.Code != http.StatusOK {
+		t.Errorf("stale ETag = %d, want 200", w.Code)
+	}
+	// the ETag of one file does not validate another
+	if w := getStatic("GET", "/ime.css", etag); w.Code != http.StatusOK {
+		t.Errorf("ETag of another file = %d, want 200", w.Code)
+	}
+	if w := getStatic("HEAD", "/ime.js", ""); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("HEAD = %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestStaticFallback(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/missing.js"},
+		{"GET", "/static/ime.js"},
+		{"GET", "/sub/"},
+		{"POST", "/ime.js"},
+	}
+	for _, test := range tests {
+		w := getStatic(test.method, test.path, "")
+		if w.Body.String() != "{code:500}" || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+			t.Errorf("%s %s = %d %q, want the error handler", test.method, test.path, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Kinds of dictionary entries that definitions belong to
+const (
+	DEFINITION_CHARACTER = "character"
+	DEFINITION_PHRASE    = "phrase"
+)
+
+// baseLanguage is the language of the definition column of the characters
+// and phrases tables, used when no preferred language has a definition
+const baseLanguage = "en"
+
+// cedictLine matches an entry of a CEDICT format dictionary such as
+// CC-CEDICT, HanDeDict or CFDICT: traditional, simplified, [pinyin], /defs/
+var cedictLine = regexp.MustCompile(`^(\S+)\s+(\S+)\s+\[([^\]]*)\]\s+/(.*)/\s*$`)
+
+// DefinitionsRequest is an object that asks the DB thread for the
+// definitions of entries, by entry id, in the first preferred language
+// each has one in
+type DefinitionsRequest struct {
+	Kind      string
+	Ids       []int
+	Languages []string
+	WriteBack chan map[int]string
+}
+
+// DictEntry is an entry of a CEDICT format dictionary
+type DictEntry struct {
+	Traditional string
+	Simplified  string
+	Readings    []ImportReading
+	Definition  string
+}
+
+// TranslationImportRequest is an object that asks the DB thread to store
+// the definitions of entries in a language
+type TranslationImportRequest struct {
+	Language  string
+	Entries   []DictEntry
+	WriteBack chan *ImportResult
+}
+
+// ParseLanguages splits a comma separated list of language codes
+func ParseLanguages(s string) []string {
+	var languages []string
+	for _, language := range strings.Split(s, ",") {
+		if language = strings.ToLower(strings.TrimSpace(language)); language != "" {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+// Definitions retrieves the definitions of entries of a kind in the first
+// of languages that each has one in. Entries without any are left out
+func (ref ReferenceStore) Definitions(kind string, ids []int, languages []string) map[int]string {
+	start := time.Now()
+	writeBack := make(chan map[int]string)
+	metrics.QueueAdd(1)
+	ref.definitionQueue <- &DefinitionsRequest{kind, ids, languages, writeBack}
+	definitions := <-writeBack
+	metrics.QueueAdd(-1)
+	metrics.ObserveQuery("definitions", time.Since(start))
+	return definitions
+}
+
+// candidateKind returns the kind of entry a candidate was read from: a
+// phrase row for two or more characters, a character row otherwise
+func candidateKind(c Character) string {
+	if utf8.RuneCountInString(c.Character) > 1 {
+		return DEFINITION_PHRASE
+	}
+	return DEFINITION_CHARACTER
+}
+
+// Localize returns a copy of candidates with their definitions in the
+// first of languages available, keeping the base definition otherwise.
+// User dictionary words, which have no row, keep theirs
+func (ref ReferenceStore) Localize(candidates []Character, languages []string) []Character {
+	if len(candidates) == 0 || len(languages) == 0 {
+		return candidates
+	}
+	ids := make(map[string][]int)
+	for _, c := range candidates {
+		if c.Id > 0 {
+			ids[candidateKind(c)] = append(ids[candidateKind(c)], c.Id)
+		}
+	}
+	definitions := make(map[string]map[int]string)
+	for kind, kindIds := range ids {
+		definitions[kind] = ref.Definitions(kind, kindIds, languages)
+	}
+
+	// candidates may be shared with the lookup cache, never change them
+	localized := make([]Character, len(candidates))
+	copy(localized, candidates)
+	for i := range localized {
+		c := &localized[i]
+		if definition, ok := definitions[candidateKind(*c)][c.Id]; ok {
+			c.Definition = definition
+		}
+	}
+	return localized
+}
+
+// GetDefinitions is the base definitions lookup function called only by
+// the DB thread
+func (ref ReferenceStore) GetDefinitions(request *DefinitionsRequest) map[int]string {
+	definitions := make(map[int]string)
+	if len(request.Ids) == 0 || len(request.Languages) == 0 {
+		return definitions
+	}
+
+	args := []interface{}{request.Kind}
+	idMarks := make([]string, len(request.Ids))
+	for i, id := range request.Ids {
+		idMarks[i] = "?"
+		args = append(args, id)
+	}
+	langMarks := make([]string, len(request.Languages))
+	for i, language := range request.Languages {
+		langMarks[i] = "?"
+		args = append(args, language)
+	}
+	searchStmt, err := ref.conn.Prepare(`SELECT entry, lang, definition FROM definitions
+						WHERE kind = ? AND entry IN (` + strings.Join(idMarks, ", ") + `)
+						AND lang IN (` + strings.Join(langMarks, ", ") + `)`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare definitions search", "err", err)
+		return definitions
+	}
+	defer searchStmt.Finalize()
+	if err = searchStmt.Exec(args...); err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while selecting definitions", "err", err)
+		return definitions
+	}
+
+	rank := make(map[string]int)
+	for i, language := range request.Languages {
+		if _, ok := rank[language]; !ok {
+			rank[language] = i
+		}
+	}
+	best := make(map[int]int)
+	for searchStmt.Next() {
+		var id int
+		var language, definition string
+		if err = searchStmt.Scan(&id, &language, &definition); err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting definition data", "err", err)
+			continue
+		}
+		if r, ok := best[id]; ok && r <= rank[language] {
+			continue
+		}
+		best[id] = rank[language]
+		definitions[id] = definition
+	}
+	return definitions
+}
+
+// GetByTranslation is the base lookup by definition in a language other
+// than the base one, called only by the DB thread. The candidates are
+// characters and phrases, carrying the definition in that language
+func (ref ReferenceStore) GetByTranslation(definition, language string) *CharLookupResponse {
+	searchStmt, err := ref.conn.Prepare(`SELECT c.id, c.character, c.zhuyin, c.pinyin, c.tone, d.definition, c.freq
+						FROM characters c JOIN definitions d ON d.kind = ? AND d.entry = c.id
+						WHERE d.lang = ? AND d.definition LIKE ?
+						UNION ALL
+						SELECT p.id, p.phrase, '', '', 0, d.definition, COALESCE(p.freq, 0)
+						FROM phrases p JOIN definitions d ON d.kind = ? AND d.entry = p.id
+						WHERE d.lang = ? AND d.definition LIKE ?
+						ORDER BY 7 DESC LIMIT 50`)
+	if err != nil {
+		metrics.Error("db_prepare")
+		logger.Error("unable to prepare translation search", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	defer searchStmt.Finalize()
+
+	err = searchStmt.Exec(DEFINITION_CHARACTER, language, "%"+definition+"%",
+		DEFINITION_PHRASE, language, "%"+definition+"%")
+	if err != nil {
+		metrics.Error("db_select")
+		logger.Error("error while selecting", "err", err)
+		return &CharLookupResponse{nil, 0}
+	}
+	var charList []Character
+	for searchStmt.Next() {
+		var c Character
+		if err = searchStmt.Scan(&c.Id, &c.Character, &c.Zhuyin, &c.Pinyin, &c.Tone, &c.Definition, &c.Freq); err != nil {
+			metrics.Error("db_scan")
+			logger.Error("error while getting row data", "err", err)
+			continue
+		}
+		charList = append(charList, c)
+	}
+	return &CharLookupResponse{charList, len(charList)}
+}
+
+// ParseCedict reads a CEDICT format dictionary, returning its entries and
+// the number of lines that could not be read
+func ParseCedict(r io.Reader) ([]DictEntry, int, error) {
+	var entries []DictEntry
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		match := cedictLine.FindStringSubmatch(line)
+		if match == nil {
+			skipped++
+			continue
+		}
+		var readings []ImportReading
+		for _, syllable := range strings.Fields(match[3]) {
+			reading, ok := parseSyllable(syllable)
+			if !ok {
+				readings = nil
+				break
+			}
+			readings = append(readings, reading)
+		}
+		if len(readings) == 0 || len(readings) != len([]rune(match[1])) {
+			skipped++
+			continue
+		}
+		definition := strings.Join(strings.Split(match[4], "/"), "; ")
+		entries = append(entries, DictEntry{match[1], match[2], readings, definition})
+	}
+	return entries, skipped, scanner.Err()
+}
+
+// ImportTranslations stores the definitions of entries in a language,
+// replacing those already stored
+func (ref ReferenceStore) ImportTranslations(language string, entries []DictEntry) *ImportResult {
+	writeBack := make(chan *ImportResult)
+	metrics.QueueAdd(1)
+	ref.translationQueue <- &TranslationImportRequest{language, entries, writeBack}
+	result := <-writeBack
+	metrics.QueueAdd(-1)
+	return result
+}
+
+// storeDefinition adds or replaces the definition of an entry in a language
+func (im *importer) storeDefinition(kind string, id int, language, definition string) error {
+	stmt, err := im.ref.conn.Prepare("SELECT definition FROM definitions WHERE kind = ? AND entry = ? AND lang = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(kind, id, language); err != nil {
+		return err
+	}
+	if stmt.Next() {
+		var old string
+		if err = stmt.Scan(&old); err != nil {
+			return err
+		}
+		if old == definition {
+			im.result.Kept++
+			return nil
+		}
+		im.result.Updated++
+		return im.ref.conn.Exec("UPDATE definitions SET definition = ? WHERE kind = ? AND entry = ? AND lang = ?",
+			definition, kind, id, language)
+	}
+	im.result.Added++
+	return im.ref.conn.Exec("INSERT INTO definitions(kind, entry, lang, definition) VALUES(?, ?, ?, ?)",
+		kind, id, language, definition)
+}
+
+// phraseIds returns the ids of the phrase rows of a phrase
+func (im *importer) phraseIds(phrase string) ([]int, error) {
+	stmt, err := im.ref.conn.Prepare("SELECT id FROM phrases WHERE phrase = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(phrase); err != nil {
+		return nil, err
+	}
+	var ids []int
+	for stmt.Next() {
+		var id int
+		if err = stmt.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// translation stores the definition of a dictionary entry on the matching
+// character rows, those with the same reading, or phrase rows
+func (im *importer) translation(language string, entry DictEntry) error {
+	var kind string
+	var ids []int
+	if len([]rune(entry.Traditional)) == 1 {
+		kind = DEFINITION_CHARACTER
+		reading := entry.Readings[0]
+		for _, c := range im.charactersOf(entry.Traditional) {
+			if c.Zhuyin == reading.Zhuyin && (reading.Tone < 0 || c.Tone == reading.Tone) {
+				ids = append(ids, c.Id)
+			}
+		}
+	} else {
+		kind = DEFINITION_PHRASE
+		var err error
+		if ids, err = im.phraseIds(entry.Traditional); err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		im.result.Skipped++
+		return nil
+	}
+	for _, id := range ids {
+		if err := im.storeDefinition(kind, id, language, entry.Definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyTranslationImport is the base definition import function called
+// only by the DB thread. The import runs in a single transaction
+func (ref ReferenceStore) ApplyTranslationImport(request *TranslationImportRequest) *ImportResult {
+	im := &importer{ref, &ImportRequest{}, &ImportResult{}, make(map[string][]Character), nil, -1}
+	return ref.importTransaction(im.result, func() error {
+		for _, entry := range request.Entries {
+			if err := im.translation(request.Language, entry); err != nil {
+				return importFailed(entry.Traditional, err)
+			}
+		}
+		return nil
+	})
+}
+
+// RunImportDefinitions is the importdefs command: it stores the
+// definitions of CEDICT format dictionaries in a language
+func RunImportDefinitions(ref *ReferenceStore, args []string) error {
+	flags := flag.NewFlagSet("importdefs", flag.ExitOnError)
+	language := flags.String("lang", "", "Language code of the definitions, e.g. de for HanDeDict or fr for CFDICT")
+	flags.Parse(args)
+
+	languages := ParseLanguages(*language)
+	if len(languages) != 1 {
+		return errors.New("-lang must give a single language code")
+	}
+	if flags.NArg() == 0 {
+		return errors.New("no dictionary to import")
+	}
+
+	var entries []DictEntry
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		parsed, skipped, err := ParseCedict(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if skipped > 0 {
+			logger.Warn("lines that are not CEDICT entries were skipped", "file", name, "count", skipped)
+		}
+		entries = append(entries, parsed...)
+	}
+
+	result := ref.ImportTranslations(languages[0], entries)
+	if result.Err != nil {
+		return result.Err
+	}
+	logger.Info("definitions imported", "lang", languages[0], "added", result.Added, "updated", result.Updated,
+		"kept", result.Kept, "unmatched", result.Skipped)
+	return nil
+}
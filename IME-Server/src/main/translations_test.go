@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testCedict is a German dictionary for the test database, with a line
+// that is not an entry and a phrase that is not in the database
+const testCedict = `# HanDeDict
+我 我 [wo3] /ich/mich/
+握 握 [wo4] /greifen/
+銀行 银行 [yin2 hang2] /Bank/
+走路 走路 [zou3 lu4] /zu Fuß gehen/
+not an entry
+`
+
+// importGerman imports testCedict into ref
+func importGerman(t *testing.T, ref *ReferenceStore) *ImportResult {
+	t.Helper()
+	entries, skipped, err := ParseCedict(strings.NewReader(testCedict))
+	if err != nil || skipped != 1 {
+		t.Fatalf("ParseCedict skipped %d, %v", skipped, err)
+	}
+	result := ref.ImportTranslations("de", entries)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	return result
+}
+
+func TestParseLanguages(t *testing.T) {
+	if got := ParseLanguages(" DE, ja,,en "); !reflect.DeepEqual(got, []string{"de", "ja", "en"}) {
+		t.Errorf("ParseLanguages = %v", got)
+	}
+}
+
+func TestImportTranslations(t *testing.T) {
+	ref := newTestReference(t)
+	result := importGerman(t, ref)
+	if result.Added != 3 || result.Skipped != 1 {
+		t.Errorf("import = %+v, want 3 added and 1 unmatched", *result)
+	}
+	if result = importGerman(t, ref); result.Kept != 3 || result.Added != 0 {
+		t.Errorf("second import = %+v, want 3 kept", *result)
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	ref := newTestReference(t)
+	importGerman(t, ref)
+
+	characters, _ := ref.GetByZhuyin("ㄨㄛ3")
+	phrases, _ := ref.GetByChar("銀行")
+	candidates := append(append([]Character{}, *characters...), *phrases...)
+	candidates = append(candidates, Character{-1, "我們", "ㄨㄛ ㄇㄣ", "wo men", 3, "", 10, ""})
+	localized := ref.Localize(candidates, []string{"ja", "de"})
+	want := []string{"ich; mich", "Bank", ""}
+	for i, c := range localized {
+		if c.Definition != want[i] {
+			t.Errorf("%s localized to %q, want %q", c.Character, c.Definition, want[i])
+		}
+	}
+	if (*characters)[0].Definition != "I, me" {
+		t.Error("Localize changed the cached candidates")
+	}
+}
+
+func TestGetByDefinition(t *testing.T) {
+	ref := newTestReference(t)
+	importGerman(t, ref)
+
+	result, n := ref.GetByDefinition("Bank", "de")
+	if n != 1 || (*result)[0].Character != "銀行" {
+		t.Errorf("GetByDefinition(Bank, de) = %v, want the phrase", *result)
+	}
+	if result, n = ref.GetByDefinition("grasp", "de"); n != 1 || (*result)[0].Character != "握" {
+		t.Errorf("GetByDefinition(grasp, de) = %v, want the English fallback", *result)
+	}
+
+	metrics.lock.Lock()
+	before := metrics.queries["definition"]
+	metrics.lock.Unlock()
+	ref.GetByDefinition("nothing", "en", "de", "en")
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if lookups := metrics.queries["definition"] - before; lookups != 2 {
+		t.Errorf("searched %d times for en, de, en, want each language once", lookups)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// User dictionary formats, besides TABLE_CIN
+const USERDICT_TEXT = "text"
+
+// User dictionary actions
+const (
+	USERDICT_LOOKUP = "lookup"
+	USERDICT_IMPORT = "import"
+	USERDICT_EXPORT = "export"
+)
+
+// maxUserDictBody bounds the size of user dictionaries sent to the API
+const maxUserDictBody = 4 << 20
+
+// errUnsafeReplace is returned for a replacing import of a dictionary that
+// was not entirely read, which would lose the user's words
+var errUnsafeReplace = errors.New("refusing to replace the dictionary: it has no entries or lines that could not be read")
+
+// UserEntry is a word of a user's own dictionary, with the reading of each
+// of its characters and a weight ranking it among the user's words. Ranked
+// marks a weight read from a format without weights, which never replaces
+// the stored one
+type UserEntry struct {
+	Id       int
+	User     string
+	Word     string
+	Readings []ImportReading
+	Weight   int
+	Ranked   bool
+}
+
+// UserDictRequest is an object that asks the DB thread to look up, import
+// or export the entries of a user's dictionary. Lookups are by the reading
+// of the first syllable, Tone -1 matching any tone. Imports with Replace
+// set remove the user's entries they do not hold, Skipped counting the lines of the
+// dictionary that could not be read
+type UserDictRequest struct {
+	User      string
+	Action    string
+	Zhuyin    string
+	Tone      int
+	Entries   []UserEntry
+	Replace   bool
+	Skipped   int
+	WriteBack chan *UserDictResult
+}
+
+// UserDictResult holds the entries a lookup or export found, or the counts
+// of an import
+type UserDictResult struct {
+	Entries []UserEntry
+	Import  *ImportResult
+	Err     error
+}
+
+// formatReadings writes readings as space separated Zhuyin syllables with
+// tone marks, the way the text format is read back
+func formatReadings(readings []ImportReading) string {
+	syllables := make([]string, len(readings))
+	for i, reading := range readings {
+		syllables[i] = strings.Join(readingSymbols(reading.Zhuyin, reading.Tone), "")
+	}
+	return strings.Join(syllables, " ")
+}
+
+// parseReadings reads the readings of a word, as Zhuyin with tone marks or
+// digits or as Pinyin, with syllables separated by spaces. Zhuyin with
+// tones may also be written without spaces
+func parseReadings(text string) ([]ImportReading, bool) {
+	var readings []ImportReading
+	for _, field := range strings.Fields(text) {
+		symbols := []string{}
+		for _, r := range field {
+			symbol := string(r)
+			if r >= '1' && r <= '5' {
+				symbol = toneSymbol(int(r - '0'))
+			}
+			symbols = append(symbols, symbol)
+		}
+		if zhuyinClass(symbols[0]) == 0 || len(symbols) > 1 && symbols[0] == "˙" {
+			reading, ok := parseSyllable(field)
+			if !ok {
+				return nil, false
+			}
+			readings = append(readings, reading)
+			continue
+		}
+		segmented, ok := SegmentZhuyin(symbols)
+		if !ok {
+			return nil, false
+		}
+		readings = append(readings, segmented...)
+	}
+	return readings, len(readings) > 0
+}
+
+// ParseUserText reads a user dictionary in the text format: one word per
+// line as word, reading and weight separated by tabs, the weight being
+// optional. It returns the number of lines that could not be read
+func ParseUserText(r io.Reader) ([]ImportEntry, int, error) {
+	var entries []ImportEntry
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			skipped++
+			continue
+		}
+		readings, ok := parseReadings(fields[1])
+		if !ok || len(readings) != utf8.RuneCountInString(fields[0]) {
+			skipped++
+			continue
+		}
+		weight := 0
+		if len(fields) > 2 {
+			var err error
+			if weight, err = strconv.Atoi(strings.TrimSpace(fields[2])); err != nil {
+				skipped++
+				continue
+			}
+		}
+		entries = append(entries, ImportEntry{fields[0], readings, weight, false})
+	}
+	return entries, skipped, scanner.Err()
+}
+
+// WriteUserText writes user entries in the text format
+func WriteUserText(w io.Writer, entries []UserEntry) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "# word\treading\tweight")
+	for _, entry := range entries {
+		fmt.Fprintf(out, "%s\t%s\t%d\n", entry.Word, formatReadings(entry.Readings), entry.Weight)
+	}
+	return out.Flush()
+}
+
+// WriteUserCin writes user entries as a .cin table keyed by Zhuyin
+func WriteUserCin(w io.Writer, name string, entries []UserEntry) error {
+	table := &DictionaryTable{name, nil, nil, time.Time{}}
+	for _, entry := range entries {
+		var syllables []string
+		for _, reading := range entry.Readings {
+			key, ok := table.syllableKey(reading.Zhuyin, reading.Tone)
+			if !ok {
+				syllables = nil
+				break
+			}
+			syllables = append(syllables, key)
+		}
+		if syllables != nil {
+			table.Entries = append(table.Entries, TableEntry{entry.Word, syllables, entry.Weight})
+		}
+	}
+	return WriteCin(w, table)
+}
+
+// ParseUserDictionary reads a user dictionary in the text or .cin format
+func ParseUserDictionary(r io.Reader, format, user string) ([]UserEntry, int, error) {
+	var parsed []ImportEntry
+	var skipped int
+	var err error
+	switch format {
+	case USERDICT_TEXT:
+		parsed, skipped, err = ParseUserText(r)
+	case TABLE_CIN:
+		parsed, skipped, err = ParseCin(r)
+	default:
+		return nil, 0, fmt.Errorf("unknown user dictionary format %q", format)
+	}
+	entries := make([]UserEntry, len(parsed))
+	for i, entry := range parsed {
+		entries[i] = UserEntry{-1, user, entry.Text, entry.Readings, entry.Freq, entry.Ranked}
+	}
+	return entries, skipped, err
+}
+
+// WriteUserDictionary writes user entries in the text or .cin format
+func WriteUserDictionary(w io.Writer, format, user string, entries []UserEntry) error {
+	switch format {
+	case USERDICT_TEXT:
+		return WriteUserText(w, entries)
+	case TABLE_CIN:
+		return WriteUserCin(w, user, entries)
+	}
+	return fmt.Errorf("unknown user dictionary format %q", format)
+}
+
+// UserDictionary runs a user dictionary action on the DB thread
+func (ref ReferenceStore) UserDictionary(request UserDictRequest) *UserDictResult {
+	request.WriteBack = make(chan *UserDictResult)
+	metrics.QueueAdd(1)
+	ref.userDictQueue <- &request
+	result := <-request.WriteBack
+	metrics.QueueAdd(-1)
+	return result
+}
+
+// MergeUserEntries returns candidates with the words of user's dictionary
+// read as zhuyin placed first, most heavily weighted first, and the system
+// candidates they repeat left out. User candidates have negative ids
+func (ref ReferenceStore) MergeUserEntries(user, zhuyin string, tone int, candidates []Character) []Character {
+	if user == "" || zhuyin == "" {
+		return candidates
+	}
+	result := ref.UserDictionary(UserDictRequest{User: user, Action: USERDICT_LOOKUP, Zhuyin: zhuyin, Tone: tone})
+	if result.Err != nil || len(result.Entries) == 0 {
+		return candidates
+	}
+
+	// candidates may be shared with the lookup cache, never change them
+	merged := make([]Character, 0, len(result.Entries)+len(candidates))
+	seen := make(map[string]bool)
+	for _, entry := range result.Entries {
+		first := entry.Readings[0]
+		var zhuyins, pinyins []string
+		for _, reading := range entry.Readings {
+			zhuyins = append(zhuyins, reading.Zhuyin)
+			pinyins = append(pinyins, reading.Pinyin)
+		}
+		merged = append(merged, Character{-entry.Id, entry.Word, strings.Join(zhuyins, " "), strings.Join(pinyins, " "),
+			first.Tone, "", entry.Weight, ""})
+		seen[entry.Word+first.Zhuyin+strconv.Itoa(first.Tone)] = true
+	}
+	for _, c := range candidates {
+		if !seen[c.Character+c.Zhuyin+strconv.Itoa(c.Tone)] {
+			merged = append(merged, c)
+		}
+	}
+	return merged
+}
+
+// encodeReadings stores readings as space separated Zhuyin syllables each
+// followed by its tone digit, none for an unknown tone
+func encodeReadings(readings []ImportReading) string {
+	syllables := make([]string, len(readings))
+	for i, reading := range readings {
+		syllables[i] = reading.Zhuyin
+		if reading.Tone >= 0 {
+			syllables[i] += strconv.Itoa(reading.Tone)
+		}
+	}
+	return strings.Join(syllables, " ")
+}
+
+// decodeReadings reads readings stored by encodeReadings
+func decodeReadings(text string) []ImportReading {
+	var readings []ImportReading
+	for _, syllable := range strings.Fields(text) {
+		tone := -1
+		if n := len(syllable); syllable[n-1] >= '0' && syllable[n-1] <= '9' {
+			tone, syllable = int(syllable[n-1]-'0'), syllable[:n-1]
+		}
+		pinyin, _ := ZhuyinToPinyin(syllable)
+		readings = append(readings, ImportReading{syllable, pinyin, tone})
+	}
+	return readings
+}
+
+// getUserEntries reads the entries of a user, all of them or those whose
+// first syllable is zhuyin
+func (ref ReferenceStore) getUserEntries(request *UserDictRequest) ([]UserEntry, error) {
+	query := `SELECT id, user, word, reading, weight FROM user_entries WHERE user = ?`
+	args := []interface{}{request.User}
+	if request.Action == USERDICT_LOOKUP {
+		query += " AND zhuyin = ?"
+		args = append(args, request.Zhuyin)
+		if request.Tone >= 0 {
+			query += " AND (tone = ? OR tone = -1)"
+			args = append(args, request.Tone)
+		}
+		query += " ORDER BY weight DESC LIMIT 50"
+	} else {
+		query += " ORDER BY weight DESC, word"
+	}
+	stmt, err := ref.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(args...); err != nil {
+		return nil, err
+	}
+	var entries []UserEntry
+	for stmt.Next() {
+		var entry UserEntry
+		var reading string
+		if err = stmt.Scan(&entry.Id, &entry.User, &entry.Word, &reading, &entry.Weight); err != nil {
+			return nil, err
+		}
+		entry.Readings = decodeReadings(reading)
+		if len(entry.Readings) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// storeUserEntry adds a user entry or updates the weight of the stored one,
+// unless the entry is only ranked
+func (ref ReferenceStore) storeUserEntry(entry UserEntry, result *ImportResult) error {
+	reading := encodeReadings(entry.Readings)
+	stmt, err := ref.conn.Prepare("SELECT id, weight FROM user_entries WHERE user = ? AND word = ? AND reading = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(entry.User, entry.Word, reading); err != nil {
+		return err
+	}
+	if !stmt.Next() {
+		result.Added++
+		first := entry.Readings[0]
+		return ref.conn.Exec("INSERT INTO user_entries(user, word, reading, zhuyin, tone, weight) VALUES(?, ?, ?, ?, ?, ?)",
+			entry.User, entry.Word, reading, first.Zhuyin, first.Tone, entry.Weight)
+	}
+	var id, weight int
+	if err = stmt.Scan(&id, &weight); err != nil {
+		return err
+	}
+	if weight == entry.Weight || entry.Ranked {
+		result.Kept++
+		return nil
+	}
+	result.Updated++
+	return ref.conn.Exec("UPDATE user_entries SET weight = ? WHERE id = ?", entry.Weight, id)
+}
+
+// removeUserEntries removes the entries of a user missing from request
+func (ref ReferenceStore) removeUserEntries(request *UserDictRequest) error {
+	keep := make(map[string]bool)
+	for _, entry := range request.Entries {
+		keep[entry.Word+"\t"+encodeReadings(entry.Readings)] = true
+	}
+	stmt, err := ref.conn.Prepare("SELECT id, word, reading FROM user_entries WHERE user = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	if err = stmt.Exec(request.User); err != nil {
+		return err
+	}
+	var removed []int
+	for stmt.Next() {
+		var id int
+		var word, reading string
+		if err = stmt.Scan(&id, &word, &reading); err != nil {
+			return err
+		}
+		if !keep[word+"\t"+reading] {
+			removed = append(removed, id)
+		}
+	}
+	for _, id := range removed {
+		if err = ref.conn.Exec("DELETE FROM user_entries WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyUserDictionary is the base user dictionary function called only by
+// the DB thread. Imports run in a single transaction. A replacing import
+// stores its entries before removing the others, so that the weights of
+// the entries it only ranks are kept
+func (ref ReferenceStore) ApplyUserDictionary(request *UserDictRequest) *UserDictResult {
+	if request.Action == USERDICT_IMPORT && request.Replace && (len(request.Entries) == 0 || request.Skipped > 0) {
+		return &UserDictResult{nil, &ImportResult{}, errUnsafeReplace}
+	}
+	if request.Action != USERDICT_IMPORT {
+		entries, err := ref.getUserEntries(request)
+		if err != nil {
+			metrics.Error("db_select")
+			logger.Error("error while selecting user entries", "user", request.User, "err", err)
+		}
+		return &UserDictResult{entries, nil, err}
+	}
+
+	result := &ImportResult{}
+	imported := ref.importTransaction(result, func() error {
+		for _, entry := range request.Entries {
+			if err := ref.storeUserEntry(entry, result); err != nil {
+				return importFailed(entry.Word, err)
+			}
+		}
+		if request.Replace {
+			return ref.removeUserEntries(request)
+		}
+		return nil
+	})
+	return &UserDictResult{nil, imported, imported.Err}
+}
+
+// userDictHandler serves /user/dictionary to the holders of a user token:
+// GET exports the user's dictionary and POST imports the one in the body,
+// in the format given by the format parameter, text or cin. With replace
+// set the import replaces the whole dictionary, unless some of the body
+// could not be read
+func (serv *ServerParams) userDictHandler(w http.ResponseWriter, r *http.Request) {
+	if !serv.allowRequest(w, r) {
+		return
+	}
+	user, ok := bearerUser(r, serv.config.UserTokens)
+	if !ok {
+		metrics.Error("unauthorized")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="user"`)
+		writeAdmin(w, http.StatusUnauthorized, errors.New("missing or unknown user token"))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = USERDICT_TEXT
+	}
+	if format != USERDICT_TEXT && format != TABLE_CIN {
+		metrics.Error("bad_request")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writeAdmin(w, http.StatusBadRequest, fmt.Errorf("unknown user dictionary format %q", format))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		result := serv.ref.UserDictionary(UserDictRequest{User: user, Action: USERDICT_EXPORT})
+		if result.Err != nil {
+			http.Error(w, result.Err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		WriteUserDictionary(w, format, user, result.Entries)
+	case "POST":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUserDictBody))
+		if err != nil {
+			metrics.Error("bad_request")
+			writeAdmin(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		entries, skipped, err := ParseUserDictionary(strings.NewReader(string(body)), format, user)
+		if err != nil {
+			metrics.Error("bad_request")
+			writeAdmin(w, http.StatusBadRequest, err)
+			return
+		}
+		result := serv.ref.UserDictionary(UserDictRequest{User: user, Action: USERDICT_IMPORT, Entries: entries,
+			Replace: r.URL.Query().Get("replace") != "", Skipped: skipped})
+		if result.Err == errUnsafeReplace {
+			metrics.Error("bad_request")
+			writeAdmin(w, http.StatusUnprocessableEntity, result.Err)
+			return
+		}
+		if result.Err != nil {
+			writeAdmin(w, http.StatusInternalServerError, result.Err)
+			return
+		}
+		result.Import.Skipped += skipped
+		writeAdmin(w, http.StatusOK, result.Import)
+	default:
+		metrics.Error("bad_request")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writeAdmin(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// RunUserDict is the userdict command: userdict import reads user
+// dictionaries into a user's entries, userdict export writes them out
+func RunUserDict(ref *ReferenceStore, args []string) error {
+	if len(args) == 0 || args[0] != USERDICT_IMPORT && args[0] != USERDICT_EXPORT {
+		return errors.New("userdict needs an action: import or export")
+	}
+	flags := flag.NewFlagSet("userdict "+args[0], flag.ExitOnError)
+	user := flags.String("user", os.Getenv("USER"), "Owner of the dictionary")
+	format := flags.String("format", USERDICT_TEXT, "Dictionary format: text (word, reading, weight) or cin")
+	replace := flags.Bool("replace", false, "Replace the user's whole dictionary on import")
+	output := flags.String("o", "", "File to export to, empty for standard output")
+	flags.Parse(args[1:])
+	if *user == "" {
+		return errors.New("-user is required")
+	}
+
+	if args[0] == USERDICT_EXPORT {
+		result := ref.UserDictionary(UserDictRequest{User: *user, Action: USERDICT_EXPORT})
+		if result.Err != nil {
+			return result.Err
+		}
+		var out io.Writer = os.Stdout
+		if *output != "" {
+			file, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+		return WriteUserDictionary(out, *format, *user, result.Entries)
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New("no dictionary to import")
+	}
+	var entries []UserEntry
+	total := 0
+	for _, name := range flags.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		parsed, skipped, err := ParseUserDictionary(file, *format, *user)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if skipped > 0 {
+			logger.Warn("lines that are not entries were skipped", "file", name, "count", skipped)
+		}
+		entries = append(entries, parsed...)
+		total += skipped
+	}
+	result := ref.UserDictionary(UserDictRequest{User: *user, Action: USERDICT_IMPORT, Entries: entries, Replace: *replace,
+		Skipped: total})
+	if result.Err != nil {
+		return result.Err
+	}
+	bytearray, _ := json.Marshal(result.Import)
+	logger.Info("user dictionary imported", "user", *user, "result", string(bytearray))
+	return nil
+}
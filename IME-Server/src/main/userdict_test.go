@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testUserText is a user dictionary in the text format, with a comment, a
+// line without a reading, a reading of the wrong length and a bad weight
+const testUserText = "# word\treading\tweight\n" +
+	"我們\tㄨㄛˇ ㄇㄣ˙\t500\n" +
+	"窩\two1\n" +
+	"握手\tㄨㄛˋㄕㄡˇ\t20\n" +
+	"沒有讀音\n" +
+	"我們\tㄨㄛˇ\t10\n" +
+	"我\tㄨㄛ3\tmany\n"
+
+func TestParseReadings(t *testing.T) {
+	tests := []struct {
+		text string
+		want []ImportReading
+	}{
+		{"ㄨㄛˇ", []ImportReading{{"ㄨㄛ", "wo", 3}}},
+		{"ㄨㄛ3 ㄇㄣ5", []ImportReading{{"ㄨㄛ", "wo", 3}, {"ㄇㄣ", "men", 5}}},
+		{"ㄨㄛˇㄇㄣ˙", []ImportReading{{"ㄨㄛ", "wo", 3}, {"ㄇㄣ", "men", 5}}},
+		{"˙ㄇㄣ", []ImportReading{{"ㄇㄣ", "men", 5}}},
+		// Pinyin without a tone number leaves the tone unknown
+		{"wo3 men", []ImportReading{{"ㄨㄛ", "wo", 3}, {"ㄇㄣ", "men", -1}}},
+	}
+	for _, test := range tests {
+		if got, ok := parseReadings(test.text); !ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseReadings(%q) = %v, %v, want %v", test.text, got, ok, test.want)
+		}
+	}
+	for _, text := range []string{"", "xyz", "ㄨㄛ6", "wo3 xyz"} {
+		if got, ok := parseReadings(text); ok {
+			t.Errorf("parseReadings(%q) = %v, want a failure", text, got)
+		}
+	}
+}
+
+func TestParseUserText(t *testing.T) {
+	entries, skipped, err := ParseUserText(strings.NewReader(testUserText))
+	if err != nil || skipped != 3 || len(entries) != 3 {
+		t.Fatalf("ParseUserText = %v, skipped %d, %v, want 3 entries and 3 skipped", entries, skipped, err)
+	}
+	want := []ImportEntry{
+		{"我們", []ImportReading{{"ㄨㄛ", "wo", 3}, {"ㄇㄣ", "men", 5}}, 500, false},
+		{"窩", []ImportReading{{"ㄨㄛ", "wo", 1}}, 0, false},
+		{"握手", []ImportReading{{"ㄨㄛ", "wo", 4}, {"ㄕㄡ", "shou", 3}}, 20, false},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("ParseUserText = %v, want %v", entries, want)
+	}
+}
+
+// importUserText imports testUserText as the dictionary of user
+func importUserText(t *testing.T, ref *ReferenceStore, user string) {
+	t.Helper()
+	entries, skipped, err := ParseUserDictionary(strings.NewReader(testUserText), USERDICT_TEXT, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := ref.UserDictionary(UserDictRequest{User: user, Action: USERDICT_IMPORT, Entries: entries, Skipped: skipped})
+	if result.Err != nil || result.Import.Added != 3 {
+		t.Fatalf("import = %+v, %v", result.Import, result.Err)
+	}
+}
+
+func TestMergeUserEntries(t *testing.T) {
+	ref := newTestReference(t)
+	importUserText(t, ref, "alice")
+
+	system, _ := ref.GetByZhuyin("ㄨㄛ3")
+	merged := ref.MergeUserEntries("alice", "ㄨㄛ", 3, *system)
+	if len(merged) != 2 || merged[0].Character != "我們" || merged[0].Id >= 0 || merged[1].Character != "我" {
+		t.Errorf("merged ㄨㄛ3 = %v, want 我們 from the user dictionary before 我", merged)
+	}
+	if merged[0].Zhuyin != "ㄨㄛ ㄇㄣ" || merged[0].Pinyin != "wo men" || merged[0].Freq != 500 {
+		t.Errorf("user candidate = %+v", merged[0])
+	}
+
+	// the user's 窩 repeats a system candidate, which is left out
+	system, _ = ref.GetByZhuyin("ㄨㄛ1")
+	if merged = ref.MergeUserEntries("alice", "ㄨㄛ", 1, *system); len(merged) != 1 || merged[0].Id >= 0 {
+		t.Errorf("merged ㄨㄛ1 = %v, want only the user's 窩", merged)
+	}
+	// any tone finds all three
+	if merged = ref.MergeUserEntries("alice", "ㄨㄛ", -1, nil); len(merged) != 3 || merged[0].Character != "我們" {
+		t.Errorf("merged ㄨㄛ = %v, want the user's words by weight", merged)
+	}
+
+	for _, user := range []string{"", "bob"} {
+		if merged = ref.MergeUserEntries(user, "ㄨㄛ", 3, *system); !reflect.DeepEqual(merged, *system) {
+			t.Errorf("merged for %q = %v, want the system candidates", user, merged)
+		}
+	}
+}
+
+func TestUserDictionaryReplace(t *testing.T) {
+	ref := newTestReference(t)
+	importUserText(t, ref, "alice")
+
+	entries, skipped, _ := ParseUserDictionary(strings.NewReader(testUserText), USERDICT_TEXT, "alice")
+	unsafe := []UserDictRequest{
+		{User: "alice", Action: USERDICT_IMPORT, Replace: true},
+		{User: "alice", Action: USERDICT_IMPORT, Replace: true, Entries: entries, Skipped: skipped},
+	}
+	for _, request := range unsafe {
+		if result := ref.UserDictionary(request); result.Err != errUnsafeReplace {
+			t.Errorf("replace with %d entries and %d skipped = %v", len(request.Entries), request.Skipped, result.Err)
+		}
+	}
+	if result := ref.UserDictionary(UserDictRequest{User: "alice", Action: USERDICT_EXPORT}); len(result.Entries) != 3 {
+		t.Fatalf("refused replace left %d entries", len(result.Entries))
+	}
+
+	result := ref.UserDictionary(UserDictRequest{User: "alice", Action: USERDICT_IMPORT, Replace: true, Entries: entries[:1]})
+	if result.Err != nil || result.Import.Kept != 1 {
+		t.Fatalf("replace = %+v, %v", result.Import, result.Err)
+	}
+	if result = ref.UserDictionary(UserDictRequest{User: "alice", Action: USERDICT_EXPORT}); len(result.Entries) != 1 {
+		t.Errorf("replace left %d entries, want 1", len(result.Entries))
+	}
+}
+
+func TestUserDictCinRoundTrip(t *testing.T) {
+	ref := newTestReference(t)
+	importUserText(t, ref, "alice")
+	exported := ref.UserDictionary(UserDictRequest{User: "alice", Action: USERDICT_EXPORT})
+	var cin strings.Builder
+	if err := WriteUserDictionary(&cin, TABLE_CIN, "alice", exported.Entries); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, skipped, err := ParseUserDictionary(strings.NewReader(cin.String()), TABLE_CIN, "alice")
+	if err != nil || skipped != 0 || len(entries) != 3 {
+		t.Fatalf("ParseUserDictionary(cin) = %v, skipped %d, %v", entries, skipped, err)
+	}
+	result := ref.UserDictionary(UserDictRequest{User: "alice", Action: USERDICT_IMPORT, Entries: entries, Replace: true})
+	if result.Err != nil || result.Import.Kept != 3 {
+		t.Fatalf("import = %+v, %v, want all 3 kept", result.Import, result.Err)
+	}
+	if after := ref.UserDictionary(UserDictRequest{User: "alice", Action: USERDICT_EXPORT}); !reflect.DeepEqual(after.Entries, exported.Entries) {
+		t.Errorf("round trip = %v, want %v", after.Entries, exported.Entries)
+	}
+
+	// a new user gets the ranks as weights
+	entries, _, _ = ParseUserDictionary(strings.NewReader(cin.String()), TABLE_CIN, "bob")
+	result = ref.UserDictionary(UserDictRequest{User: "bob", Action: USERDICT_IMPORT, Entries: entries})
+	bob := ref.UserDictionary(UserDictRequest{User: "bob", Action: USERDICT_EXPORT})
+	if result.Err != nil || len(bob.Entries) != 3 || bob.Entries[0].Weight < 1 {
+		t.Errorf("new user's entries = %v, %v", bob.Entries, result.Err)
+	}
+}
+
+func TestUserDictHandlerReplace(t *testing.T) {
+	ref := newTestReference(t)
+	importUserText(t, ref, "alice")
+	serv := &ServerParams{ref: ref, config: ServerConfig{UserTokens: map[string]string{"t0ken": "alice"}}}
+
+	post := func(body string) int {
+		r := httptest.NewRequest("POST", "/user/dictionary?replace=1", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer t0ken")
+		w := httptest.NewRecorder()
+		serv.userDictHandler(w, r)
+		return w.Code
+	}
+	// separated by spaces rather than tabs, no line is an entry
+	if status := post("我 ㄨㄛˇ 1\n我們 ㄨㄛˇㄇㄣ˙ 2\n"); status != http.StatusUnprocessableEntity {
+		t.Errorf("replace in the wrong format = %d", status)
+	}
+	if status := post(testUserText); status != http.StatusUnprocessableEntity {
+		t.Errorf("replace with skipped lines = %d", status)
+	}
+	if result := ref.UserDictionary(UserDictRequest{User: "alice", Action: USERDICT_EXPORT}); len(result.Entries) != 3 {
+		t.Errorf("refused replaces left %d entries", len(result.Entries))
+	}
+	if status := post("我\tㄨㄛˇ\t1\n"); status != http.StatusOK {
+		t.Errorf("replace = %d", status)
+	}
+}
+
+func TestComposerUserDictionary(t *testing.T) {
+	ref := newTestReference(t)
+	importUserText(t, ref, "alice")
+
+	c := NewComposer(ref)
+	c.SetUser("alice")
+	state := typeKeys(c, "ㄨ", "ㄛ", "ˇ")
+	if state.Total != 2 || state.Candidates[0].Character != "我們" {
+		t.Fatalf("composer with a user = %+v", state)
+	}
+	if got := commits(c.Key(KEY_SPACE)); !reflect.DeepEqual(got, []string{"我們"}) {
+		t.Errorf("space committed %v, want [我們]", got)
+	}
+
+	c.SetUser("")
+	if state = typeKeys(c, "ㄨ", "ㄛ", "ˇ"); state.Total != 1 || state.Candidates[0].Character != "我" {
+		t.Errorf("composer without a user = %+v", state)
+	}
+}